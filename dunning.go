@@ -0,0 +1,165 @@
+package pay
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cristosal/orm"
+)
+
+// GracePolicy determines how long a subscription with failed payments keeps counting towards the plans and features of its users
+type GracePolicy struct {
+	Period      time.Duration // time after the first failed payment until the subscription stops counting
+	MaxAttempts int           // failed attempts after which the grace period ends early, no limit when zero
+}
+
+// DefaultGracePolicy keeps subscriptions counting for a week after the first failed payment
+var DefaultGracePolicy = GracePolicy{
+	Period: 7 * 24 * time.Hour,
+}
+
+// graceEnd returns the end of the grace period of a dunning that started at start after the given failed attempts
+func (p *GracePolicy) graceEnd(start time.Time, attempts int) time.Time {
+	end := start.Add(p.Period)
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+	}
+
+	return end
+}
+
+// SetGracePolicy sets the policy used for subscriptions that start failing payments from now on.
+// Grace periods already started are kept
+func (r *Repo) SetGracePolicy(p GracePolicy) {
+	r.grace = p
+}
+
+// GetDunningBySubscriptionID returns the dunning state of the subscription, orm.ErrNotFound is returned when its payments are not failing
+func (r *Repo) GetDunningBySubscriptionID(ctx context.Context, subID int64) (*Dunning, error) {
+	var d Dunning
+	if err := orm.Get(r.conn(ctx), &d, "WHERE subscription_id = $1", subID); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListDunning returns the dunning state of all subscriptions with failing payments, the ones whose grace period ends first come first
+func (r *Repo) ListDunning(ctx context.Context) ([]Dunning, error) {
+	var dunning []Dunning
+	if err := orm.List(r.conn(ctx), &dunning, "ORDER BY grace_ends_at ASC"); err != nil {
+		return nil, err
+	}
+
+	return dunning, nil
+}
+
+// addPaymentFailure records a failed attempt to pay the invoice.
+// Attempts is the number of attempts reported by the provider, when zero the previous count is incremented
+func (r *Repo) addPaymentFailure(ctx context.Context, i *Invoice, attempts int, nextRetry *time.Time) error {
+	if i.SubscriptionID == nil {
+		r.paymentFailed(i, nil)
+		return nil
+	}
+
+	d, err := r.startDunning(ctx, *i.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	if attempts == 0 {
+		attempts = d.Attempts + 1
+	}
+
+	now := time.Now()
+	d.InvoiceID = &i.ID
+	d.Attempts = attempts
+	d.LastFailedAt = &now
+	d.NextRetryAt = nextRetry
+
+	// MaxAttempts may end the grace period early but never extends it
+	if end := r.grace.graceEnd(d.StartedAt, attempts); end.Before(d.GraceEndsAt) {
+		d.GraceEndsAt = end
+	}
+
+	if err := orm.Update(r.conn(ctx), d, "WHERE subscription_id = $1", d.SubscriptionID); err != nil {
+		return err
+	}
+
+	r.paymentFailed(i, d)
+	return nil
+}
+
+// startDunning returns the dunning state of the subscription, starting its grace period if there is none
+func (r *Repo) startDunning(ctx context.Context, subID int64) (*Dunning, error) {
+	now := time.Now()
+	d := Dunning{
+		SubscriptionID: subID,
+		StartedAt:      now,
+		GraceEndsAt:    r.grace.graceEnd(now, 0),
+	}
+
+	sql := fmt.Sprintf(`INSERT INTO %s (subscription_id, attempts, started_at, grace_ends_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subscription_id) DO NOTHING`, orm.TableName(&d))
+
+	if _, err := r.conn(ctx).Exec(sql, d.SubscriptionID, d.Attempts, d.StartedAt, d.GraceEndsAt); err != nil {
+		return nil, err
+	}
+
+	return r.GetDunningBySubscriptionID(ctx, subID)
+}
+
+// endDunning removes the dunning state of the subscription once its payments succeed again
+func (r *Repo) endDunning(ctx context.Context, subID int64) error {
+	sql := fmt.Sprintf("DELETE FROM %s WHERE subscription_id = $1", orm.TableName(&Dunning{}))
+	_, err := r.conn(ctx).Exec(sql, subID)
+	return err
+}
+
+// invoiceSaved ends the dunning of the subscription when the invoice was paid, firing the payment callback the first time it is seen as paid
+func (r *Repo) invoiceSaved(ctx context.Context, prev, i *Invoice) error {
+	if i.Status != InvoicePaid {
+		return nil
+	}
+
+	if i.SubscriptionID != nil {
+		if err := r.endDunning(ctx, *i.SubscriptionID); err != nil {
+			return err
+		}
+	}
+
+	if prev == nil || prev.Status != InvoicePaid {
+		r.paymentSucceeded(i)
+	}
+
+	return nil
+}
+
+// subscriptionSaved starts the dunning of a subscription once it is past due and ends it once it recovers
+func (r *Repo) subscriptionSaved(ctx context.Context, prev, s *Subscription) error {
+	if dunningStatus(s.Status) {
+		_, err := r.startDunning(ctx, s.ID)
+		return err
+	}
+
+	if prev != nil && dunningStatus(prev.Status) {
+		return r.endDunning(ctx, s.ID)
+	}
+
+	return nil
+}
+
+func dunningStatus(status SubscriptionStatus) bool {
+	return status == SubscriptionPastDue || status == SubscriptionUnpaid
+}
+
+// entitledSQL is the condition for subscription s to count towards the plans and features of its users.
+// Subscriptions with failing payments count until their grace period ends
+func (r *Repo) entitledSQL() string {
+	return fmt.Sprintf(`(s.active OR (s.status IN ('%s', '%s') AND EXISTS (
+		SELECT 1 FROM %s d WHERE d.subscription_id = s.id AND d.grace_ends_at > NOW()
+	)))`, SubscriptionPastDue, SubscriptionUnpaid, orm.TableName(&Dunning{}))
+}
@@ -1,32 +1,198 @@
 package pay
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
 	"time"
 )
 
-type PricingSchedule = string
+// PriceInterval is the unit of the billing period of a recurring price
+type PriceInterval = string
 
 const (
-	PricingAnnual  PricingSchedule = "annual"
-	PricingMonthly PricingSchedule = "monthly"
-	PricingOnce    PricingSchedule = "once"
+	IntervalDay   PriceInterval = "day"
+	IntervalWeek  PriceInterval = "week"
+	IntervalMonth PriceInterval = "month"
+	IntervalYear  PriceInterval = "year"
+)
+
+type UsageType = string
+
+const (
+	UsageLicensed UsageType = "licensed" // billed for the quantity of the subscription
+	UsageMetered  UsageType = "metered"  // billed for the usage recorded during the period
+)
+
+// AggregateUsage determines how the usage recorded for a metered price during a period is combined
+type AggregateUsage = string
+
+const (
+	AggregateSum              AggregateUsage = "sum"
+	AggregateMax              AggregateUsage = "max"
+	AggregateLastDuringPeriod AggregateUsage = "last_during_period"
+	AggregateLastEver         AggregateUsage = "last_ever"
+)
+
+// BillingScheme determines how the amount of a price is calculated from the quantity
+type BillingScheme = string
+
+const (
+	BillingPerUnit BillingScheme = "per_unit" // Amount is charged for each unit
+	BillingTiered  BillingScheme = "tiered"   // the amount depends on the tier the quantity falls in
+)
+
+// TiersMode determines how the tiers of a tiered price apply to the quantity
+type TiersMode = string
+
+const (
+	TiersGraduated TiersMode = "graduated" // each unit is charged at the tier it falls in
+	TiersVolume    TiersMode = "volume"    // every unit is charged at the tier the total quantity falls in
 )
 
 type Price struct {
-	ID         int64
-	PlanID     int64
-	Provider   string
-	ProviderID string
-	Amount     int64
-	Currency   string
-	Schedule   PricingSchedule
-	TrialDays  int
+	ID             int64
+	PlanID         int64
+	Provider       string
+	ProviderID     string
+	Amount         int64 // per unit for metered prices
+	Currency       string
+	Interval       PriceInterval `db:"billing_interval"` // empty for one time prices
+	IntervalCount  int           // number of intervals in a billing period, such as 3 months for quarterly prices
+	TrialDays      int
+	UsageType      UsageType
+	AggregateUsage AggregateUsage // empty for licensed prices
+	BillingScheme  BillingScheme
+	TiersMode      TiersMode   // empty unless tiered
+	DeletedAt      *time.Time  // when the price was deleted at the provider, the row is kept for the history referencing it
+	Tiers          []PriceTier `db:"-"` // ordered by UpTo, the last tier has no upper bound
 }
 
 func (p *Price) TableName() string {
 	return "pay.price"
 }
 
+// IsRecurring reports whether the price is billed every period rather than paid once
+func (p *Price) IsRecurring() bool {
+	return p.Interval != ""
+}
+
+// PeriodEnd returns the end of the billing period starting at start
+func (p *Price) PeriodEnd(start time.Time) time.Time {
+	n := max(p.IntervalCount, 1)
+	switch p.Interval {
+	case IntervalDay:
+		return start.AddDate(0, 0, n)
+	case IntervalWeek:
+		return start.AddDate(0, 0, 7*n)
+	case IntervalYear:
+		return start.AddDate(n, 0, 0)
+	default:
+		return start.AddDate(0, n, 0)
+	}
+}
+
+// PeriodStart returns the start of the billing period ending at end
+func (p *Price) PeriodStart(end time.Time) time.Time {
+	n := max(p.IntervalCount, 1)
+	switch p.Interval {
+	case IntervalDay:
+		return end.AddDate(0, 0, -n)
+	case IntervalWeek:
+		return end.AddDate(0, 0, -7*n)
+	case IntervalYear:
+		return end.AddDate(-n, 0, 0)
+	default:
+		return end.AddDate(0, -n, 0)
+	}
+}
+
+// IsMetered reports whether the price is billed for recorded usage
+func (p *Price) IsMetered() bool {
+	return p.UsageType == UsageMetered
+}
+
+// IsTiered reports whether the amount of the price is calculated from its tiers
+func (p *Price) IsTiered() bool {
+	return p.BillingScheme == BillingTiered
+}
+
+// Quote returns the amount charged for quantity units of the price
+func (p *Price) Quote(quantity int64) int64 {
+	if !p.IsTiered() {
+		return p.Amount * quantity
+	}
+
+	var (
+		total int64
+		from  int64 // units covered by the previous tiers
+	)
+
+	for _, t := range p.Tiers {
+		if p.TiersMode == TiersVolume {
+			if t.UpTo == nil || quantity <= *t.UpTo {
+				return quantity*t.UnitAmount + t.FlatAmount
+			}
+
+			continue
+		}
+
+		units := quantity - from
+		if t.UpTo != nil && *t.UpTo < quantity {
+			units = *t.UpTo - from
+		}
+
+		if units <= 0 {
+			break
+		}
+
+		total += units*t.UnitAmount + t.FlatAmount
+		if t.UpTo == nil {
+			break
+		}
+
+		from = *t.UpTo
+	}
+
+	return total
+}
+
+// validTiers reports whether the tiers are in order with only the last one being unbounded
+func (p *Price) validTiers() bool {
+	if len(p.Tiers) == 0 || p.Tiers[len(p.Tiers)-1].UpTo != nil {
+		return false
+	}
+
+	if p.TiersMode != TiersGraduated && p.TiersMode != TiersVolume {
+		return false
+	}
+
+	var prev int64
+	for _, t := range p.Tiers[:len(p.Tiers)-1] {
+		if t.UpTo == nil || *t.UpTo <= prev {
+			return false
+		}
+
+		prev = *t.UpTo
+	}
+
+	return true
+}
+
+// PriceTier is a range of quantities of a tiered price
+type PriceTier struct {
+	ID         int64
+	PriceID    int64
+	UpTo       *int64 // the last unit of the tier, nil for the last tier
+	UnitAmount int64
+	FlatAmount int64 // charged once when the quantity reaches the tier
+}
+
+func (PriceTier) TableName() string {
+	return "pay.price_tier"
+}
+
 func (p *Price) HasTrial() bool {
 	return p.TrialDays > 0
 }
@@ -44,25 +210,54 @@ type Plan struct {
 	Provider    string
 	ProviderID  string
 	Active      bool
+	DeletedAt   *time.Time // when the plan was deleted at the provider, the row is kept for the history referencing it
 }
 
 func (p *Plan) TableName() string {
 	return "pay.plan"
 }
 
+// PlanFeature grants a feature to the subscribers of a plan.
+// Boolean features only use Enabled, numeric features also set a Limit where nil means unlimited
+type PlanFeature struct {
+	ID      int64
+	PlanID  int64
+	Key     string
+	Enabled bool
+	Limit   *int64 `db:"feature_limit"`
+}
+
+func (PlanFeature) TableName() string {
+	return "pay.plan_feature"
+}
+
 // Customer from a provider like stripe or paypal
 type Customer struct {
-	ID         int64  // internal (to this service)
-	ProviderID string // external providers id
-	Provider   string // the provider for this customer
-	Name       string // customers name
-	Email      string // customers email
+	ID         int64      // internal (to this service)
+	ProviderID string     // external providers id
+	Provider   string     // the provider for this customer
+	Name       string     // customers name
+	Email      string     // customers email
+	DeletedAt  *time.Time // when the customer was deleted at the provider, the row is kept for the history referencing it
 }
 
 func (c *Customer) TableName() string {
 	return "pay.customer"
 }
 
+type SubscriptionStatus = string
+
+const (
+	SubscriptionIncomplete        SubscriptionStatus = "incomplete"         // the first payment has not been made yet
+	SubscriptionIncompleteExpired SubscriptionStatus = "incomplete_expired" // the first payment was never made
+	SubscriptionTrialing          SubscriptionStatus = "trialing"
+	SubscriptionActive            SubscriptionStatus = "active"
+	SubscriptionPastDue           SubscriptionStatus = "past_due" // a renewal payment failed and is being retried
+	SubscriptionUnpaid            SubscriptionStatus = "unpaid"   // retries of a renewal payment were exhausted
+	SubscriptionPaused            SubscriptionStatus = "paused"   // the trial ended without a payment method
+	SubscriptionCanceled          SubscriptionStatus = "canceled"
+)
+
 // Subscription represents a customers subscription to a Plan
 type Subscription struct {
 	ID         int64
@@ -70,31 +265,466 @@ type Subscription struct {
 	ProviderID string
 	CustomerID int64
 	PriceID    int64
-	Active     bool
+	Quantity   int64 // number of seats that were paid for
+	Active     bool  // the status is either active or trialing
+	Status     SubscriptionStatus
 	CreatedAt  time.Time
+
+	CurrentPeriodStart time.Time
+	CurrentPeriodEnd   time.Time
+	TrialStart         *time.Time
+	TrialEnd           *time.Time
+	EndedAt            *time.Time // when the subscription was canceled for good
+
+	CancelAtPeriodEnd bool       // the subscription ends once the current period is over
+	CanceledAt        *time.Time // when the cancellation was requested
+	PauseCollection   string     // behavior of payment collection while paused, empty when not paused
+
+	CouponID                *int64     // coupon of the discount applied to the subscription
+	PromotionCodeID         *int64     // promotion code the customer redeemed for the discount, if any
+	PromotionCodeProviderID string     // provider id of the promotion code, kept until the code itself is received
+	DiscountStart           *time.Time // when the discount was applied
+	DiscountEnd             *time.Time // when the discount stops applying, nil when it applies forever
+
+	SnapshotAt *time.Time // when the provider state stored was current, older snapshots are ignored
+
+	Items []SubscriptionItem `db:"-"` // line items received from the provider, listed with ListSubscriptionItems
+}
+
+// Trialing reports whether the subscription is in its trial period
+func (s *Subscription) Trialing() bool {
+	return s.Status == SubscriptionTrialing
+}
+
+// Paused reports whether payment collection is paused
+func (s *Subscription) Paused() bool {
+	return s.PauseCollection != ""
 }
 
 func (s *Subscription) TableName() string {
 	return "pay.subscription"
 }
 
+// SubscriptionItem is a price billed by a subscription. The item whose price is the PriceID of the subscription
+// holds its seats, the others are add-ons checked out along with it
+type SubscriptionItem struct {
+	ID             int64
+	SubscriptionID int64
+	ProviderID     string
+	PriceID        int64
+	Quantity       int64
+}
+
+func (SubscriptionItem) TableName() string {
+	return "pay.subscription_item"
+}
+
+type WebhookEventStatus = string
+
+const (
+	WebhookEventPending   WebhookEventStatus = "pending"   // received but not yet handled
+	WebhookEventProcessed WebhookEventStatus = "processed" // handled successfully
+	WebhookEventFailed    WebhookEventStatus = "failed"    // handling failed, retried while NextAttemptAt is set
+)
+
+// WebhookEvent received from a provider along with the status of its processing
 type WebhookEvent struct {
-	ID         int64
-	Provider   string
-	ProviderID string
-	EventType  string
-	Payload    []byte
+	ID            int64
+	Provider      string
+	ProviderID    string
+	EventType     string
+	Payload       []byte
+	Status        WebhookEventStatus
+	Attempts      int
+	LastError     string
+	NextAttemptAt *time.Time
+	OccurredAt    *time.Time // when the event happened at the provider
+	CreatedAt     time.Time
+	ProcessedAt   *time.Time
 }
 
 func (e *WebhookEvent) TableName() string {
 	return "pay.webhook_event"
 }
 
+type SeatRole = string
+
+const (
+	SeatOwner  SeatRole = "owner"  // responsible for billing, every subscription keeps at least one
+	SeatAdmin  SeatRole = "admin"  // manages the other users of the subscription
+	SeatMember SeatRole = "member" // uses the subscription
+)
+
 type SubscriptionUser struct {
 	SubscriptionID int64
 	Username       string
+	Role           SeatRole
 }
 
 func (SubscriptionUser) TableName() string {
 	return "pay.subscription_user"
 }
+
+type SeatInviteStatus = string
+
+const (
+	SeatInvitePending  SeatInviteStatus = "pending"
+	SeatInviteAccepted SeatInviteStatus = "accepted"
+	SeatInviteRevoked  SeatInviteStatus = "revoked"
+	SeatInviteExpired  SeatInviteStatus = "expired"
+)
+
+// SeatInvite offers a seat of a subscription to someone by email.
+// Accepting the invite adds a SubscriptionUser
+type SeatInvite struct {
+	ID             int64
+	SubscriptionID int64
+	Email          string
+	Username       string // username the invite was accepted with
+	Status         SeatInviteStatus
+	ExpiresAt      time.Time
+	CreatedAt      time.Time
+	AcceptedAt     *time.Time
+}
+
+func (SeatInvite) TableName() string {
+	return "pay.seat_invite"
+}
+
+// Expired reports whether the invite can no longer be accepted because it is past its expiry
+func (i *SeatInvite) Expired() bool {
+	return i.Status == SeatInviteExpired || (i.Status == SeatInvitePending && time.Now().After(i.ExpiresAt))
+}
+
+type CheckoutSessionStatus = string
+
+const (
+	CheckoutSessionOpen     CheckoutSessionStatus = "open"
+	CheckoutSessionComplete CheckoutSessionStatus = "complete"
+	CheckoutSessionExpired  CheckoutSessionStatus = "expired"
+)
+
+// CheckoutSession is created when a customer is sent to checkout a price
+type CheckoutSession struct {
+	ID                     int64
+	Provider               string
+	ProviderID             string
+	CustomerID             int64
+	PriceID                int64 // price of the first item
+	Status                 CheckoutSessionStatus
+	URL                    string
+	CancelURL              string
+	Locale                 string
+	ClientReferenceID      string
+	Metadata               Metadata
+	SubscriptionProviderID string // provider id of the subscription created once the session completes
+	CreatedAt              time.Time
+	CompletedAt            *time.Time
+	Items                  []CheckoutSessionItem `db:"-"`
+}
+
+func (CheckoutSession) TableName() string {
+	return "pay.checkout_session"
+}
+
+// CheckoutSessionItem is a price checked out in a session
+type CheckoutSessionItem struct {
+	ID                int64
+	CheckoutSessionID int64
+	PriceID           int64
+	Quantity          int64
+}
+
+func (CheckoutSessionItem) TableName() string {
+	return "pay.checkout_session_item"
+}
+
+// Metadata is free form data that is kept with the provider as well, stored as jsonb
+type Metadata map[string]string
+
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(m)
+}
+
+func (m *Metadata) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, m)
+	case string:
+		return json.Unmarshal([]byte(v), m)
+	default:
+		return fmt.Errorf("can't scan %T into metadata", src)
+	}
+}
+
+// Purchase is a one time payment for a price, such as a lifetime license or a pack of credits
+type Purchase struct {
+	ID         int64
+	Provider   string
+	ProviderID string // id of the line item paid for with the provider
+	PaymentID  string // id of the payment with the provider, shared by the purchases of a checkout
+	CustomerID int64
+	PriceID    int64
+	Quantity   int64
+	Amount     int64 // total amount paid in the smallest currency unit
+	Currency   string
+	CreatedAt  time.Time
+}
+
+func (Purchase) TableName() string {
+	return "pay.purchase"
+}
+
+type InvoiceStatus = string
+
+const (
+	InvoiceDraft         InvoiceStatus = "draft"
+	InvoiceOpen          InvoiceStatus = "open" // finalized and waiting to be paid
+	InvoicePaid          InvoiceStatus = "paid"
+	InvoiceUncollectible InvoiceStatus = "uncollectible"
+	InvoiceVoid          InvoiceStatus = "void"
+)
+
+// Invoice issued to a customer by the provider
+type Invoice struct {
+	ID               int64
+	Provider         string
+	ProviderID       string
+	CustomerID       int64
+	SubscriptionID   *int64 // nil for invoices that are not for a subscription
+	Number           string
+	Status           InvoiceStatus
+	AmountDue        int64
+	AmountPaid       int64
+	Currency         string
+	PeriodStart      time.Time
+	PeriodEnd        time.Time
+	HostedInvoiceURL string // page where the customer can view and pay the invoice
+	InvoicePDF       string
+	CreatedAt        time.Time
+}
+
+func (Invoice) TableName() string {
+	return "pay.invoice"
+}
+
+// Dunning tracks the failed payments of a subscription until it is paid again
+type Dunning struct {
+	SubscriptionID int64
+	InvoiceID      *int64 // last invoice that failed to be paid
+	Attempts       int
+	StartedAt      time.Time
+	LastFailedAt   *time.Time
+	NextRetryAt    *time.Time // nil when the provider won't retry the payment
+	GraceEndsAt    time.Time  // the subscription stops counting towards the users plans and features after this
+}
+
+func (Dunning) TableName() string {
+	return "pay.dunning"
+}
+
+// InGrace reports whether the subscription still counts as paid for
+func (d *Dunning) InGrace() bool {
+	return time.Now().Before(d.GraceEndsAt)
+}
+
+type ChargeStatus = string
+
+const (
+	ChargePending   ChargeStatus = "pending"
+	ChargeSucceeded ChargeStatus = "succeeded"
+	ChargeFailed    ChargeStatus = "failed"
+)
+
+// Charge is an attempt to collect a payment from a customer
+type Charge struct {
+	ID              int64
+	Provider        string
+	ProviderID      string
+	PaymentIntentID string // provider id of the payment the charge was made for
+	CustomerID      *int64
+	InvoiceID       *int64 // nil for charges that are not for an invoice, such as one time purchases
+	Amount          int64
+	AmountRefunded  int64
+	Currency        string
+	Status          ChargeStatus
+	Refunded        bool // set once the whole amount has been refunded
+	FailureMessage  string
+	CreatedAt       time.Time
+}
+
+func (Charge) TableName() string {
+	return "pay.charge"
+}
+
+// Refundable returns the amount of the charge that can still be refunded
+func (c *Charge) Refundable() int64 {
+	if c.Status != ChargeSucceeded {
+		return 0
+	}
+
+	return c.Amount - c.AmountRefunded
+}
+
+type RefundReason = string
+
+const (
+	RefundDuplicate           RefundReason = "duplicate"
+	RefundFraudulent          RefundReason = "fraudulent"
+	RefundRequestedByCustomer RefundReason = "requested_by_customer"
+)
+
+type RefundStatus = string
+
+const (
+	RefundPending        RefundStatus = "pending"
+	RefundRequiresAction RefundStatus = "requires_action"
+	RefundSucceeded      RefundStatus = "succeeded"
+	RefundFailed         RefundStatus = "failed"
+	RefundCanceled       RefundStatus = "canceled"
+)
+
+// Refund returns part or all of a charge to the customer
+type Refund struct {
+	ID            int64
+	Provider      string
+	ProviderID    string
+	ChargeID      int64
+	Amount        int64
+	Currency      string
+	Status        RefundStatus
+	Reason        RefundReason
+	FailureReason string
+	CreatedAt     time.Time
+}
+
+func (Refund) TableName() string {
+	return "pay.refund"
+}
+
+type DisputeStatus = string
+
+const (
+	DisputeWarningNeedsResponse DisputeStatus = "warning_needs_response"
+	DisputeWarningUnderReview   DisputeStatus = "warning_under_review"
+	DisputeWarningClosed        DisputeStatus = "warning_closed"
+	DisputeNeedsResponse        DisputeStatus = "needs_response"
+	DisputeUnderReview          DisputeStatus = "under_review"
+	DisputeChargeRefunded       DisputeStatus = "charge_refunded"
+	DisputeWon                  DisputeStatus = "won"
+	DisputeLost                 DisputeStatus = "lost"
+)
+
+// Dispute is raised when a customer questions a charge with their bank, also known as a chargeback
+type Dispute struct {
+	ID            int64
+	Provider      string
+	ProviderID    string
+	ChargeID      int64
+	Amount        int64
+	Currency      string
+	Status        DisputeStatus
+	Reason        string     // such as fraudulent or product_not_received
+	EvidenceDueBy *time.Time // evidence must be submitted before this for the dispute to be reviewed
+	CreatedAt     time.Time
+}
+
+func (Dispute) TableName() string {
+	return "pay.dispute"
+}
+
+// Closed reports whether the dispute has been decided
+func (d *Dispute) Closed() bool {
+	switch d.Status {
+	case DisputeWarningClosed, DisputeChargeRefunded, DisputeWon, DisputeLost:
+		return true
+	}
+
+	return false
+}
+
+// UsageRecord is usage of a metered subscription recorded locally until it is flushed to the provider
+type UsageRecord struct {
+	ID             int64
+	SubscriptionID int64
+	PriceID        int64 // metered price of the subscription the usage is billed with, either its base price or an add-on item
+	Quantity       int64
+	RecordedAt     time.Time // when the usage happened
+	IdempotencyKey string
+	ProviderID     string // id of the provider record the usage was flushed in, empty until flushed
+	Attempts       int    // number of failed attempts at flushing the record
+	LastError      string
+	NextAttemptAt  *time.Time // when the record is flushed next, nil once flushed or when it failed too many times
+	CreatedAt      time.Time
+	FlushedAt      *time.Time
+}
+
+func (UsageRecord) TableName() string {
+	return "pay.usage_record"
+}
+
+type CouponDuration = string
+
+const (
+	CouponOnce      CouponDuration = "once"      // applies to the first invoice only
+	CouponRepeating CouponDuration = "repeating" // applies for DurationInMonths
+	CouponForever   CouponDuration = "forever"
+)
+
+// Coupon is a discount that can be applied to checkouts directly or redeemed through promotion codes.
+// Either PercentOff or AmountOff is set
+type Coupon struct {
+	ID               int64
+	Provider         string
+	ProviderID       string
+	Name             string
+	PercentOff       float64
+	AmountOff        int64
+	Currency         string // currency of AmountOff
+	Duration         CouponDuration
+	DurationInMonths int   // only set for repeating coupons
+	MaxRedemptions   int64 // no limit when zero
+	TimesRedeemed    int64
+	RedeemBy         *time.Time // the coupon can't be redeemed after this
+	Valid            bool       // whether the coupon can still be redeemed
+	CreatedAt        time.Time
+}
+
+func (Coupon) TableName() string {
+	return "pay.coupon"
+}
+
+// Discount returns the amount taken off of amount by the coupon
+func (c *Coupon) Discount(amount int64) int64 {
+	if c.AmountOff > 0 {
+		return min(c.AmountOff, amount)
+	}
+
+	return int64(math.Round(float64(amount) * c.PercentOff / 100))
+}
+
+// PromotionCode is a code customers enter at checkout to redeem a coupon
+type PromotionCode struct {
+	ID             int64
+	Provider       string
+	ProviderID     string
+	CouponID       int64
+	Code           string
+	Active         bool
+	CustomerID     *int64 // the only customer that can redeem the code, anyone can when nil
+	MaxRedemptions int64  // no limit when zero
+	TimesRedeemed  int64
+	ExpiresAt      *time.Time
+	CreatedAt      time.Time
+}
+
+func (PromotionCode) TableName() string {
+	return "pay.promotion_code"
+}
@@ -0,0 +1,99 @@
+package pay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriceQuote(t *testing.T) {
+	upTo := func(n int64) *int64 { return &n }
+	tiers := []PriceTier{
+		{UpTo: upTo(10), UnitAmount: 100},
+		{UpTo: upTo(20), UnitAmount: 80, FlatAmount: 500},
+		{UnitAmount: 50},
+	}
+
+	tests := []struct {
+		name     string
+		price    Price
+		quantity int64
+		want     int64
+	}{
+		{"per unit", Price{Amount: 300, BillingScheme: BillingPerUnit}, 3, 900},
+		{"per unit none", Price{Amount: 300, BillingScheme: BillingPerUnit}, 0, 0},
+		{"graduated none", Price{BillingScheme: BillingTiered, TiersMode: TiersGraduated, Tiers: tiers}, 0, 0},
+		{"graduated first tier", Price{BillingScheme: BillingTiered, TiersMode: TiersGraduated, Tiers: tiers}, 5, 500},
+		{"graduated tier boundary", Price{BillingScheme: BillingTiered, TiersMode: TiersGraduated, Tiers: tiers}, 10, 1000},
+		{"graduated second tier", Price{BillingScheme: BillingTiered, TiersMode: TiersGraduated, Tiers: tiers}, 15, 1900},
+		{"graduated last tier", Price{BillingScheme: BillingTiered, TiersMode: TiersGraduated, Tiers: tiers}, 25, 2550},
+		{"volume first tier", Price{BillingScheme: BillingTiered, TiersMode: TiersVolume, Tiers: tiers}, 5, 500},
+		{"volume tier boundary", Price{BillingScheme: BillingTiered, TiersMode: TiersVolume, Tiers: tiers}, 10, 1000},
+		{"volume second tier", Price{BillingScheme: BillingTiered, TiersMode: TiersVolume, Tiers: tiers}, 15, 1700},
+		{"volume last tier", Price{BillingScheme: BillingTiered, TiersMode: TiersVolume, Tiers: tiers}, 25, 1250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.price.Quote(tt.quantity); got != tt.want {
+				t.Fatalf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPricePeriod(t *testing.T) {
+	start := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		price Price
+		want  time.Time
+	}{
+		{"daily", Price{Interval: IntervalDay}, time.Date(2024, time.January, 16, 12, 0, 0, 0, time.UTC)},
+		{"every 10 days", Price{Interval: IntervalDay, IntervalCount: 10}, time.Date(2024, time.January, 25, 12, 0, 0, 0, time.UTC)},
+		{"weekly", Price{Interval: IntervalWeek, IntervalCount: 1}, time.Date(2024, time.January, 22, 12, 0, 0, 0, time.UTC)},
+		{"every 2 weeks", Price{Interval: IntervalWeek, IntervalCount: 2}, time.Date(2024, time.January, 29, 12, 0, 0, 0, time.UTC)},
+		{"monthly", Price{Interval: IntervalMonth, IntervalCount: 1}, time.Date(2024, time.February, 15, 12, 0, 0, 0, time.UTC)},
+		{"quarterly", Price{Interval: IntervalMonth, IntervalCount: 3}, time.Date(2024, time.April, 15, 12, 0, 0, 0, time.UTC)},
+		{"yearly", Price{Interval: IntervalYear, IntervalCount: 1}, time.Date(2025, time.January, 15, 12, 0, 0, 0, time.UTC)},
+		{"every 2 years", Price{Interval: IntervalYear, IntervalCount: 2}, time.Date(2026, time.January, 15, 12, 0, 0, 0, time.UTC)},
+		{"no interval count", Price{Interval: IntervalMonth}, time.Date(2024, time.February, 15, 12, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.price.PeriodEnd(start); !got.Equal(tt.want) {
+				t.Fatalf("expected period to end at %s, got %s", tt.want, got)
+			}
+
+			if got := tt.price.PeriodStart(tt.want); !got.Equal(start) {
+				t.Fatalf("expected period to start at %s, got %s", start, got)
+			}
+		})
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		name   string
+		coupon Coupon
+		amount int64
+		want   int64
+	}{
+		{"percent off", Coupon{PercentOff: 15}, 1000, 150},
+		{"percent off rounded", Coupon{PercentOff: 10}, 1999, 200},
+		{"percent off half unit", Coupon{PercentOff: 50}, 1, 1},
+		{"full percent off", Coupon{PercentOff: 100}, 1999, 1999},
+		{"amount off", Coupon{AmountOff: 500, Currency: "usd"}, 2000, 500},
+		{"amount off over amount", Coupon{AmountOff: 500, Currency: "usd"}, 300, 300},
+		{"nothing to discount", Coupon{PercentOff: 20}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.coupon.Discount(tt.amount); got != tt.want {
+				t.Fatalf("expected discount of %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,20 +1,40 @@
 package pay
 
 type events struct {
-	subAddedCallbacks        []func(*Subscription)
-	subUpdatedCallbacks      []func(*Subscription, *Subscription)
-	subRemovedCallbacks      []func(*Subscription)
-	seatAddedCallbacks       []func(*Subscription, string)
-	seatRemovedCallbacks     []func(*Subscription, string)
-	customerAddedCallbacks   []func(*Customer)
-	customerUpdatedCallbacks []func(*Customer, *Customer)
-	customerRemovedCallbacks []func(*Customer)
-	planAddedCallbacks       []func(*Plan)
-	planUpdatedCallbacks     []func(*Plan, *Plan)
-	planRemovedCallbacks     []func(*Plan)
-	priceAddedCallbacks      []func(*Price)
-	priceUpdatedCallbacks    []func(*Price, *Price)
-	priceRemovedCallbacks    []func(*Price)
+	subAddedCallbacks          []func(*Subscription)
+	subUpdatedCallbacks        []func(*Subscription, *Subscription)
+	subRemovedCallbacks        []func(*Subscription)
+	seatAddedCallbacks         []func(*Subscription, string)
+	seatRemovedCallbacks       []func(*Subscription, string)
+	customerAddedCallbacks     []func(*Customer)
+	customerUpdatedCallbacks   []func(*Customer, *Customer)
+	customerRemovedCallbacks   []func(*Customer)
+	planAddedCallbacks         []func(*Plan)
+	planUpdatedCallbacks       []func(*Plan, *Plan)
+	planRemovedCallbacks       []func(*Plan)
+	priceAddedCallbacks        []func(*Price)
+	priceUpdatedCallbacks      []func(*Price, *Price)
+	priceRemovedCallbacks      []func(*Price)
+	checkoutCompletedCallbacks []func(*CheckoutSession)
+	checkoutExpiredCallbacks   []func(*CheckoutSession)
+	purchaseAddedCallbacks     []func(*Purchase)
+	seatInvitedCallbacks       []func(*SeatInvite, string)
+	seatAcceptedCallbacks      []func(*SeatInvite)
+	invoiceAddedCallbacks      []func(*Invoice)
+	invoiceUpdatedCallbacks    []func(*Invoice, *Invoice)
+	invoiceRemovedCallbacks    []func(*Invoice)
+	paymentFailedCallbacks     []func(*Invoice, *Dunning)
+	paymentSucceededCallbacks  []func(*Invoice)
+	chargeAddedCallbacks       []func(*Charge)
+	chargeUpdatedCallbacks     []func(*Charge, *Charge)
+	refundAddedCallbacks       []func(*Refund)
+	refundUpdatedCallbacks     []func(*Refund, *Refund)
+	disputeOpenedCallbacks     []func(*Dispute)
+	disputeClosedCallbacks     []func(*Dispute)
+	couponAddedCallbacks       []func(*Coupon)
+	couponUpdatedCallbacks     []func(*Coupon, *Coupon)
+	promoAddedCallbacks        []func(*PromotionCode)
+	promoUpdatedCallbacks      []func(*PromotionCode, *PromotionCode)
 }
 
 func (e *events) OnSeatAdded(cb func(*Subscription, string)) {
@@ -25,6 +45,16 @@ func (e *events) OnSeatRemoved(cb func(*Subscription, string)) {
 	e.seatRemovedCallbacks = append(e.seatRemovedCallbacks, cb)
 }
 
+// OnSeatInvited is called with the invite and the token to send to the invitee
+func (e *events) OnSeatInvited(cb func(inv *SeatInvite, token string)) {
+	e.seatInvitedCallbacks = append(e.seatInvitedCallbacks, cb)
+}
+
+// OnSeatAccepted is called once an invite was accepted and the user added to the subscription
+func (e *events) OnSeatAccepted(cb func(*SeatInvite)) {
+	e.seatAcceptedCallbacks = append(e.seatAcceptedCallbacks, cb)
+}
+
 func (e *events) OnSubscriptionAdded(cb func(*Subscription)) {
 	e.subAddedCallbacks = append(e.subAddedCallbacks, cb)
 }
@@ -73,6 +103,86 @@ func (e *events) OnPriceRemoved(cb func(*Price)) {
 	e.priceRemovedCallbacks = append(e.priceRemovedCallbacks, cb)
 }
 
+// OnPaymentFailed is called when an invoice could not be paid.
+// The dunning state is nil for invoices that don't belong to a subscription
+func (e *events) OnPaymentFailed(cb func(*Invoice, *Dunning)) {
+	e.paymentFailedCallbacks = append(e.paymentFailedCallbacks, cb)
+}
+
+// OnPaymentSucceeded is called once an invoice has been paid
+func (e *events) OnPaymentSucceeded(cb func(*Invoice)) {
+	e.paymentSucceededCallbacks = append(e.paymentSucceededCallbacks, cb)
+}
+
+func (e *events) OnChargeAdded(cb func(*Charge)) {
+	e.chargeAddedCallbacks = append(e.chargeAddedCallbacks, cb)
+}
+
+func (e *events) OnChargeUpdated(cb func(*Charge, *Charge)) {
+	e.chargeUpdatedCallbacks = append(e.chargeUpdatedCallbacks, cb)
+}
+
+func (e *events) OnRefundAdded(cb func(*Refund)) {
+	e.refundAddedCallbacks = append(e.refundAddedCallbacks, cb)
+}
+
+func (e *events) OnRefundUpdated(cb func(*Refund, *Refund)) {
+	e.refundUpdatedCallbacks = append(e.refundUpdatedCallbacks, cb)
+}
+
+// OnDisputeOpened is called when a customer disputes a charge
+func (e *events) OnDisputeOpened(cb func(*Dispute)) {
+	e.disputeOpenedCallbacks = append(e.disputeOpenedCallbacks, cb)
+}
+
+// OnDisputeClosed is called once a dispute has been decided, check the status to see whether it was won
+func (e *events) OnDisputeClosed(cb func(*Dispute)) {
+	e.disputeClosedCallbacks = append(e.disputeClosedCallbacks, cb)
+}
+
+func (e *events) OnCouponAdded(cb func(*Coupon)) {
+	e.couponAddedCallbacks = append(e.couponAddedCallbacks, cb)
+}
+
+func (e *events) OnCouponUpdated(cb func(*Coupon, *Coupon)) {
+	e.couponUpdatedCallbacks = append(e.couponUpdatedCallbacks, cb)
+}
+
+func (e *events) OnPromotionCodeAdded(cb func(*PromotionCode)) {
+	e.promoAddedCallbacks = append(e.promoAddedCallbacks, cb)
+}
+
+func (e *events) OnPromotionCodeUpdated(cb func(*PromotionCode, *PromotionCode)) {
+	e.promoUpdatedCallbacks = append(e.promoUpdatedCallbacks, cb)
+}
+
+func (e *events) OnInvoiceAdded(cb func(*Invoice)) {
+	e.invoiceAddedCallbacks = append(e.invoiceAddedCallbacks, cb)
+}
+
+func (e *events) OnInvoiceUpdated(cb func(*Invoice, *Invoice)) {
+	e.invoiceUpdatedCallbacks = append(e.invoiceUpdatedCallbacks, cb)
+}
+
+func (e *events) OnInvoiceRemoved(cb func(*Invoice)) {
+	e.invoiceRemovedCallbacks = append(e.invoiceRemovedCallbacks, cb)
+}
+
+// OnCheckoutCompleted is called once the customer has completed the checkout session
+func (e *events) OnCheckoutCompleted(cb func(*CheckoutSession)) {
+	e.checkoutCompletedCallbacks = append(e.checkoutCompletedCallbacks, cb)
+}
+
+// OnCheckoutExpired is called when the checkout session expires before being completed
+func (e *events) OnCheckoutExpired(cb func(*CheckoutSession)) {
+	e.checkoutExpiredCallbacks = append(e.checkoutExpiredCallbacks, cb)
+}
+
+// OnPurchaseAdded is called once a one time payment has been received
+func (e *events) OnPurchaseAdded(cb func(*Purchase)) {
+	e.purchaseAddedCallbacks = append(e.purchaseAddedCallbacks, cb)
+}
+
 func (e *events) subAdded(s *Subscription) {
 	for _, cb := range e.subAddedCallbacks {
 		cb(s)
@@ -145,6 +255,96 @@ func (e *events) priceRemoved(c *Price) {
 	}
 }
 
+func (e *events) invoiceAdded(i *Invoice) {
+	for _, cb := range e.invoiceAddedCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) invoiceUpdated(prev *Invoice, i *Invoice) {
+	for _, cb := range e.invoiceUpdatedCallbacks {
+		cb(prev, i)
+	}
+}
+
+func (e *events) invoiceRemoved(i *Invoice) {
+	for _, cb := range e.invoiceRemovedCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) paymentFailed(i *Invoice, d *Dunning) {
+	for _, cb := range e.paymentFailedCallbacks {
+		cb(i, d)
+	}
+}
+
+func (e *events) paymentSucceeded(i *Invoice) {
+	for _, cb := range e.paymentSucceededCallbacks {
+		cb(i)
+	}
+}
+
+func (e *events) chargeAdded(c *Charge) {
+	for _, cb := range e.chargeAddedCallbacks {
+		cb(c)
+	}
+}
+
+func (e *events) chargeUpdated(prev *Charge, c *Charge) {
+	for _, cb := range e.chargeUpdatedCallbacks {
+		cb(prev, c)
+	}
+}
+
+func (e *events) refundAdded(rf *Refund) {
+	for _, cb := range e.refundAddedCallbacks {
+		cb(rf)
+	}
+}
+
+func (e *events) refundUpdated(prev *Refund, rf *Refund) {
+	for _, cb := range e.refundUpdatedCallbacks {
+		cb(prev, rf)
+	}
+}
+
+func (e *events) disputeOpened(d *Dispute) {
+	for _, cb := range e.disputeOpenedCallbacks {
+		cb(d)
+	}
+}
+
+func (e *events) disputeClosed(d *Dispute) {
+	for _, cb := range e.disputeClosedCallbacks {
+		cb(d)
+	}
+}
+
+func (e *events) couponAdded(c *Coupon) {
+	for _, cb := range e.couponAddedCallbacks {
+		cb(c)
+	}
+}
+
+func (e *events) couponUpdated(prev *Coupon, c *Coupon) {
+	for _, cb := range e.couponUpdatedCallbacks {
+		cb(prev, c)
+	}
+}
+
+func (e *events) promoAdded(pc *PromotionCode) {
+	for _, cb := range e.promoAddedCallbacks {
+		cb(pc)
+	}
+}
+
+func (e *events) promoUpdated(prev *PromotionCode, pc *PromotionCode) {
+	for _, cb := range e.promoUpdatedCallbacks {
+		cb(prev, pc)
+	}
+}
+
 func (e *events) seatAdded(s *Subscription, seat string) {
 	for _, cb := range e.seatAddedCallbacks {
 		cb(s, seat)
@@ -156,3 +356,33 @@ func (e *events) seatRemoved(s *Subscription, seat string) {
 		cb(s, seat)
 	}
 }
+
+func (e *events) seatInvited(inv *SeatInvite, token string) {
+	for _, cb := range e.seatInvitedCallbacks {
+		cb(inv, token)
+	}
+}
+
+func (e *events) seatAccepted(inv *SeatInvite) {
+	for _, cb := range e.seatAcceptedCallbacks {
+		cb(inv)
+	}
+}
+
+func (e *events) checkoutCompleted(cs *CheckoutSession) {
+	for _, cb := range e.checkoutCompletedCallbacks {
+		cb(cs)
+	}
+}
+
+func (e *events) checkoutExpired(cs *CheckoutSession) {
+	for _, cb := range e.checkoutExpiredCallbacks {
+		cb(cs)
+	}
+}
+
+func (e *events) purchaseAdded(p *Purchase) {
+	for _, cb := range e.purchaseAddedCallbacks {
+		cb(p)
+	}
+}
@@ -0,0 +1,1384 @@
+package pay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProviderFake is the name of the in-memory provider used for tests and local development
+const ProviderFake = "fake"
+
+var (
+	ErrFakeNotFound = errors.New("fake: entity not found")
+
+	_ Provider = (*FakeProvider)(nil)
+)
+
+// FakeProvider is an in-memory provider used for tests and local development.
+// Unlike the StripeProvider, changes are written to the Repo immediately and callbacks fire before the method returns,
+// the same way they would once a webhook event is received.
+type FakeProvider struct {
+	*Repo
+	mu            sync.Mutex
+	plans         map[string]*Plan
+	prices        map[string]*Price
+	customers     map[string]*Customer
+	subscriptions map[string]*Subscription
+	invoices      map[string]*Invoice
+	charges       map[string]*Charge
+	refunds       map[string]*Refund
+	disputes      map[string]*Dispute
+	coupons       map[string]*Coupon
+	promos        map[string]*PromotionCode
+	discounts     map[string][]appliedDiscount // discounts of checkout sessions
+	baseItems     map[string]string            // provider ids of the items holding the seats of subscriptions
+}
+
+// NewFakeProvider creates an in-memory provider that stores its entities in repo
+func NewFakeProvider(repo *Repo) *FakeProvider {
+	return &FakeProvider{
+		Repo:          repo,
+		plans:         make(map[string]*Plan),
+		prices:        make(map[string]*Price),
+		customers:     make(map[string]*Customer),
+		subscriptions: make(map[string]*Subscription),
+		invoices:      make(map[string]*Invoice),
+		charges:       make(map[string]*Charge),
+		refunds:       make(map[string]*Refund),
+		disputes:      make(map[string]*Dispute),
+		coupons:       make(map[string]*Coupon),
+		promos:        make(map[string]*PromotionCode),
+		discounts:     make(map[string][]appliedDiscount),
+		baseItems:     make(map[string]string),
+	}
+}
+
+// Name returns the name of the fake provider
+func (f *FakeProvider) Name() string {
+	return ProviderFake
+}
+
+// AddPlan uses context.Background, to specify the context use AddPlanContext
+func (f *FakeProvider) AddPlan(p *Plan) error {
+	return f.AddPlanContext(context.Background(), p)
+}
+
+// AddPlanContext to the fake provider
+func (f *FakeProvider) AddPlanContext(ctx context.Context, p *Plan) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pl := *p
+	pl.Provider = ProviderFake
+	pl.ProviderID = f.nextID("prod")
+
+	return f.emit(ctx, "product.created", &pl, func() error {
+		if err := f.addPlan(ctx, &pl); err != nil {
+			return err
+		}
+
+		f.plans[pl.ProviderID] = &pl
+		return nil
+	})
+}
+
+// UpdatePlan uses context.Background, to specify the context use UpdatePlanContext
+func (f *FakeProvider) UpdatePlan(p *Plan) error {
+	return f.UpdatePlanContext(context.Background(), p)
+}
+
+// UpdatePlanContext in the fake provider
+func (f *FakeProvider) UpdatePlanContext(ctx context.Context, p *Plan) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.plans[p.ProviderID]; !ok {
+		return ErrFakeNotFound
+	}
+
+	pl := *p
+	pl.Provider = ProviderFake
+
+	return f.emit(ctx, "product.updated", &pl, func() error {
+		if err := f.updatePlanByProvider(ctx, &pl); err != nil {
+			return err
+		}
+
+		f.plans[pl.ProviderID] = &pl
+		return nil
+	})
+}
+
+// RemovePlanByProviderID uses context.Background, to specify the context use RemovePlanByProviderIDContext
+func (f *FakeProvider) RemovePlanByProviderID(providerID string) error {
+	return f.RemovePlanByProviderIDContext(context.Background(), providerID)
+}
+
+// RemovePlanByProviderIDContext from the fake provider
+func (f *FakeProvider) RemovePlanByProviderIDContext(ctx context.Context, providerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pl, ok := f.plans[providerID]
+	if !ok {
+		return ErrFakeNotFound
+	}
+
+	return f.emit(ctx, "product.deleted", pl, func() error {
+		if err := f.removePlanByProvider(ctx, ProviderFake, providerID); err != nil {
+			return err
+		}
+
+		delete(f.plans, providerID)
+		return nil
+	})
+}
+
+// AddPrice uses context.Background, to specify the context use AddPriceContext
+func (f *FakeProvider) AddPrice(p *Price) error {
+	return f.AddPriceContext(context.Background(), p)
+}
+
+// AddPriceContext to the fake provider
+func (f *FakeProvider) AddPriceContext(ctx context.Context, p *Price) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.GetPlanByIDContext(ctx, p.PlanID); err != nil {
+		return fmt.Errorf("plan with id %d not found", p.PlanID)
+	}
+
+	pr := *p
+	pr.Provider = ProviderFake
+	pr.ProviderID = f.nextID("price")
+	pr.Tiers = append([]PriceTier(nil), p.Tiers...)
+	if pr.UsageType == "" {
+		pr.UsageType = UsageLicensed
+	}
+
+	if pr.BillingScheme == "" {
+		pr.BillingScheme = BillingPerUnit
+	}
+
+	if pr.IsRecurring() && pr.IntervalCount == 0 {
+		pr.IntervalCount = 1
+	}
+
+	if pr.IsTiered() && !pr.validTiers() {
+		return ErrInvalidPriceTiers
+	}
+
+	return f.emit(ctx, "price.created", &pr, func() error {
+		if err := f.addPrice(ctx, &pr); err != nil {
+			return err
+		}
+
+		f.prices[pr.ProviderID] = &pr
+		return nil
+	})
+}
+
+// AddCoupon to the fake provider
+func (f *FakeProvider) AddCoupon(ctx context.Context, c *Coupon) error {
+	if (c.PercentOff > 0) == (c.AmountOff > 0) {
+		return ErrInvalidCoupon
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c.Provider = ProviderFake
+	c.ProviderID = f.nextID("co")
+	c.Valid = true
+	c.CreatedAt = time.Now()
+	if c.Duration == "" {
+		c.Duration = CouponOnce
+	}
+
+	return f.emit(ctx, "coupon.created", c, func() error {
+		if err := f.addCoupon(ctx, c); err != nil {
+			return err
+		}
+
+		f.coupons[c.ProviderID] = c
+		return nil
+	})
+}
+
+// AddPromotionCode to the fake provider, a code is generated when empty
+func (f *FakeProvider) AddPromotionCode(ctx context.Context, pc *PromotionCode) error {
+	c, err := f.GetCouponByID(ctx, pc.CouponID)
+	if err != nil {
+		return err
+	}
+
+	if c.Provider != ProviderFake {
+		return ErrProviderMismatch
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pc.Provider = ProviderFake
+	pc.ProviderID = f.nextID("promo")
+	pc.Active = true
+	pc.CreatedAt = time.Now()
+	if pc.Code == "" {
+		pc.Code = "FAKE" + strings.ToUpper(randomHex(4))
+	}
+
+	return f.emit(ctx, "promotion_code.created", pc, func() error {
+		if err := f.addPromotionCode(ctx, pc); err != nil {
+			return err
+		}
+
+		f.promos[pc.ProviderID] = pc
+		return nil
+	})
+}
+
+// redeemFakeDiscounts counts the redemption of the discounts of the checkout session and returns the amount they take off, f.mu must be held
+func (f *FakeProvider) redeemFakeDiscounts(ctx context.Context, sessionID string, amount int64) (int64, error) {
+	var off int64
+	for _, d := range f.discounts[sessionID] {
+		off += d.coupon.Discount(amount - off)
+
+		c := *d.coupon
+		c.TimesRedeemed++
+		err := f.emit(ctx, "coupon.updated", &c, func() error {
+			if err := f.updateCouponByProvider(ctx, &c); err != nil {
+				return err
+			}
+
+			f.coupons[c.ProviderID] = &c
+			return nil
+		})
+
+		if err != nil {
+			return 0, err
+		}
+
+		if d.promo == nil {
+			continue
+		}
+
+		pc := *d.promo
+		pc.TimesRedeemed++
+		err = f.emit(ctx, "promotion_code.updated", &pc, func() error {
+			if err := f.updatePromotionCodeByProvider(ctx, &pc); err != nil {
+				return err
+			}
+
+			f.promos[pc.ProviderID] = &pc
+			return nil
+		})
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	delete(f.discounts, sessionID)
+	return off, nil
+}
+
+// AddCustomer uses context.Background, to specify the context use AddCustomerContext
+func (f *FakeProvider) AddCustomer(c *Customer) error {
+	return f.AddCustomerContext(context.Background(), c)
+}
+
+// AddCustomerContext to the fake provider
+func (f *FakeProvider) AddCustomerContext(ctx context.Context, c *Customer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust := *c
+	cust.Provider = ProviderFake
+	cust.ProviderID = f.nextID("cus")
+
+	return f.emit(ctx, "customer.created", &cust, func() error {
+		if err := f.addCustomer(ctx, &cust); err != nil {
+			return err
+		}
+
+		f.customers[cust.ProviderID] = &cust
+		return nil
+	})
+}
+
+// UpdateCustomer uses context.Background, to specify the context use UpdateCustomerContext
+func (f *FakeProvider) UpdateCustomer(c *Customer) error {
+	return f.UpdateCustomerContext(context.Background(), c)
+}
+
+// UpdateCustomerContext in the fake provider
+func (f *FakeProvider) UpdateCustomerContext(ctx context.Context, c *Customer) error {
+	if c.ProviderID == "" {
+		return errors.New("missing customer provider id")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.customers[c.ProviderID]; !ok {
+		return ErrFakeNotFound
+	}
+
+	cust := *c
+	cust.Provider = ProviderFake
+
+	return f.emit(ctx, "customer.updated", &cust, func() error {
+		if err := f.updateCustomerByProvider(ctx, &cust); err != nil {
+			return err
+		}
+
+		f.customers[cust.ProviderID] = &cust
+		return nil
+	})
+}
+
+// RemoveCustomerByProviderID uses context.Background, to specify the context use RemoveCustomerByProviderIDContext
+func (f *FakeProvider) RemoveCustomerByProviderID(providerID string) error {
+	return f.RemoveCustomerByProviderIDContext(context.Background(), providerID)
+}
+
+// RemoveCustomerByProviderIDContext from the fake provider
+func (f *FakeProvider) RemoveCustomerByProviderIDContext(ctx context.Context, providerID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cust, ok := f.customers[providerID]
+	if !ok {
+		return ErrFakeNotFound
+	}
+
+	return f.emit(ctx, "customer.deleted", cust, func() error {
+		if err := f.removeCustomerByProvider(ctx, ProviderFake, providerID); err != nil {
+			return err
+		}
+
+		delete(f.customers, providerID)
+		return nil
+	})
+}
+
+// Checkout uses context.Background, to specify the context use CheckoutContext
+func (f *FakeProvider) Checkout(request *CheckoutRequest) (url string, err error) {
+	return f.CheckoutContext(context.Background(), request)
+}
+
+// CheckoutContext creates a fake checkout session and returns its url.
+// The session can be completed with SimulateCheckoutCompleted.
+func (f *FakeProvider) CheckoutContext(ctx context.Context, request *CheckoutRequest) (url string, err error) {
+	customer, err := f.GetCustomerByIDContext(ctx, request.CustomerID)
+	if err != nil {
+		return
+	}
+
+	items, err := f.checkoutItems(ctx, ProviderFake, request)
+	if err != nil {
+		return
+	}
+
+	discounts, err := f.checkoutDiscounts(ctx, ProviderFake, request)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.nextID("cs")
+	cs := newCheckoutSession(ProviderFake, id, fmt.Sprintf("https://checkout.fake.test/%s", id), customer, items, request)
+
+	if err = f.addCheckoutSession(ctx, cs); err != nil {
+		return
+	}
+
+	f.discounts[id] = discounts
+	url = cs.URL
+	return
+}
+
+// VerifyCheckout uses context.Background, to specify the context use VerifyCheckoutContext
+func (f *FakeProvider) VerifyCheckout(sessionID string) error {
+	return f.VerifyCheckoutContext(context.Background(), sessionID)
+}
+
+// VerifyCheckoutContext returns ErrCheckoutFailed unless the session has been completed
+func (f *FakeProvider) VerifyCheckoutContext(ctx context.Context, sessionID string) error {
+	cs, err := f.GetCheckoutSessionByProvider(ctx, ProviderFake, sessionID)
+	if err != nil {
+		return err
+	}
+
+	if cs.Status != CheckoutSessionComplete {
+		return ErrCheckoutFailed
+	}
+
+	return nil
+}
+
+// CancelSubscription in the fake provider
+func (f *FakeProvider) CancelSubscription(ctx context.Context, subID int64, atPeriodEnd bool) error {
+	sub, err := f.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	if !atPeriodEnd {
+		_, err = f.SimulateSubscriptionCanceled(ctx, sub.ProviderID)
+		return err
+	}
+
+	_, err = f.simulateSubscriptionUpdated(ctx, sub.ProviderID, func(s *Subscription) {
+		now := time.Now()
+		s.CancelAtPeriodEnd = true
+		s.CanceledAt = &now
+	})
+
+	return err
+}
+
+// PauseSubscription in the fake provider
+func (f *FakeProvider) PauseSubscription(ctx context.Context, subID int64) error {
+	sub, err := f.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.simulateSubscriptionUpdated(ctx, sub.ProviderID, func(s *Subscription) {
+		s.PauseCollection = "void"
+	})
+
+	return err
+}
+
+// ResumeSubscription in the fake provider
+func (f *FakeProvider) ResumeSubscription(ctx context.Context, subID int64) error {
+	sub, err := f.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.simulateSubscriptionUpdated(ctx, sub.ProviderID, func(s *Subscription) {
+		s.PauseCollection = ""
+		s.CancelAtPeriodEnd = false
+		s.CanceledAt = nil
+	})
+
+	return err
+}
+
+// ChangeSubscriptionPrice in the fake provider.
+// The fake doesn't invoice prorations, so mode and prorationDate are accepted for compatibility and ignored
+func (f *FakeProvider) ChangeSubscriptionPrice(ctx context.Context, subID, priceID int64, mode ProrationMode, prorationDate time.Time) error {
+	sub, pr, err := f.getPriceChange(ctx, subID, priceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.simulateSubscriptionUpdated(ctx, sub.ProviderID, func(s *Subscription) {
+		s.PriceID = pr.ID
+	})
+
+	return err
+}
+
+// PreviewSubscriptionPriceChange in the fake provider.
+// Prorations are calculated as if the current period had just started, so the full difference between prices is charged.
+// The ProrationDate returned is the time of the preview, ChangeSubscriptionPrice ignores it
+func (f *FakeProvider) PreviewSubscriptionPriceChange(ctx context.Context, subID, priceID int64, mode ProrationMode) (*ProrationPreview, error) {
+	sub, pr, err := f.getPriceChange(ctx, subID, priceID)
+	if err != nil {
+		return nil, err
+	}
+
+	prev, err := f.GetPriceByIDContext(ctx, sub.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := ProrationPreview{
+		AmountDue:     pr.Quote(sub.Quantity),
+		Currency:      pr.Currency,
+		ProrationDate: time.Now(),
+	}
+
+	if mode != ProrationNone {
+		preview.Amount = pr.Quote(sub.Quantity) - prev.Quote(sub.Quantity)
+		preview.AmountDue += preview.Amount
+	}
+
+	return &preview, nil
+}
+
+// SetSeatCount in the fake provider
+func (f *FakeProvider) SetSeatCount(ctx context.Context, subID, n int64) error {
+	sub, err := f.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	if err := f.checkSeatCount(ctx, subID, n); err != nil {
+		return err
+	}
+
+	_, err = f.simulateSubscriptionUpdated(ctx, sub.ProviderID, func(s *Subscription) {
+		s.Quantity = n
+	})
+
+	return err
+}
+
+// Refund refunds the charge immediately
+func (f *FakeProvider) Refund(ctx context.Context, chargeID, amount int64, reason RefundReason) (*Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, err := f.GetChargeByID(ctx, chargeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Provider != ProviderFake {
+		return nil, ErrProviderMismatch
+	}
+
+	amount, err = refundAmount(c, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	c.AmountRefunded += amount
+	c.Refunded = c.AmountRefunded == c.Amount
+
+	rf := &Refund{
+		Provider:   ProviderFake,
+		ProviderID: f.nextID("re"),
+		ChargeID:   c.ID,
+		Amount:     amount,
+		Currency:   c.Currency,
+		Status:     RefundSucceeded,
+		Reason:     reason,
+		CreatedAt:  time.Now(),
+	}
+
+	err = f.emit(ctx, "charge.refunded", c, func() error {
+		if err := f.updateChargeByProvider(ctx, c); err != nil {
+			return err
+		}
+
+		if err := f.addRefund(ctx, rf); err != nil {
+			return err
+		}
+
+		f.charges[c.ProviderID] = c
+		f.refunds[rf.ProviderID] = rf
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// FlushUsage marks the recorded usage of fake subscriptions as sent
+func (f *FakeProvider) FlushUsage(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for {
+		records, err := f.listUnflushedUsage(ctx, ProviderFake, usageBatchSize)
+		if err != nil {
+			return err
+		}
+
+		if err := f.markUsageFlushed(ctx, records, f.nextID("mbur")); err != nil {
+			return err
+		}
+
+		if len(records) < usageBatchSize {
+			return nil
+		}
+	}
+}
+
+func (f *FakeProvider) getPriceChange(ctx context.Context, subID, priceID int64) (*Subscription, *Price, error) {
+	sub, err := f.getSubscription(ctx, subID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, err := f.GetPriceByIDContext(ctx, priceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pr.Provider != ProviderFake {
+		return nil, nil, ErrProviderMismatch
+	}
+
+	if !pr.IsRecurring() {
+		return nil, nil, ErrPriceNotRecurring
+	}
+
+	if err := f.checkPriceCurrency(ctx, sub, pr); err != nil {
+		return nil, nil, err
+	}
+
+	return sub, pr, nil
+}
+
+func (f *FakeProvider) getSubscription(ctx context.Context, subID int64) (*Subscription, error) {
+	sub, err := f.GetSubscriptionByIDContext(ctx, subID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Provider != ProviderFake {
+		return nil, ErrProviderMismatch
+	}
+
+	return sub, nil
+}
+
+// Sync uses context.Background, to specify the context use SyncContext
+func (f *FakeProvider) Sync() error {
+	return f.SyncContext(context.Background())
+}
+
+// SyncContext writes the state held in memory to the repository.
+// Removals are written as they happen, so fake entities this instance doesn't hold are left untouched.
+// They may have been stored by an earlier run against the same database
+func (f *FakeProvider) SyncContext(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.customers {
+		if err := f.saveCustomer(ctx, c); err != nil {
+			return fmt.Errorf("error syncing customers: %w", err)
+		}
+	}
+
+	for _, pl := range f.plans {
+		if err := f.savePlan(ctx, pl); err != nil {
+			return fmt.Errorf("error syncing plans: %w", err)
+		}
+	}
+
+	for _, pr := range f.prices {
+		if err := f.savePrice(ctx, pr); err != nil {
+			return fmt.Errorf("error syncing prices: %w", err)
+		}
+	}
+
+	for _, c := range f.coupons {
+		if err := f.saveCoupon(ctx, c); err != nil {
+			return fmt.Errorf("error syncing coupons: %w", err)
+		}
+	}
+
+	for _, pc := range f.promos {
+		if err := f.savePromotionCode(ctx, pc); err != nil {
+			return fmt.Errorf("error syncing promotion codes: %w", err)
+		}
+	}
+
+	for _, sub := range f.subscriptions {
+		if err := f.saveSubscription(ctx, sub); err != nil {
+			return fmt.Errorf("error syncing subscriptions: %w", err)
+		}
+	}
+
+	for _, inv := range f.invoices {
+		if err := f.saveInvoice(ctx, inv); err != nil {
+			return fmt.Errorf("error syncing invoices: %w", err)
+		}
+	}
+
+	for _, c := range f.charges {
+		if err := f.saveCharge(ctx, c); err != nil {
+			return fmt.Errorf("error syncing charges: %w", err)
+		}
+	}
+
+	for _, rf := range f.refunds {
+		if err := f.saveRefund(ctx, rf); err != nil {
+			return fmt.Errorf("error syncing refunds: %w", err)
+		}
+	}
+
+	for _, d := range f.disputes {
+		if err := f.saveDispute(ctx, d); err != nil {
+			return fmt.Errorf("error syncing disputes: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Webhook returns a handler that acknowledges every request.
+// Events are applied directly by the fake provider so there is nothing to receive.
+func (f *FakeProvider) Webhook() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// fakeSessionItems returns the items of the checkout session with their prices
+func (f *FakeProvider) fakeSessionItems(ctx context.Context, cs *CheckoutSession) ([]checkoutItem, error) {
+	var items []checkoutItem
+	for _, item := range cs.Items {
+		pr, err := f.GetPriceByIDContext(ctx, item.PriceID)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, checkoutItem{price: pr, quantity: item.Quantity})
+	}
+
+	return items, nil
+}
+
+// SimulateCheckoutCompleted completes the checkout session, creating an active subscription to the first recurring price of the session.
+// One time prices checked out along with it are charged on the first invoice
+func (f *FakeProvider) SimulateCheckoutCompleted(ctx context.Context, sessionID string) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cs, err := f.GetCheckoutSessionByProvider(ctx, ProviderFake, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cs.Status != CheckoutSessionOpen {
+		return nil, fmt.Errorf("fake: checkout session %s is %s", sessionID, cs.Status)
+	}
+
+	items, err := f.fakeSessionItems(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	item := recurringCheckoutItem(items)
+	if item == nil {
+		return nil, fmt.Errorf("fake: checkout session %s is for one time prices, use SimulatePurchaseCompleted", sessionID)
+	}
+
+	pr := item.price
+	now := time.Now()
+	sub := &Subscription{
+		Provider:           ProviderFake,
+		ProviderID:         f.nextID("sub"),
+		CustomerID:         cs.CustomerID,
+		PriceID:            pr.ID,
+		Quantity:           item.quantity,
+		Active:             true,
+		Status:             SubscriptionActive,
+		CreatedAt:          now,
+		CurrentPeriodStart: now,
+		CurrentPeriodEnd:   pr.PeriodEnd(now),
+	}
+
+	// recurring add-ons are billed by the subscription along with its price
+	var baseItemID string
+	for i := range items {
+		if !items[i].price.IsRecurring() {
+			continue
+		}
+
+		si := SubscriptionItem{
+			ProviderID: f.nextID("si"),
+			PriceID:    items[i].price.ID,
+			Quantity:   items[i].quantity,
+		}
+
+		if &items[i] == item {
+			baseItemID = si.ProviderID
+		}
+
+		sub.Items = append(sub.Items, si)
+	}
+
+	// only one discount can be applied to a subscription
+	if discounts := f.discounts[sessionID]; len(discounts) > 0 {
+		sub.CouponID = &discounts[0].coupon.ID
+		sub.DiscountStart = &now
+		if discounts[0].promo != nil {
+			sub.PromotionCodeID = &discounts[0].promo.ID
+			sub.PromotionCodeProviderID = discounts[0].promo.ProviderID
+		}
+
+		if c := discounts[0].coupon; c.Duration == CouponRepeating {
+			end := now.AddDate(0, c.DurationInMonths, 0)
+			sub.DiscountEnd = &end
+		}
+	}
+
+	if pr.HasTrial() {
+		trialEnd := pr.TrialEnd()
+		sub.Status = SubscriptionTrialing
+		sub.TrialStart = &now
+		sub.TrialEnd = &trialEnd
+		sub.CurrentPeriodEnd = trialEnd
+	}
+
+	err = f.emit(ctx, "customer.subscription.created", sub, func() error {
+		if err := f.addSubscription(ctx, sub); err != nil {
+			return err
+		}
+
+		f.subscriptions[sub.ProviderID] = sub
+		f.baseItems[sub.ProviderID] = baseItemID
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// recurring prices are not charged until the trial ends, metered prices are charged for their usage at the end of the period
+	var amount int64
+	for _, it := range items {
+		if it.price.IsRecurring() && (sub.Trialing() || it.price.IsMetered()) {
+			continue
+		}
+
+		amount += it.price.Quote(it.quantity)
+	}
+
+	off, err := f.redeemFakeDiscounts(ctx, sessionID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	amount -= off
+
+	inv, err := f.saveFakeInvoice(ctx, "invoice.paid", sub, pr, InvoicePaid, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	if amount > 0 {
+		if err := f.addFakeCharge(ctx, &Charge{CustomerID: &inv.CustomerID, InvoiceID: &inv.ID, Amount: amount, Currency: inv.Currency, Status: ChargeSucceeded}); err != nil {
+			return nil, err
+		}
+	}
+
+	cs.SubscriptionProviderID = sub.ProviderID
+	if err := f.completeCheckoutSession(ctx, cs); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// SimulatePurchaseCompleted pays for the checkout session of one time prices, recording a purchase of each item.
+// The purchase of the first item is returned
+func (f *FakeProvider) SimulatePurchaseCompleted(ctx context.Context, sessionID string) (*Purchase, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cs, err := f.GetCheckoutSessionByProvider(ctx, ProviderFake, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cs.Status != CheckoutSessionOpen {
+		return nil, fmt.Errorf("fake: checkout session %s is %s", sessionID, cs.Status)
+	}
+
+	items, err := f.fakeSessionItems(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	if recurringCheckoutItem(items) != nil {
+		return nil, fmt.Errorf("fake: checkout session %s is for a recurring price, use SimulateCheckoutCompleted", sessionID)
+	}
+
+	var amount int64
+	for _, it := range items {
+		amount += it.price.Quote(it.quantity)
+	}
+
+	off, err := f.redeemFakeDiscounts(ctx, sessionID, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	amount -= off
+	paymentID := f.nextID("pi")
+	itemIDs := make([]string, len(cs.Items))
+	for i := range itemIDs {
+		itemIDs[i] = f.nextID("li")
+	}
+
+	purchases, err := f.sessionPurchases(ctx, cs, paymentID, itemIDs, amount, items[0].price.Currency, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.addFakeCharge(ctx, &Charge{
+		PaymentIntentID: paymentID,
+		CustomerID:      &cs.CustomerID,
+		Amount:          amount,
+		Currency:        items[0].price.Currency,
+		Status:          ChargeSucceeded,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.completeCheckoutSession(ctx, cs, purchases...); err != nil {
+		return nil, err
+	}
+
+	return &purchases[0], nil
+}
+
+// completeCheckoutSession marks the session as complete recording the purchases when given
+func (f *FakeProvider) completeCheckoutSession(ctx context.Context, cs *CheckoutSession, purchases ...Purchase) error {
+	now := time.Now()
+	cs.Status = CheckoutSessionComplete
+	cs.CompletedAt = &now
+
+	return f.emit(ctx, "checkout.session.completed", cs, func() error {
+		for i := range purchases {
+			if err := f.addPurchase(ctx, &purchases[i]); err != nil {
+				return err
+			}
+		}
+
+		return f.updateCheckoutSessionByProvider(ctx, cs)
+	})
+}
+
+// SimulateCheckoutExpired expires the checkout session as happens when a customer abandons the checkout
+func (f *FakeProvider) SimulateCheckoutExpired(ctx context.Context, sessionID string) (*CheckoutSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cs, err := f.GetCheckoutSessionByProvider(ctx, ProviderFake, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if cs.Status != CheckoutSessionOpen {
+		return nil, fmt.Errorf("fake: checkout session %s is %s", sessionID, cs.Status)
+	}
+
+	cs.Status = CheckoutSessionExpired
+	err = f.emit(ctx, "checkout.session.expired", cs, func() error {
+		return f.updateCheckoutSessionByProvider(ctx, cs)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// SimulatePaymentFailed marks the subscription as inactive as happens when a renewal payment fails.
+// The renewal invoice is left open until SimulatePaymentSucceeded is called
+func (f *FakeProvider) SimulatePaymentFailed(ctx context.Context, subProviderID string) (*Subscription, error) {
+	sub, err := f.simulateSubscriptionUpdated(ctx, subProviderID, func(s *Subscription) {
+		s.Active = false
+		s.Status = SubscriptionPastDue
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := f.simulateRenewalInvoice(ctx, "invoice.payment_failed", sub, InvoiceOpen)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.simulateInvoiceCharge(ctx, inv, ChargeFailed); err != nil {
+		return nil, err
+	}
+
+	// the provider retries the payment a few days later
+	nextRetry := time.Now().AddDate(0, 0, 3)
+	if err := f.addPaymentFailure(ctx, inv, 0, &nextRetry); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// SimulatePaymentSucceeded reactivates the subscription as happens when an outstanding payment is collected
+func (f *FakeProvider) SimulatePaymentSucceeded(ctx context.Context, subProviderID string) (*Subscription, error) {
+	sub, err := f.GetSubscriptionByProviderContext(ctx, ProviderFake, subProviderID)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, err := f.GetPriceByIDContext(ctx, sub.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the payment starts a new period
+	sub, err = f.simulateSubscriptionUpdated(ctx, subProviderID, func(s *Subscription) {
+		now := time.Now()
+		s.Active = true
+		s.Status = SubscriptionActive
+		s.CurrentPeriodStart = now
+		s.CurrentPeriodEnd = pr.PeriodEnd(now)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	inv, err := f.simulateRenewalInvoice(ctx, "invoice.paid", sub, InvoicePaid)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.simulateInvoiceCharge(ctx, inv, ChargeSucceeded); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+// simulateRenewalInvoice settles the open invoice of the subscription with the given status, creating one when there is none
+func (f *FakeProvider) simulateRenewalInvoice(ctx context.Context, eventType string, sub *Subscription, status InvoiceStatus) (*Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pr, err := f.GetPriceByIDContext(ctx, sub.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, inv := range f.invoices {
+		if inv.SubscriptionID == nil || *inv.SubscriptionID != sub.ID || inv.Status != InvoiceOpen {
+			continue
+		}
+
+		updated := *inv
+		updated.Status = status
+		if status == InvoicePaid {
+			updated.AmountPaid = updated.AmountDue
+		}
+
+		err := f.emit(ctx, eventType, &updated, func() error {
+			if err := f.updateInvoiceByProvider(ctx, &updated); err != nil {
+				return err
+			}
+
+			f.invoices[updated.ProviderID] = &updated
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &updated, nil
+	}
+
+	amount := pr.Quote(sub.Quantity)
+	if pr.IsMetered() {
+		usage, err := f.GetCurrentUsage(ctx, sub.ID, pr.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		amount = pr.Quote(usage)
+	}
+
+	return f.saveFakeInvoice(ctx, eventType, sub, pr, status, amount)
+}
+
+// simulateInvoiceCharge charges the amount due of the invoice
+func (f *FakeProvider) simulateInvoiceCharge(ctx context.Context, inv *Invoice, status ChargeStatus) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := &Charge{
+		CustomerID: &inv.CustomerID,
+		InvoiceID:  &inv.ID,
+		Amount:     inv.AmountDue,
+		Currency:   inv.Currency,
+		Status:     status,
+	}
+
+	if status == ChargeFailed {
+		c.FailureMessage = "Your card was declined."
+	}
+
+	return f.addFakeCharge(ctx, c)
+}
+
+// addFakeCharge stores the charge emitting the event of its status, f.mu must be held
+func (f *FakeProvider) addFakeCharge(ctx context.Context, c *Charge) error {
+	c.Provider = ProviderFake
+	c.ProviderID = f.nextID("ch")
+	c.CreatedAt = time.Now()
+
+	return f.emit(ctx, "charge."+c.Status, c, func() error {
+		if err := f.addCharge(ctx, c); err != nil {
+			return err
+		}
+
+		f.charges[c.ProviderID] = c
+		return nil
+	})
+}
+
+// saveFakeInvoice adds an invoice for the current period of the subscription, f.mu must be held
+func (f *FakeProvider) saveFakeInvoice(ctx context.Context, eventType string, sub *Subscription, pr *Price, status InvoiceStatus, amount int64) (*Invoice, error) {
+	id := f.nextID("in")
+	inv := &Invoice{
+		Provider:         ProviderFake,
+		ProviderID:       id,
+		CustomerID:       sub.CustomerID,
+		SubscriptionID:   &sub.ID,
+		Number:           fmt.Sprintf("FAKE-%04d", len(f.invoices)+1),
+		Status:           status,
+		AmountDue:        amount,
+		Currency:         pr.Currency,
+		PeriodStart:      sub.CurrentPeriodStart,
+		PeriodEnd:        sub.CurrentPeriodEnd,
+		HostedInvoiceURL: fmt.Sprintf("https://invoice.fake.test/%s", id),
+		InvoicePDF:       fmt.Sprintf("https://invoice.fake.test/%s/pdf", id),
+		CreatedAt:        time.Now(),
+	}
+
+	if status == InvoicePaid {
+		inv.AmountPaid = amount
+	}
+
+	err := f.emit(ctx, eventType, inv, func() error {
+		if err := f.addInvoice(ctx, inv); err != nil {
+			return err
+		}
+
+		f.invoices[id] = inv
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// SimulateSubscriptionCanceled ends the subscription as happens when it is canceled in the provider
+func (f *FakeProvider) SimulateSubscriptionCanceled(ctx context.Context, subProviderID string) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[subProviderID]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+
+	now := time.Now()
+	canceled := *sub
+	canceled.Items = fakeSubscriptionItems(sub, &canceled, f.baseItems[subProviderID])
+	canceled.Active = false
+	canceled.Status = SubscriptionCanceled
+	canceled.EndedAt = &now
+	if canceled.CanceledAt == nil {
+		canceled.CanceledAt = &now
+	}
+
+	err := f.emit(ctx, "customer.subscription.deleted", &canceled, func() error {
+		if err := f.updateSubscriptionByProvider(ctx, &canceled); err != nil {
+			return err
+		}
+
+		f.subscriptions[subProviderID] = &canceled
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &canceled, nil
+}
+
+// SimulateDisputeOpened disputes the whole amount of the charge as happens when the customer contacts their bank
+func (f *FakeProvider) SimulateDisputeOpened(ctx context.Context, chargeProviderID, reason string) (*Dispute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.charges[chargeProviderID]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+
+	dueBy := time.Now().AddDate(0, 0, 7)
+	d := &Dispute{
+		Provider:      ProviderFake,
+		ProviderID:    f.nextID("dp"),
+		ChargeID:      c.ID,
+		Amount:        c.Amount,
+		Currency:      c.Currency,
+		Status:        DisputeNeedsResponse,
+		Reason:        reason,
+		EvidenceDueBy: &dueBy,
+		CreatedAt:     time.Now(),
+	}
+
+	err := f.emit(ctx, "charge.dispute.created", d, func() error {
+		if err := f.addDispute(ctx, d); err != nil {
+			return err
+		}
+
+		f.disputes[d.ProviderID] = d
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// SimulateDisputeClosed decides the dispute in favor of the merchant when won is set
+func (f *FakeProvider) SimulateDisputeClosed(ctx context.Context, disputeProviderID string, won bool) (*Dispute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	d, ok := f.disputes[disputeProviderID]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+
+	closed := *d
+	closed.Status = DisputeLost
+	if won {
+		closed.Status = DisputeWon
+	}
+
+	err := f.emit(ctx, "charge.dispute.closed", &closed, func() error {
+		if err := f.updateDisputeByProvider(ctx, &closed); err != nil {
+			return err
+		}
+
+		f.disputes[disputeProviderID] = &closed
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &closed, nil
+}
+
+// fakeSubscriptionItems returns a copy of the items of prev where the item holding the seats, baseItemID, follows the price and quantity of sub
+func fakeSubscriptionItems(prev, sub *Subscription, baseItemID string) []SubscriptionItem {
+	if prev.Items == nil {
+		return nil
+	}
+
+	items := make([]SubscriptionItem, 0, len(prev.Items))
+	for _, it := range prev.Items {
+		item := SubscriptionItem{ProviderID: it.ProviderID, PriceID: it.PriceID, Quantity: it.Quantity}
+		if it.ProviderID == baseItemID {
+			item.PriceID = sub.PriceID
+			item.Quantity = sub.Quantity
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func (f *FakeProvider) simulateSubscriptionUpdated(ctx context.Context, subProviderID string, update func(*Subscription)) (*Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[subProviderID]
+	if !ok {
+		return nil, ErrFakeNotFound
+	}
+
+	updated := *sub
+	update(&updated)
+	updated.Items = fakeSubscriptionItems(sub, &updated, f.baseItems[subProviderID])
+
+	err := f.emit(ctx, "customer.subscription.updated", &updated, func() error {
+		if err := f.updateSubscriptionByProvider(ctx, &updated); err != nil {
+			return err
+		}
+
+		f.subscriptions[subProviderID] = &updated
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// emit records the event in the same way the stripe webhook does and applies it to the repository
+func (f *FakeProvider) emit(ctx context.Context, eventType string, v any, apply func() error) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	e := &WebhookEvent{
+		Provider:   ProviderFake,
+		ProviderID: f.nextID("evt"),
+		EventType:  eventType,
+		Payload:    payload,
+		OccurredAt: &now,
+	}
+
+	if _, err := f.addWebhookEvent(ctx, e); err != nil {
+		return err
+	}
+
+	// the fake provider applies events synchronously so they are never retried
+	err = apply()
+	if err := f.completeWebhookEvent(ctx, e, err, &RetryPolicy{MaxAttempts: 1}); err != nil {
+		return err
+	}
+
+	return err
+}
+
+// nextID returns a random id so that instances sharing a database, such as restarts during local development, don't collide
+func (f *FakeProvider) nextID(prefix string) string {
+	return fmt.Sprintf("%s_%s", prefix, randomHex(8))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
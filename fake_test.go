@@ -0,0 +1,142 @@
+package pay
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+// testRepo returns a repo on a freshly migrated schema of the database in PAY_TEST_DATABASE,
+// the test is skipped when it is not set
+func testRepo(t *testing.T) *Repo {
+	t.Helper()
+
+	dsn := os.Getenv("PAY_TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("PAY_TEST_DATABASE is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS " + DefaultSchema + " CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewEntityRepo(db)
+	if err := repo.InitContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return repo
+}
+
+func TestFakeCheckoutCompleted(t *testing.T) {
+	ctx := context.Background()
+	f := NewFakeProvider(testRepo(t))
+
+	var (
+		added     []*Subscription
+		completed []*CheckoutSession
+		paid      []*Invoice
+	)
+
+	f.OnSubscriptionAdded(func(s *Subscription) { added = append(added, s) })
+	f.OnCheckoutCompleted(func(cs *CheckoutSession) { completed = append(completed, cs) })
+	f.OnPaymentSucceeded(func(inv *Invoice) { paid = append(paid, inv) })
+
+	pl := Plan{Name: "Basic", Active: true}
+	if err := f.AddPlanContext(ctx, &pl); err != nil {
+		t.Fatal(err)
+	}
+
+	base := Price{PlanID: pl.ID, Amount: 1000, Currency: "usd", Interval: IntervalMonth, IntervalCount: 1}
+	if err := f.AddPriceContext(ctx, &base); err != nil {
+		t.Fatal(err)
+	}
+
+	addon := Price{PlanID: pl.ID, Amount: 500, Currency: "usd", Interval: IntervalMonth, IntervalCount: 1}
+	if err := f.AddPriceContext(ctx, &addon); err != nil {
+		t.Fatal(err)
+	}
+
+	cust := Customer{Name: "Jane", Email: "jane@example.com"}
+	if err := f.AddCustomerContext(ctx, &cust); err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := f.CheckoutContext(ctx, &CheckoutRequest{
+		CustomerID:  cust.ID,
+		PriceID:     base.ID,
+		Quantity:    3,
+		Items:       []CheckoutItem{{PriceID: addon.ID}},
+		RedirectURL: "https://example.com/success",
+		Metadata:    Metadata{"order": "42"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := f.SimulateCheckoutCompleted(ctx, path.Base(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.PriceID != base.ID || sub.Quantity != 3 {
+		t.Fatalf("expected subscription for 3 seats of price %d, got %d seats of price %d", base.ID, sub.Quantity, sub.PriceID)
+	}
+
+	if len(added) != 1 || added[0].ProviderID != sub.ProviderID {
+		t.Fatalf("expected OnSubscriptionAdded for %s, got %d calls", sub.ProviderID, len(added))
+	}
+
+	if len(completed) != 1 {
+		t.Fatalf("expected OnCheckoutCompleted once, got %d calls", len(completed))
+	}
+
+	if cs := completed[0]; cs.Status != CheckoutSessionComplete || cs.Metadata["order"] != "42" || len(cs.Items) != 2 {
+		t.Fatalf("unexpected completed session %+v", cs)
+	}
+
+	if len(paid) != 1 || paid[0].AmountPaid != 3500 {
+		t.Fatalf("expected OnPaymentSucceeded for 3500, got %+v", paid)
+	}
+
+	items, err := f.ListSubscriptionItems(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 || items[0].PriceID != base.ID || items[1].PriceID != addon.ID {
+		t.Fatalf("expected the base and add-on items, got %+v", items)
+	}
+
+	users, err := f.ListUsernamesContext(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 1 || users[0] != cust.Email {
+		t.Fatalf("expected the customer to be the only user, got %v", users)
+	}
+
+	// every change is recorded as an event the same way the webhook does
+	events, err := f.ListAllWebhookEventsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events {
+		if e.Provider != ProviderFake || e.Status != WebhookEventProcessed {
+			t.Fatalf("unexpected event %s %s %s", e.Provider, e.EventType, e.Status)
+		}
+	}
+}
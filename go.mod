@@ -4,6 +4,7 @@ go 1.21.4
 
 require (
 	github.com/cristosal/orm v0.0.4-beta
+	github.com/lib/pq v1.9.0
 	github.com/stripe/stripe-go/v74 v74.30.0
 )
 
@@ -0,0 +1,307 @@
+package pay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cristosal/orm"
+)
+
+var (
+	ErrInviteKeyNotSet  = errors.New("invite key not set")
+	ErrInviteInvalid    = errors.New("invalid invite token")
+	ErrInviteExpired    = errors.New("invite expired")
+	ErrInviteNotPending = errors.New("invite is no longer pending")
+)
+
+// DefaultInviteTTL is how long an invite can be accepted for when no ttl is given
+const DefaultInviteTTL = 7 * 24 * time.Hour
+
+// InviteSeat invites email to take a seat of the subscription. Pending invites count against the seats,
+// ErrNoSeatsAvailable is returned when every seat is taken or promised to an invitee.
+// The returned token is sent to the invitee, who accepts the invite by passing it to AcceptSeatInvite
+func (r *Repo) InviteSeat(ctx context.Context, subID int64, email string, ttl time.Duration) (*SeatInvite, string, error) {
+	if len(r.inviteKey) == 0 {
+		return nil, "", ErrInviteKeyNotSet
+	}
+
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer tx.Rollback()
+
+	sub, taken, err := r.lockSeats(ctx, tx, subID, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if taken >= sub.Quantity {
+		return nil, "", ErrNoSeatsAvailable
+	}
+
+	now := time.Now()
+	inv := SeatInvite{
+		SubscriptionID: subID,
+		Email:          email,
+		Status:         SeatInvitePending,
+		ExpiresAt:      now.Add(ttl),
+		CreatedAt:      now,
+	}
+
+	if err := orm.Add(r.tx(ctx, tx), &inv); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	token, err := r.SeatInviteToken(&inv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	r.seatInvited(&inv, token)
+	return &inv, token, nil
+}
+
+// SeatInviteToken returns the token of the invite so that it can be sent again
+func (r *Repo) SeatInviteToken(inv *SeatInvite) (string, error) {
+	if len(r.inviteKey) == 0 {
+		return "", ErrInviteKeyNotSet
+	}
+
+	payload := fmt.Sprintf("%d.%d", inv.ID, inv.ExpiresAt.Unix())
+	return payload + "." + base64.RawURLEncoding.EncodeToString(r.signInvite(payload)), nil
+}
+
+// AcceptSeatInvite adds username to the subscription the invite was sent for.
+// ErrNoSeatsAvailable is returned when the seats were taken since the invite was sent
+func (r *Repo) AcceptSeatInvite(ctx context.Context, token, username string) (*SeatInvite, error) {
+	id, expires, err := r.parseInviteToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	var inv SeatInvite
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE id = $1 FOR UPDATE", orm.Columns(&inv).List(), orm.TableName(&inv))
+	if err := orm.QueryRow(r.tx(ctx, tx), &inv, sql, id); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return nil, ErrInviteInvalid
+		}
+
+		return nil, err
+	}
+
+	if inv.ExpiresAt.Unix() != expires {
+		return nil, ErrInviteInvalid
+	}
+
+	if inv.Expired() {
+		if err := r.expireSeatInvite(ctx, tx, &inv); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrInviteExpired
+	}
+
+	if inv.Status != SeatInvitePending {
+		return nil, ErrInviteNotPending
+	}
+
+	// the seat held by the invite is the one taken
+	sub, err := r.addSubscriptionUser(ctx, tx, &SubscriptionUser{
+		SubscriptionID: inv.SubscriptionID,
+		Username:       username,
+	}, inv.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	inv.Status = SeatInviteAccepted
+	inv.Username = username
+	inv.AcceptedAt = &now
+
+	if err := orm.UpdateByID(r.tx(ctx, tx), &inv); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.seatAdded(sub, username)
+	r.seatAccepted(&inv)
+	return &inv, nil
+}
+
+// RevokeSeatInvite withdraws a pending invite
+func (r *Repo) RevokeSeatInvite(ctx context.Context, id int64) error {
+	sql := fmt.Sprintf("UPDATE %s SET status = $1 WHERE id = $2 AND status = $3", orm.TableName(&SeatInvite{}))
+	res, err := r.conn(ctx).Exec(sql, SeatInviteRevoked, id, SeatInvitePending)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		if _, err := r.GetSeatInviteByID(ctx, id); err != nil {
+			return err
+		}
+
+		return ErrInviteNotPending
+	}
+
+	return nil
+}
+
+// ExpireSeatInvites marks pending invites that are past their expiry as expired, returning how many were
+func (r *Repo) ExpireSeatInvites(ctx context.Context) (int64, error) {
+	sql := fmt.Sprintf("UPDATE %s SET status = $1 WHERE status = $2 AND expires_at <= $3", orm.TableName(&SeatInvite{}))
+	res, err := r.conn(ctx).Exec(sql, SeatInviteExpired, SeatInvitePending, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// GetSeatInviteByID returns the invite with the given id
+func (r *Repo) GetSeatInviteByID(ctx context.Context, id int64) (*SeatInvite, error) {
+	var inv SeatInvite
+	if err := orm.Get(r.conn(ctx), &inv, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &inv, nil
+}
+
+// ListSeatInvites returns the invites sent for the subscription, most recent first
+func (r *Repo) ListSeatInvites(ctx context.Context, subID int64) ([]SeatInvite, error) {
+	var invites []SeatInvite
+	if err := orm.List(r.conn(ctx), &invites, "WHERE subscription_id = $1 ORDER BY created_at DESC", subID); err != nil {
+		return nil, err
+	}
+
+	return invites, nil
+}
+
+// lockSeats locks the subscription, serializing changes to its seats, and returns it with the number of seats taken.
+// Users and pending invites take a seat, the pending invite with id except is left out so that accepting it isn't counted twice
+func (r *Repo) lockSeats(ctx context.Context, tx *sql.Tx, subID, except int64) (*Subscription, int64, error) {
+	sub, err := r.lockSubscription(ctx, tx, subID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users, err := orm.Count(r.tx(ctx, tx), &SubscriptionUser{}, "WHERE subscription_id = $1", subID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// pending invites hold on to a seat until they are accepted, revoked or expire
+	pending, err := orm.Count(r.tx(ctx, tx), &SeatInvite{}, "WHERE subscription_id = $1 AND status = $2 AND expires_at > $3 AND id <> $4",
+		subID, SeatInvitePending, time.Now(), except)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return sub, users + pending, nil
+}
+
+// checkSeatCount returns ErrSeatsInUse when n is less than the seats taken by the users and pending invites of the subscription
+func (r *Repo) checkSeatCount(ctx context.Context, subID, n int64) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	_, taken, err := r.lockSeats(ctx, tx, subID, 0)
+	if err != nil {
+		return err
+	}
+
+	if n < taken {
+		return ErrSeatsInUse
+	}
+
+	return tx.Commit()
+}
+
+// expireSeatInvite commits the expiry of the invite so that it is recorded even though accepting it fails
+func (r *Repo) expireSeatInvite(ctx context.Context, tx *sql.Tx, inv *SeatInvite) error {
+	inv.Status = SeatInviteExpired
+	if err := orm.UpdateByID(r.tx(ctx, tx), inv); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// parseInviteToken checks the signature of the token returning the invite id and expiry it was issued for
+func (r *Repo) parseInviteToken(token string) (id int64, expires int64, err error) {
+	if len(r.inviteKey) == 0 {
+		return 0, 0, ErrInviteKeyNotSet
+	}
+
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return 0, 0, ErrInviteInvalid
+	}
+
+	payload := token[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(sig, r.signInvite(payload)) {
+		return 0, 0, ErrInviteInvalid
+	}
+
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return 0, 0, ErrInviteInvalid
+	}
+
+	if id, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return 0, 0, ErrInviteInvalid
+	}
+
+	if expires, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, ErrInviteInvalid
+	}
+
+	return id, expires, nil
+}
+
+func (r *Repo) signInvite(payload string) []byte {
+	mac := hmac.New(sha256.New, r.inviteKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
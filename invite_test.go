@@ -0,0 +1,56 @@
+package pay
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeatInviteToken(t *testing.T) {
+	r := NewEntityRepo(nil)
+	r.SetInviteKey([]byte("secret"))
+
+	expiresAt := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.UTC)
+	token, err := r.SeatInviteToken(&SeatInvite{ID: 42, ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, expires, err := r.parseInviteToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 42 || expires != expiresAt.Unix() {
+		t.Fatalf("expected invite 42 expiring at %d, got invite %d expiring at %d", expiresAt.Unix(), id, expires)
+	}
+
+	other := NewEntityRepo(nil)
+	other.SetInviteKey([]byte("other secret"))
+
+	sig := token[strings.LastIndex(token, ".")+1:]
+	tests := []struct {
+		name  string
+		repo  *Repo
+		token string
+		want  error
+	}{
+		{"other invite", r, strings.Replace(token, "42.", "43.", 1), ErrInviteInvalid},
+		{"later expiry", r, strings.Replace(token, ".", ".9", 1), ErrInviteInvalid},
+		{"other signature", r, strings.TrimSuffix(token, sig) + strings.Repeat("A", len(sig)), ErrInviteInvalid},
+		{"malformed signature", r, token + "!", ErrInviteInvalid},
+		{"no signature", r, "42", ErrInviteInvalid},
+		{"empty", r, "", ErrInviteInvalid},
+		{"other key", other, token, ErrInviteInvalid},
+		{"no key", NewEntityRepo(nil), token, ErrInviteKeyNotSet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := tt.repo.parseInviteToken(tt.token); !errors.Is(err, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -91,4 +91,489 @@ var migrations = []orm.Migration{
 			)`,
 		Down: "DROP TABLE {{ .Schema }}.subscription_user",
 	},
+	{
+		Name:        "webhook event status",
+		Description: "adds processing status to webhook events so that failed events can be retried, events delivered more than once are moved to webhook_event_duplicate so that the provider id can be unique",
+		Up: `ALTER TABLE {{ .Schema }}.webhook_event
+			ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'processed',
+			ADD COLUMN attempts INT NOT NULL DEFAULT 0,
+			ADD COLUMN last_error TEXT NOT NULL DEFAULT '',
+			ADD COLUMN next_attempt_at TIMESTAMPTZ,
+			ADD COLUMN occurred_at TIMESTAMPTZ,
+			ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			ADD COLUMN processed_at TIMESTAMPTZ;
+
+			CREATE INDEX webhook_event_due_idx ON {{ .Schema }}.webhook_event (provider, next_attempt_at) WHERE status != 'processed';
+
+			CREATE TABLE {{ .Schema }}.webhook_event_duplicate (LIKE {{ .Schema }}.webhook_event);
+
+			INSERT INTO {{ .Schema }}.webhook_event_duplicate
+				SELECT * FROM {{ .Schema }}.webhook_event a WHERE EXISTS (
+					SELECT 1 FROM {{ .Schema }}.webhook_event b
+					WHERE a.provider = b.provider AND a.provider_id = b.provider_id AND a.id > b.id
+				);
+
+			DELETE FROM {{ .Schema }}.webhook_event WHERE id IN (SELECT id FROM {{ .Schema }}.webhook_event_duplicate);
+
+			ALTER TABLE {{ .Schema }}.webhook_event ADD CONSTRAINT webhook_event_provider_id_key UNIQUE (provider, provider_id);`,
+		Down: `ALTER TABLE {{ .Schema }}.webhook_event DROP CONSTRAINT webhook_event_provider_id_key;
+
+			INSERT INTO {{ .Schema }}.webhook_event SELECT * FROM {{ .Schema }}.webhook_event_duplicate;
+
+			DROP TABLE {{ .Schema }}.webhook_event_duplicate;
+
+			DROP INDEX {{ .Schema }}.webhook_event_due_idx;
+
+			ALTER TABLE {{ .Schema }}.webhook_event
+			DROP COLUMN status,
+			DROP COLUMN attempts,
+			DROP COLUMN last_error,
+			DROP COLUMN next_attempt_at,
+			DROP COLUMN occurred_at,
+			DROP COLUMN created_at,
+			DROP COLUMN processed_at;`,
+	},
+	{
+		Name:        "subscription snapshot",
+		Description: "adds the time the stored state of a subscription was current at the provider so that older snapshots are ignored",
+		Up:          "ALTER TABLE {{ .Schema }}.subscription ADD COLUMN snapshot_at TIMESTAMPTZ",
+		Down:        "ALTER TABLE {{ .Schema }}.subscription DROP COLUMN snapshot_at",
+	},
+	{
+		Name:        "checkout_session table",
+		Description: "create checkout session table",
+		Up: `CREATE TABLE {{ .Schema }}.checkout_session (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			customer_id INT NOT NULL,
+			price_id INT NOT NULL,
+			status VARCHAR(32) NOT NULL,
+			url TEXT NOT NULL DEFAULT '',
+			subscription_provider_id VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			completed_at TIMESTAMPTZ,
+			FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE RESTRICT,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE RESTRICT,
+			UNIQUE (provider, provider_id)
+		);`,
+		Down: "DROP TABLE {{ .Schema }}.checkout_session",
+	},
+	{
+		Name:        "purchase table",
+		Description: "create purchase table for one time payments",
+		Up: `CREATE TABLE {{ .Schema }}.purchase (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			payment_id VARCHAR(255) NOT NULL,
+			customer_id INT NOT NULL,
+			price_id INT NOT NULL,
+			quantity INT NOT NULL DEFAULT 1,
+			amount INT NOT NULL,
+			currency VARCHAR(3) NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE RESTRICT,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE RESTRICT,
+			UNIQUE (provider, provider_id)
+		);`,
+		Down: "DROP TABLE {{ .Schema }}.purchase",
+	},
+	{
+		Name:        "subscription cancellation",
+		Description: "adds cancellation and pause state to subscriptions",
+		Up: `ALTER TABLE {{ .Schema }}.subscription
+			ADD COLUMN cancel_at_period_end BOOLEAN NOT NULL DEFAULT FALSE,
+			ADD COLUMN canceled_at TIMESTAMPTZ,
+			ADD COLUMN pause_collection VARCHAR(32) NOT NULL DEFAULT '';`,
+		Down: `ALTER TABLE {{ .Schema }}.subscription
+			DROP COLUMN cancel_at_period_end,
+			DROP COLUMN canceled_at,
+			DROP COLUMN pause_collection;`,
+	},
+	{
+		Name:        "subscription status",
+		Description: "adds the provider status and billing periods to subscriptions. existing subscriptions are marked active or past_due until the next sync",
+		Up: `ALTER TABLE {{ .Schema }}.subscription
+			ADD COLUMN status VARCHAR(32) NOT NULL DEFAULT 'active',
+			ADD COLUMN current_period_start TIMESTAMPTZ,
+			ADD COLUMN current_period_end TIMESTAMPTZ,
+			ADD COLUMN trial_start TIMESTAMPTZ,
+			ADD COLUMN trial_end TIMESTAMPTZ,
+			ADD COLUMN ended_at TIMESTAMPTZ;
+
+			UPDATE {{ .Schema }}.subscription SET
+				status = CASE WHEN active THEN 'active' ELSE 'past_due' END,
+				current_period_start = created_at,
+				current_period_end = created_at;
+
+			ALTER TABLE {{ .Schema }}.subscription
+			ALTER COLUMN current_period_start SET NOT NULL,
+			ALTER COLUMN current_period_end SET NOT NULL;
+
+			CREATE INDEX subscription_status_idx ON {{ .Schema }}.subscription (status);`,
+		Down: `DROP INDEX {{ .Schema }}.subscription_status_idx;
+
+			ALTER TABLE {{ .Schema }}.subscription
+			DROP COLUMN status,
+			DROP COLUMN current_period_start,
+			DROP COLUMN current_period_end,
+			DROP COLUMN trial_start,
+			DROP COLUMN trial_end,
+			DROP COLUMN ended_at;`,
+	},
+	{
+		Name:        "plan_feature table",
+		Description: "create plan feature table for entitlements",
+		Up: `CREATE TABLE {{ .Schema }}.plan_feature (
+			id SERIAL PRIMARY KEY,
+			plan_id INT NOT NULL,
+			key VARCHAR(255) NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT TRUE,
+			feature_limit BIGINT,
+			FOREIGN KEY (plan_id) REFERENCES {{ .Schema }}.plan (id) ON DELETE CASCADE,
+			UNIQUE (plan_id, key)
+		);`,
+		Down: "DROP TABLE {{ .Schema }}.plan_feature",
+	},
+	{
+		Name:        "subscription quantity",
+		Description: "adds the number of seats to subscriptions. existing subscriptions get as many seats as they have users",
+		Up: `ALTER TABLE {{ .Schema }}.subscription ADD COLUMN quantity INT NOT NULL DEFAULT 1;
+
+			UPDATE {{ .Schema }}.subscription s SET quantity = su.n
+			FROM (SELECT subscription_id, COUNT(*) AS n FROM {{ .Schema }}.subscription_user GROUP BY subscription_id) su
+			WHERE su.subscription_id = s.id;`,
+		Down: "ALTER TABLE {{ .Schema }}.subscription DROP COLUMN quantity",
+	},
+	{
+		Name:        "seat_invite table",
+		Description: "create seat invite table",
+		Up: `CREATE TABLE {{ .Schema }}.seat_invite (
+			id SERIAL PRIMARY KEY,
+			subscription_id INT NOT NULL,
+			email VARCHAR(255) NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			status VARCHAR(32) NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL,
+			created_at TIMESTAMPTZ NOT NULL,
+			accepted_at TIMESTAMPTZ,
+			FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX seat_invite_subscription_idx ON {{ .Schema }}.seat_invite (subscription_id);`,
+		Down: "DROP TABLE {{ .Schema }}.seat_invite",
+	},
+	{
+		Name:        "subscription_user role",
+		Description: "adds roles to subscription users. users matching the email of the customer become owners",
+		Up: `ALTER TABLE {{ .Schema }}.subscription_user ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member';
+
+			UPDATE {{ .Schema }}.subscription_user su SET role = 'owner'
+			FROM {{ .Schema }}.subscription s
+			INNER JOIN {{ .Schema }}.customer c ON c.id = s.customer_id
+			WHERE su.subscription_id = s.id AND su.username = c.email;`,
+		Down: "ALTER TABLE {{ .Schema }}.subscription_user DROP COLUMN role",
+	},
+	{
+		Name:        "invoice table",
+		Description: "create invoice table",
+		Up: `CREATE TABLE {{ .Schema }}.invoice (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			customer_id INT NOT NULL,
+			subscription_id INT,
+			number VARCHAR(255) NOT NULL DEFAULT '',
+			status VARCHAR(32) NOT NULL,
+			amount_due INT NOT NULL,
+			amount_paid INT NOT NULL,
+			currency VARCHAR(3) NOT NULL,
+			period_start TIMESTAMPTZ NOT NULL,
+			period_end TIMESTAMPTZ NOT NULL,
+			hosted_invoice_url TEXT NOT NULL DEFAULT '',
+			invoice_pdf TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE CASCADE,
+			FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE SET NULL,
+			UNIQUE (provider, provider_id)
+		);
+
+		CREATE INDEX invoice_customer_idx ON {{ .Schema }}.invoice (customer_id, created_at);`,
+		Down: "DROP TABLE {{ .Schema }}.invoice",
+	},
+	{
+		Name:        "dunning table",
+		Description: "create dunning table tracking failed payments of subscriptions",
+		Up: `CREATE TABLE {{ .Schema }}.dunning (
+			subscription_id INT PRIMARY KEY,
+			invoice_id INT,
+			attempts INT NOT NULL DEFAULT 0,
+			started_at TIMESTAMPTZ NOT NULL,
+			last_failed_at TIMESTAMPTZ,
+			next_retry_at TIMESTAMPTZ,
+			grace_ends_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE,
+			FOREIGN KEY (invoice_id) REFERENCES {{ .Schema }}.invoice (id) ON DELETE SET NULL
+		);`,
+		Down: "DROP TABLE {{ .Schema }}.dunning",
+	},
+	{
+		Name:        "charge table",
+		Description: "create charge table",
+		Up: `CREATE TABLE {{ .Schema }}.charge (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			payment_intent_id VARCHAR(255) NOT NULL DEFAULT '',
+			customer_id INT,
+			invoice_id INT,
+			amount INT NOT NULL,
+			amount_refunded INT NOT NULL DEFAULT 0,
+			currency VARCHAR(3) NOT NULL,
+			status VARCHAR(32) NOT NULL,
+			refunded BOOL NOT NULL DEFAULT FALSE,
+			failure_message TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE SET NULL,
+			FOREIGN KEY (invoice_id) REFERENCES {{ .Schema }}.invoice (id) ON DELETE SET NULL,
+			UNIQUE (provider, provider_id)
+		);
+
+		CREATE INDEX charge_customer_idx ON {{ .Schema }}.charge (customer_id, created_at);`,
+		Down: "DROP TABLE {{ .Schema }}.charge",
+	},
+	{
+		Name:        "refund table",
+		Description: "create refund table",
+		Up: `CREATE TABLE {{ .Schema }}.refund (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			charge_id INT NOT NULL,
+			amount INT NOT NULL,
+			currency VARCHAR(3) NOT NULL,
+			status VARCHAR(32) NOT NULL,
+			reason VARCHAR(64) NOT NULL DEFAULT '',
+			failure_reason VARCHAR(64) NOT NULL DEFAULT '',
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (charge_id) REFERENCES {{ .Schema }}.charge (id) ON DELETE CASCADE,
+			UNIQUE (provider, provider_id)
+		);`,
+		Down: "DROP TABLE {{ .Schema }}.refund",
+	},
+	{
+		Name:        "dispute table",
+		Description: "create dispute table",
+		Up: `CREATE TABLE {{ .Schema }}.dispute (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			charge_id INT NOT NULL,
+			amount INT NOT NULL,
+			currency VARCHAR(3) NOT NULL,
+			status VARCHAR(32) NOT NULL,
+			reason VARCHAR(64) NOT NULL DEFAULT '',
+			evidence_due_by TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (charge_id) REFERENCES {{ .Schema }}.charge (id) ON DELETE CASCADE,
+			UNIQUE (provider, provider_id)
+		);
+
+		CREATE INDEX dispute_status_idx ON {{ .Schema }}.dispute (status);`,
+		Down: "DROP TABLE {{ .Schema }}.dispute",
+	},
+	{
+		Name:        "metered prices",
+		Description: "add usage type to prices and create usage_record table, records that fail to be flushed are attempted again after next_attempt_at",
+		Up: `ALTER TABLE {{ .Schema }}.price
+			ADD COLUMN usage_type VARCHAR(16) NOT NULL DEFAULT 'licensed',
+			ADD COLUMN aggregate_usage VARCHAR(32) NOT NULL DEFAULT '';
+
+		CREATE TABLE {{ .Schema }}.usage_record (
+			id SERIAL PRIMARY KEY,
+			subscription_id INT NOT NULL,
+			price_id INT NOT NULL,
+			quantity BIGINT NOT NULL,
+			recorded_at TIMESTAMPTZ NOT NULL,
+			idempotency_key VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL DEFAULT '',
+			attempts INT NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL,
+			flushed_at TIMESTAMPTZ,
+			FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id),
+			UNIQUE (subscription_id, idempotency_key)
+		);
+
+		CREATE INDEX usage_record_unflushed_idx ON {{ .Schema }}.usage_record (next_attempt_at) WHERE flushed_at IS NULL;
+		CREATE INDEX usage_record_period_idx ON {{ .Schema }}.usage_record (subscription_id, price_id, recorded_at);`,
+		Down: `DROP TABLE {{ .Schema }}.usage_record;
+
+		ALTER TABLE {{ .Schema }}.price
+			DROP COLUMN usage_type,
+			DROP COLUMN aggregate_usage;`,
+	},
+	{
+		Name:        "price tiers",
+		Description: "add billing scheme to prices and create price_tier table",
+		Up: `ALTER TABLE {{ .Schema }}.price
+			ADD COLUMN billing_scheme VARCHAR(16) NOT NULL DEFAULT 'per_unit',
+			ADD COLUMN tiers_mode VARCHAR(16) NOT NULL DEFAULT '';
+
+		CREATE TABLE {{ .Schema }}.price_tier (
+			id SERIAL PRIMARY KEY,
+			price_id INT NOT NULL,
+			up_to BIGINT,
+			unit_amount INT NOT NULL DEFAULT 0,
+			flat_amount INT NOT NULL DEFAULT 0,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX price_tier_price_id_idx ON {{ .Schema }}.price_tier (price_id);`,
+		Down: `DROP TABLE {{ .Schema }}.price_tier;
+
+		ALTER TABLE {{ .Schema }}.price
+			DROP COLUMN billing_scheme,
+			DROP COLUMN tiers_mode;`,
+	},
+	{
+		Name:        "price intervals",
+		Description: "replace price schedule with billing interval and interval count, prices stored with an empty schedule such as weekly and daily prices are left without an interval until a sync or price event fills it in",
+		Up: `ALTER TABLE {{ .Schema }}.price
+			ADD COLUMN billing_interval VARCHAR(16) NOT NULL DEFAULT '',
+			ADD COLUMN interval_count INT NOT NULL DEFAULT 0;
+
+		UPDATE {{ .Schema }}.price SET billing_interval = 'month', interval_count = 1 WHERE schedule = 'monthly';
+		UPDATE {{ .Schema }}.price SET billing_interval = 'year', interval_count = 1 WHERE schedule = 'annual';
+
+		ALTER TABLE {{ .Schema }}.price DROP COLUMN schedule;`,
+		Down: `ALTER TABLE {{ .Schema }}.price ADD COLUMN schedule VARCHAR(32) NOT NULL DEFAULT '';
+
+		UPDATE {{ .Schema }}.price SET schedule = CASE
+			WHEN billing_interval = '' THEN 'once'
+			WHEN billing_interval = 'month' AND interval_count = 1 THEN 'monthly'
+			WHEN billing_interval = 'year' AND interval_count = 1 THEN 'annual'
+			ELSE ''
+		END;
+
+		ALTER TABLE {{ .Schema }}.price
+			DROP COLUMN billing_interval,
+			DROP COLUMN interval_count;`,
+	},
+	{
+		Name:        "coupons",
+		Description: "create coupon and promotion_code tables and add discounts to subscriptions",
+		Up: `CREATE TABLE {{ .Schema }}.coupon (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL DEFAULT '',
+			percent_off NUMERIC(5, 2) NOT NULL DEFAULT 0,
+			amount_off INT NOT NULL DEFAULT 0,
+			currency VARCHAR(3) NOT NULL DEFAULT '',
+			duration VARCHAR(16) NOT NULL,
+			duration_in_months INT NOT NULL DEFAULT 0,
+			max_redemptions INT NOT NULL DEFAULT 0,
+			times_redeemed INT NOT NULL DEFAULT 0,
+			redeem_by TIMESTAMPTZ,
+			valid BOOL NOT NULL DEFAULT TRUE,
+			created_at TIMESTAMPTZ NOT NULL,
+			UNIQUE (provider, provider_id)
+		);
+
+		CREATE TABLE {{ .Schema }}.promotion_code (
+			id SERIAL PRIMARY KEY,
+			provider VARCHAR(255) NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			coupon_id INT NOT NULL,
+			code VARCHAR(255) NOT NULL,
+			active BOOL NOT NULL DEFAULT TRUE,
+			customer_id INT,
+			max_redemptions INT NOT NULL DEFAULT 0,
+			times_redeemed INT NOT NULL DEFAULT 0,
+			expires_at TIMESTAMPTZ,
+			created_at TIMESTAMPTZ NOT NULL,
+			FOREIGN KEY (coupon_id) REFERENCES {{ .Schema }}.coupon (id) ON DELETE CASCADE,
+			FOREIGN KEY (customer_id) REFERENCES {{ .Schema }}.customer (id) ON DELETE CASCADE,
+			UNIQUE (provider, provider_id)
+		);
+
+		CREATE INDEX promotion_code_code_idx ON {{ .Schema }}.promotion_code (code);
+
+		ALTER TABLE {{ .Schema }}.subscription
+			ADD COLUMN coupon_id INT REFERENCES {{ .Schema }}.coupon (id) ON DELETE SET NULL,
+			ADD COLUMN promotion_code_id INT REFERENCES {{ .Schema }}.promotion_code (id) ON DELETE SET NULL,
+			ADD COLUMN promotion_code_provider_id VARCHAR(255) NOT NULL DEFAULT '',
+			ADD COLUMN discount_start TIMESTAMPTZ,
+			ADD COLUMN discount_end TIMESTAMPTZ;
+
+		CREATE INDEX subscription_coupon_id_idx ON {{ .Schema }}.subscription (coupon_id);`,
+		Down: `ALTER TABLE {{ .Schema }}.subscription
+			DROP COLUMN coupon_id,
+			DROP COLUMN promotion_code_id,
+			DROP COLUMN promotion_code_provider_id,
+			DROP COLUMN discount_start,
+			DROP COLUMN discount_end;
+
+		DROP TABLE {{ .Schema }}.promotion_code;
+		DROP TABLE {{ .Schema }}.coupon;`,
+	},
+	{
+		Name:        "checkout session items",
+		Description: "create checkout_session_item and subscription_item tables and add cancel url, locale, client reference and metadata to checkout sessions",
+		Up: `CREATE TABLE {{ .Schema }}.checkout_session_item (
+			id SERIAL PRIMARY KEY,
+			checkout_session_id INT NOT NULL,
+			price_id INT NOT NULL,
+			quantity INT NOT NULL DEFAULT 1,
+			FOREIGN KEY (checkout_session_id) REFERENCES {{ .Schema }}.checkout_session (id) ON DELETE CASCADE,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE RESTRICT
+		);
+
+		CREATE INDEX checkout_session_item_checkout_session_id_idx ON {{ .Schema }}.checkout_session_item (checkout_session_id);
+
+		INSERT INTO {{ .Schema }}.checkout_session_item (checkout_session_id, price_id, quantity)
+			SELECT id, price_id, 1 FROM {{ .Schema }}.checkout_session;
+
+		ALTER TABLE {{ .Schema }}.checkout_session
+			ADD COLUMN cancel_url TEXT NOT NULL DEFAULT '',
+			ADD COLUMN locale VARCHAR(16) NOT NULL DEFAULT '',
+			ADD COLUMN client_reference_id VARCHAR(255) NOT NULL DEFAULT '',
+			ADD COLUMN metadata JSONB;
+
+		CREATE INDEX checkout_session_client_reference_id_idx ON {{ .Schema }}.checkout_session (client_reference_id);
+
+		CREATE TABLE {{ .Schema }}.subscription_item (
+			id SERIAL PRIMARY KEY,
+			subscription_id INT NOT NULL,
+			provider_id VARCHAR(255) NOT NULL,
+			price_id INT NOT NULL,
+			quantity INT NOT NULL DEFAULT 0,
+			FOREIGN KEY (subscription_id) REFERENCES {{ .Schema }}.subscription (id) ON DELETE CASCADE,
+			FOREIGN KEY (price_id) REFERENCES {{ .Schema }}.price (id) ON DELETE RESTRICT,
+			UNIQUE (subscription_id, provider_id)
+		);`,
+		Down: `DROP TABLE {{ .Schema }}.subscription_item;
+
+		ALTER TABLE {{ .Schema }}.checkout_session
+			DROP COLUMN cancel_url,
+			DROP COLUMN locale,
+			DROP COLUMN client_reference_id,
+			DROP COLUMN metadata;
+
+		DROP TABLE {{ .Schema }}.checkout_session_item;`,
+	},
+	{
+		Name:        "soft deletes",
+		Description: "add deleted_at to customers, plans and prices which are kept once deleted at the provider as subscriptions, purchases and checkout sessions reference them",
+		Up: `ALTER TABLE {{ .Schema }}.customer ADD COLUMN deleted_at TIMESTAMPTZ;
+		ALTER TABLE {{ .Schema }}.plan ADD COLUMN deleted_at TIMESTAMPTZ;
+		ALTER TABLE {{ .Schema }}.price ADD COLUMN deleted_at TIMESTAMPTZ;`,
+		Down: `ALTER TABLE {{ .Schema }}.customer DROP COLUMN deleted_at;
+		ALTER TABLE {{ .Schema }}.plan DROP COLUMN deleted_at;
+		ALTER TABLE {{ .Schema }}.price DROP COLUMN deleted_at;`,
+	},
 }
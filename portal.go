@@ -0,0 +1,212 @@
+package pay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/billingportal/configuration"
+	"github.com/stripe/stripe-go/v74/billingportal/session"
+)
+
+// PortalConfig determines what customers can do in the billing portal
+type PortalConfig struct {
+	Headline          string
+	PrivacyPolicyURL  string
+	TermsOfServiceURL string
+	DefaultReturnURL  string // used when a session is created without a return url
+
+	UpdateCustomer      bool // customers can change their email, address and phone number
+	UpdatePaymentMethod bool
+	InvoiceHistory      bool
+	CancelSubscription  bool
+	CancelAtPeriodEnd   bool // canceled subscriptions run until the end of the period, otherwise they end immediately
+	PauseSubscription   bool
+
+	// SwitchablePriceIDs are the recurring prices customers can move their subscription between.
+	// Switching is disabled when empty
+	SwitchablePriceIDs []int64
+	Proration          ProrationMode // how switching and canceling is prorated, ProrationCreate when empty
+}
+
+// NewPortalConfig returns a config that lets customers manage their details, payment method and invoices,
+// cancel at the end of the period and switch between the active recurring prices of the active plans
+func (s *StripeProvider) NewPortalConfig(ctx context.Context) (*PortalConfig, error) {
+	plans, err := s.ListActivePlansContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := PortalConfig{
+		UpdateCustomer:      true,
+		UpdatePaymentMethod: true,
+		InvoiceHistory:      true,
+		CancelSubscription:  true,
+		CancelAtPeriodEnd:   true,
+	}
+
+	for _, pl := range plans {
+		if pl.Provider != ProviderStripe {
+			continue
+		}
+
+		prices, err := s.ListPricesByPlanIDContext(ctx, pl.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pr := range prices {
+			if pr.IsRecurring() {
+				cfg.SwitchablePriceIDs = append(cfg.SwitchablePriceIDs, pr.ID)
+			}
+		}
+	}
+
+	return &cfg, nil
+}
+
+// AddPortalConfig creates the billing portal configuration in stripe returning its id.
+// Set StripeConfig.PortalConfigID to the id for PortalSession to use it
+func (s *StripeProvider) AddPortalConfig(ctx context.Context, cfg *PortalConfig) (string, error) {
+	proration := prorationMode(cfg.Proration)
+
+	cancelMode := "immediately"
+	if cfg.CancelAtPeriodEnd {
+		cancelMode = "at_period_end"
+	}
+
+	params := &stripe.BillingPortalConfigurationParams{
+		Params: stripe.Params{Context: ctx},
+		BusinessProfile: &stripe.BillingPortalConfigurationBusinessProfileParams{
+			Headline:          optionalString(cfg.Headline),
+			PrivacyPolicyURL:  optionalString(cfg.PrivacyPolicyURL),
+			TermsOfServiceURL: optionalString(cfg.TermsOfServiceURL),
+		},
+		DefaultReturnURL: optionalString(cfg.DefaultReturnURL),
+		Features: &stripe.BillingPortalConfigurationFeaturesParams{
+			CustomerUpdate: &stripe.BillingPortalConfigurationFeaturesCustomerUpdateParams{
+				Enabled:        stripe.Bool(cfg.UpdateCustomer),
+				AllowedUpdates: stripe.StringSlice([]string{"email", "address", "phone"}),
+			},
+			PaymentMethodUpdate: &stripe.BillingPortalConfigurationFeaturesPaymentMethodUpdateParams{
+				Enabled: stripe.Bool(cfg.UpdatePaymentMethod),
+			},
+			InvoiceHistory: &stripe.BillingPortalConfigurationFeaturesInvoiceHistoryParams{
+				Enabled: stripe.Bool(cfg.InvoiceHistory),
+			},
+			SubscriptionCancel: &stripe.BillingPortalConfigurationFeaturesSubscriptionCancelParams{
+				Enabled:           stripe.Bool(cfg.CancelSubscription),
+				Mode:              stripe.String(cancelMode),
+				ProrationBehavior: stripe.String(proration),
+			},
+			SubscriptionPause: &stripe.BillingPortalConfigurationFeaturesSubscriptionPauseParams{
+				Enabled: stripe.Bool(cfg.PauseSubscription),
+			},
+		},
+	}
+
+	if !cfg.UpdateCustomer {
+		params.Features.CustomerUpdate.AllowedUpdates = nil
+	}
+
+	products, err := s.portalProducts(ctx, cfg.SwitchablePriceIDs)
+	if err != nil {
+		return "", err
+	}
+
+	update := &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateParams{
+		Enabled: stripe.Bool(len(products) > 0),
+	}
+
+	if len(products) > 0 {
+		update.Products = products
+		update.DefaultAllowedUpdates = stripe.StringSlice([]string{"price"})
+		update.ProrationBehavior = stripe.String(proration)
+	}
+
+	params.Features.SubscriptionUpdate = update
+
+	c, err := configuration.New(params)
+	if err != nil {
+		return "", err
+	}
+
+	return c.ID, nil
+}
+
+// PortalSession returns the url of a billing portal session for the customer.
+// The customer is sent back to returnURL when leaving the portal
+func (s *StripeProvider) PortalSession(ctx context.Context, customerID int64, returnURL string) (url string, err error) {
+	cust, err := s.GetCustomerByIDContext(ctx, customerID)
+	if err != nil {
+		return "", err
+	}
+
+	if cust.Provider != ProviderStripe {
+		return "", ErrProviderMismatch
+	}
+
+	sess, err := session.New(&stripe.BillingPortalSessionParams{
+		Params:        stripe.Params{Context: ctx},
+		Customer:      stripe.String(cust.ProviderID),
+		ReturnURL:     optionalString(returnURL),
+		Configuration: optionalString(s.config.PortalConfigID),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return sess.URL, nil
+}
+
+// portalProducts groups the prices by the product they belong to as stripe expects them
+func (s *StripeProvider) portalProducts(ctx context.Context, priceIDs []int64) ([]*stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams, error) {
+	var (
+		products []*stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams
+		byPlan   = make(map[int64]*stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams)
+	)
+
+	for _, id := range priceIDs {
+		pr, err := s.GetPriceByIDContext(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("price %d: %w", id, err)
+		}
+
+		if pr.Provider != ProviderStripe {
+			return nil, ErrProviderMismatch
+		}
+
+		if !pr.IsRecurring() {
+			return nil, ErrPriceNotRecurring
+		}
+
+		p, ok := byPlan[pr.PlanID]
+		if !ok {
+			pl, err := s.GetPlanByIDContext(ctx, pr.PlanID)
+			if err != nil {
+				return nil, fmt.Errorf("plan %d: %w", pr.PlanID, err)
+			}
+
+			p = &stripe.BillingPortalConfigurationFeaturesSubscriptionUpdateProductParams{
+				Product: stripe.String(pl.ProviderID),
+			}
+
+			byPlan[pr.PlanID] = p
+			products = append(products, p)
+		}
+
+		p.Prices = append(p.Prices, stripe.String(pr.ProviderID))
+	}
+
+	return products, nil
+}
+
+// optionalString returns nil for empty strings so that the param is left out of the request
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+
+	return stripe.String(s)
+}
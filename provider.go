@@ -0,0 +1,119 @@
+package pay
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provider is implemented by payment providers such as stripe.
+// Catalog and customer methods issue requests to the provider, the resulting changes are stored in the Repo
+// once the provider notifies the Webhook or a Sync is performed.
+type Provider interface {
+	// Name of the provider. Entities created by this provider have their Provider field set to this value
+	Name() string
+
+	AddPlanContext(ctx context.Context, p *Plan) error
+	UpdatePlanContext(ctx context.Context, p *Plan) error
+	RemovePlanByProviderIDContext(ctx context.Context, providerID string) error
+	AddPriceContext(ctx context.Context, p *Price) error
+
+	// AddCoupon and AddPromotionCode store the discount right away so that it can be used in checkout requests
+	AddCoupon(ctx context.Context, c *Coupon) error
+	AddPromotionCode(ctx context.Context, pc *PromotionCode) error
+
+	AddCustomerContext(ctx context.Context, c *Customer) error
+	UpdateCustomerContext(ctx context.Context, c *Customer) error
+	RemoveCustomerByProviderIDContext(ctx context.Context, providerID string) error
+
+	CheckoutContext(ctx context.Context, request *CheckoutRequest) (url string, err error)
+	VerifyCheckoutContext(ctx context.Context, sessionID string) error
+
+	// CancelSubscription ends the subscription now or, when atPeriodEnd is set, once the current period is over
+	CancelSubscription(ctx context.Context, subID int64, atPeriodEnd bool) error
+	PauseSubscription(ctx context.Context, subID int64) error
+	// ResumeSubscription resumes payment collection and withdraws a cancellation scheduled for the end of the period
+	ResumeSubscription(ctx context.Context, subID int64) error
+
+	// ChangeSubscriptionPrice moves the subscription to another recurring price such as when upgrading to a better plan.
+	// The proration is calculated at prorationDate, pass the ProrationDate of a preview to charge what it showed. Zero means now
+	ChangeSubscriptionPrice(ctx context.Context, subID, priceID int64, mode ProrationMode, prorationDate time.Time) error
+	// PreviewSubscriptionPriceChange returns what the customer would be charged if ChangeSubscriptionPrice was called now
+	PreviewSubscriptionPriceChange(ctx context.Context, subID, priceID int64, mode ProrationMode) (*ProrationPreview, error)
+	// SetSeatCount changes the quantity of the subscription, ErrSeatsInUse is returned when its users and pending invites take more than n seats
+	SetSeatCount(ctx context.Context, subID, n int64) error
+
+	// Refund returns amount of the charge to the customer, a zero amount refunds whatever has not been refunded yet.
+	// ErrRefundExceedsCharge is returned when amount is more than what is left
+	Refund(ctx context.Context, chargeID, amount int64, reason RefundReason) (*Refund, error)
+
+	// FlushUsage sends usage stored with RecordUsage to the provider, records that fail are attempted again after a backoff
+	FlushUsage(ctx context.Context) error
+
+	SyncContext(ctx context.Context) error
+	Webhook() http.HandlerFunc
+}
+
+// ProrationMode controls how the time left in the current period is charged for when a subscription changes price
+type ProrationMode = string
+
+const (
+	ProrationCreate        ProrationMode = "create_prorations" // the difference is added to the next invoice, used when no mode is given
+	ProrationAlwaysInvoice ProrationMode = "always_invoice"    // the difference is invoiced immediately
+	ProrationNone          ProrationMode = "none"              // the new price applies from the next period
+)
+
+// ProrationPreview is the outcome of changing the price of a subscription
+type ProrationPreview struct {
+	Amount        int64 // sum of the proration adjustments, negative when the customer is credited
+	AmountDue     int64 // total of the next invoice including the adjustments
+	Currency      string
+	ProrationDate time.Time // time at which the proration was calculated
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// Register makes a provider available by its name.
+// Registering a provider with the same name as an existing one replaces it.
+func Register(p Provider) {
+	if p == nil {
+		panic("pay: Register provider is nil")
+	}
+
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider returns the provider registered under name
+func GetProvider(name string) (Provider, error) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("pay: unknown provider %q", name)
+	}
+
+	return p, nil
+}
+
+// Providers returns a sorted list of the names of registered providers
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -5,6 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/cristosal/orm"
 	"github.com/cristosal/orm/schema"
@@ -16,10 +20,75 @@ const DefaultSchema = "pay"
 var (
 	ErrSubscriptionNotFound  = errors.New("subscription not found")
 	ErrSubscriptionNotActive = errors.New("subscription not active")
+	ErrNoSeatsAvailable      = errors.New("no seats available")
+	ErrSeatsInUse            = errors.New("more seats are in use than requested")
+	ErrLastOwner             = errors.New("subscription must keep an owner")
+	ErrInvalidRole           = errors.New("invalid seat role")
+	ErrChargeNotRefundable   = errors.New("charge has nothing left to refund")
+	ErrRefundExceedsCharge   = errors.New("refund amount exceeds the refundable amount of the charge")
+	ErrPriceNotMetered       = errors.New("price is not metered")
+	ErrPriceNotSubscribed    = errors.New("price is not part of the subscription")
+	ErrInvalidPriceTiers     = errors.New("price tiers must be in order and end with a tier without an upper bound")
+	ErrInvalidCoupon         = errors.New("coupon must take off either a percentage or an amount")
+	ErrInvalidDiscount       = errors.New("discount must have either a coupon or a promotion code")
+	ErrDiscountConflict      = errors.New("discounts can't be combined with allowing promotion codes")
+	ErrCouponNotRedeemable   = errors.New("coupon can no longer be redeemed")
+	ErrEmptyCheckout         = errors.New("checkout must have at least one item")
+	ErrInvalidQuantity       = errors.New("quantity must not be negative")
+	ErrCheckoutItemsMismatch = errors.New("checkout items must share a currency and recurring items a billing interval")
+	ErrCurrencyMismatch      = errors.New("price is in a different currency than the subscription")
 )
 
+// webhookEventLease is how long a claimed webhook event is reserved for the worker processing it
+const webhookEventLease = time.Minute
+
 type Migration = orm.Migration
 
+// RetryPolicy determines when webhook events that failed to be handled, or usage that failed to be flushed, are attempted again
+type RetryPolicy struct {
+	MaxAttempts int           // number of attempts after which a failed event or usage record is no longer retried
+	MinBackoff  time.Duration // delay before the first retry, doubled for each subsequent attempt
+	MaxBackoff  time.Duration // upper bound on the delay between attempts
+}
+
+// DefaultRetryPolicy retries failed events for roughly two days
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 16,
+	MinBackoff:  30 * time.Second,
+	MaxBackoff:  6 * time.Hour,
+}
+
+// withDefaults returns a copy of the policy where backoffs that are not set are taken from DefaultRetryPolicy
+func (p RetryPolicy) withDefaults() *RetryPolicy {
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = DefaultRetryPolicy.MinBackoff
+	}
+
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = max(DefaultRetryPolicy.MaxBackoff, p.MinBackoff)
+	}
+
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+
+	return &p
+}
+
+// backoff returns the delay before the next attempt given the number of attempts made so far
+func (p *RetryPolicy) backoff(attempts int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempts && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	return d
+}
+
 // Repo contains methods for storing entities within an sql database
 type Repo struct {
 	events
@@ -27,6 +96,8 @@ type Repo struct {
 	migrationTable  string
 	schema          string
 	extraMigrations []orm.Migration
+	inviteKey       []byte
+	grace           GracePolicy
 }
 
 // NewEntityRepo is a constructor for *Repo
@@ -34,6 +105,7 @@ func NewEntityRepo(db *sql.DB) *Repo {
 	return &Repo{
 		db:     db,
 		schema: DefaultSchema,
+		grace:  DefaultGracePolicy,
 	}
 }
 
@@ -47,18 +119,29 @@ func (r *Repo) SetSchema(schema string) {
 	r.schema = schema
 }
 
+// SetInviteKey sets the secret used to sign seat invite tokens.
+// Changing the key invalidates the tokens of pending invites
+func (r *Repo) SetInviteKey(key []byte) {
+	r.inviteKey = key
+}
+
 // AddMigrations adds migrations to the execute after the base migrations
 func (r *Repo) AddMigrations(migrations []Migration) {
 	r.extraMigrations = append(r.extraMigrations, migrations...)
 }
 
-// Init creates the required tables and migrations for entities.
-// The call to init is idempotent and can therefore be called many times acheiving the same result.
+// Init uses context.Background, to specify the context use InitContext
 func (r *Repo) Init() error {
+	return r.InitContext(context.Background())
+}
+
+// InitContext creates the required tables and migrations for entities.
+// The call to init is idempotent and can therefore be called many times acheiving the same result.
+func (r *Repo) InitContext(ctx context.Context) error {
 	orm.SetSchema(r.schema)
 	orm.SetMigrationTable(r.migrationTable)
 
-	if err := orm.CreateMigrationTable(r.db); err != nil {
+	if err := orm.CreateMigrationTable(r.conn(ctx)); err != nil {
 		return err
 	}
 
@@ -67,145 +150,323 @@ func (r *Repo) Init() error {
 	m = append(m, migrations...)
 	m = append(m, r.extraMigrations...)
 
-	if err := orm.AddMigrations(r.db, m); err != nil {
+	if err := orm.AddMigrations(r.conn(ctx), m); err != nil {
 		return err
 	}
 
-	return orm.Exec(r.db, fmt.Sprintf("SET search_path = %s;", r.schema))
+	return orm.Exec(r.conn(ctx), fmt.Sprintf("SET search_path = %s;", r.schema))
 }
 
-// GetPriceByID returns the price by a given id
+// GetPriceByID uses context.Background, to specify the context use GetPriceByIDContext
 func (r *Repo) GetPriceByID(priceID int64) (*Price, error) {
+	return r.GetPriceByIDContext(context.Background(), priceID)
+}
+
+// GetPriceByIDContext returns the price by a given id
+func (r *Repo) GetPriceByIDContext(ctx context.Context, priceID int64) (*Price, error) {
 	var p Price
-	if err := orm.Get(r.db, &p, "WHERE id = $1", priceID); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE id = $1", priceID); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPriceTiers(ctx, &p); err != nil {
 		return nil, err
 	}
+
 	return &p, nil
 }
 
-// GetPriceByID returns the price by a given id
+// GetPriceByProvider uses context.Background, to specify the context use GetPriceByProviderContext
 func (r *Repo) GetPriceByProvider(provider, providerID string) (*Price, error) {
+	return r.GetPriceByProviderContext(context.Background(), provider, providerID)
+}
+
+// GetPriceByProviderContext returns the price with the provider id
+func (r *Repo) GetPriceByProviderContext(ctx context.Context, provider, providerID string) (*Price, error) {
 	var p Price
-	if err := orm.Get(r.db, &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadPriceTiers(ctx, &p); err != nil {
 		return nil, err
 	}
+
 	return &p, nil
 }
 
+// ListPriceTiers returns the tiers of the price ordered by their upper bound
+func (r *Repo) ListPriceTiers(ctx context.Context, priceID int64) ([]PriceTier, error) {
+	var tiers []PriceTier
+	if err := orm.List(r.conn(ctx), &tiers, "WHERE price_id = $1 ORDER BY up_to ASC NULLS LAST", priceID); err != nil {
+		return nil, err
+	}
+
+	return tiers, nil
+}
+
+// loadPriceTiers sets the tiers of the tiered prices
+func (r *Repo) loadPriceTiers(ctx context.Context, prices ...*Price) error {
+	for _, p := range prices {
+		if !p.IsTiered() {
+			continue
+		}
+
+		tiers, err := r.ListPriceTiers(ctx, p.ID)
+		if err != nil {
+			return err
+		}
+
+		p.Tiers = tiers
+	}
+
+	return nil
+}
+
 // Destroy removes all tables and relationships
 func (r *Repo) Destroy(ctx context.Context) error {
 	orm.SetSchema(r.schema)
 	orm.SetMigrationTable(r.migrationTable)
-	_, err := orm.RemoveAllMigrations(r.db)
+	_, err := orm.RemoveAllMigrations(r.conn(ctx))
 	return err
 }
 
-// ListAllCustomers returns a list of prices
+// ListAllCustomers uses context.Background, to specify the context use ListAllCustomersContext
 func (r *Repo) ListAllCustomers() ([]Customer, error) {
+	return r.ListAllCustomersContext(context.Background())
+}
+
+// ListAllCustomersContext returns a list of customers, leaving out the ones deleted at the provider
+func (r *Repo) ListAllCustomersContext(ctx context.Context) ([]Customer, error) {
 	var customers []Customer
-	if err := orm.ListAll(r.db, &customers); err != nil {
+	if err := orm.List(r.conn(ctx), &customers, "WHERE deleted_at IS NULL"); err != nil {
 		return nil, err
 	}
 
 	return customers, nil
 }
 
-// ListAllWebhookEvents returns a list of all webhook events
+// ListAllWebhookEvents uses context.Background, to specify the context use ListAllWebhookEventsContext
 func (r *Repo) ListAllWebhookEvents() ([]WebhookEvent, error) {
+	return r.ListAllWebhookEventsContext(context.Background())
+}
+
+// ListAllWebhookEventsContext returns a list of all webhook events
+func (r *Repo) ListAllWebhookEventsContext(ctx context.Context) ([]WebhookEvent, error) {
 	var webhookEvents []WebhookEvent
-	if err := orm.ListAll(r.db, &webhookEvents); err != nil {
+	if err := orm.ListAll(r.conn(ctx), &webhookEvents); err != nil {
 		return nil, err
 	}
 
 	return webhookEvents, nil
 }
 
-// ListAllPrices returns a list of prices
+// ListAllPrices uses context.Background, to specify the context use ListAllPricesContext
 func (r *Repo) ListAllPrices() ([]Price, error) {
+	return r.ListAllPricesContext(context.Background())
+}
+
+// ListAllPricesContext returns a list of prices, leaving out the ones deleted at the provider
+func (r *Repo) ListAllPricesContext(ctx context.Context) ([]Price, error) {
 	var prices []Price
-	if err := orm.ListAll(r.db, &prices); err != nil {
+	if err := orm.List(r.conn(ctx), &prices, "WHERE deleted_at IS NULL"); err != nil {
 		return nil, err
 	}
 
+	for i := range prices {
+		if err := r.loadPriceTiers(ctx, &prices[i]); err != nil {
+			return nil, err
+		}
+	}
+
 	return prices, nil
 }
 
-// ListPrices returns a list of prices
+// ListPricesByPlanID uses context.Background, to specify the context use ListPricesByPlanIDContext
 func (r *Repo) ListPricesByPlanID(planID int64) ([]Price, error) {
+	return r.ListPricesByPlanIDContext(context.Background(), planID)
+}
+
+// ListPricesByPlanIDContext returns the prices of the plan that were not deleted at the provider
+func (r *Repo) ListPricesByPlanIDContext(ctx context.Context, planID int64) ([]Price, error) {
 	var prices []Price
-	if err := orm.List(r.db, &prices, "WHERE plan_id = $1", planID); err != nil {
+	if err := orm.List(r.conn(ctx), &prices, "WHERE plan_id = $1 AND deleted_at IS NULL", planID); err != nil {
 		return nil, err
 	}
 
+	for i := range prices {
+		if err := r.loadPriceTiers(ctx, &prices[i]); err != nil {
+			return nil, err
+		}
+	}
+
 	return prices, nil
 }
 
+// ListAllSubscriptions uses context.Background, to specify the context use ListAllSubscriptionsContext
 func (r *Repo) ListAllSubscriptions() ([]Subscription, error) {
+	return r.ListAllSubscriptionsContext(context.Background())
+}
+
+func (r *Repo) ListAllSubscriptionsContext(ctx context.Context) ([]Subscription, error) {
 	var subs []Subscription
-	if err := orm.ListAll(r.db, &subs); err != nil {
+	if err := orm.ListAll(r.conn(ctx), &subs); err != nil {
 		return nil, err
 	}
 	return subs, nil
 }
 
 // addPrice to plan
-func (r *Repo) addPrice(p *Price) error {
-	if err := orm.Add(r.db, p); err != nil {
+func (r *Repo) addPrice(ctx context.Context, p *Price) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.Add(r.tx(ctx, tx), p); err != nil {
+		return err
+	}
+
+	if err := r.replacePriceTiers(ctx, tx, p); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
+
 	r.priceAdded(p)
 	return nil
 }
 
 // UpdatePriceByProvider
-func (r *Repo) updatePriceByProvider(p *Price) error {
-	var prev *Price
-	_ = orm.Get(r.db, prev, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID)
+func (r *Repo) updatePriceByProvider(ctx context.Context, p *Price) error {
+	var prev Price
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
+		return err
+	}
+
+	if err := r.loadPriceTiers(ctx, &prev); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
 
-	err := orm.Update(r.db, p, "WHERE provider = $1 AND provider_id = $2",
+	p.ID = prev.ID               // the id can't change
+	p.DeletedAt = prev.DeletedAt // ids of deleted prices are not reused, late events don't restore them
+	err = orm.Update(r.tx(ctx, tx), p, "WHERE provider = $1 AND provider_id = $2",
 		p.Provider, p.ProviderID)
 	if err != nil {
 		return err
 	}
 
-	r.priceUpdated(prev, p)
+	if err := r.replacePriceTiers(ctx, tx, p); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	r.priceUpdated(&prev, p)
+	return nil
+}
+
+// replacePriceTiers sets the tiers of the price to the ones it holds
+func (r *Repo) replacePriceTiers(ctx context.Context, tx *sql.Tx, p *Price) error {
+	if err := orm.Remove(r.tx(ctx, tx), &PriceTier{}, "WHERE price_id = $1", p.ID); err != nil {
+		return err
+	}
+
+	for i := range p.Tiers {
+		p.Tiers[i].PriceID = p.ID
+		if err := orm.Add(r.tx(ctx, tx), &p.Tiers[i]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// RemovePrice deletes price from repository
-func (r *Repo) removePriceByProvider(p *Price) error {
-	err := orm.Remove(r.db, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID)
+// savePrice adds the price or updates it when it already exists
+func (r *Repo) savePrice(ctx context.Context, p *Price) error {
+	_, err := r.GetPriceByProviderContext(ctx, p.Provider, p.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addPrice(ctx, p)
+	}
+
 	if err != nil {
 		return err
 	}
 
+	return r.updatePriceByProvider(ctx, p)
+}
+
+// removePriceByProvider marks the price as deleted, the row is kept for the subscriptions and purchases referencing it
+func (r *Repo) removePriceByProvider(ctx context.Context, p *Price) error {
+	if err := orm.Get(r.conn(ctx), p, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
+		return err
+	}
+
+	if p.DeletedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	p.DeletedAt = &now
+	if err := orm.UpdateByID(r.conn(ctx), p); err != nil {
+		return err
+	}
+
 	r.priceRemoved(p)
 	return nil
 }
 
-// GetCustomerByID returns the customer by its id field
+// GetCustomerByID uses context.Background, to specify the context use GetCustomerByIDContext
 func (r *Repo) GetCustomerByID(id int64) (*Customer, error) {
+	return r.GetCustomerByIDContext(context.Background(), id)
+}
+
+// GetCustomerByIDContext returns the customer by its id field
+func (r *Repo) GetCustomerByIDContext(ctx context.Context, id int64) (*Customer, error) {
 	var c Customer
-	if err := orm.Get(r.db, &c, "WHERE id = $1", id); err != nil {
+	if err := orm.Get(r.conn(ctx), &c, "WHERE id = $1", id); err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-// GetCustomerByEmail returns the customer with a given email
+// GetCustomerByEmail uses context.Background, to specify the context use GetCustomerByEmailContext
 func (r *Repo) GetCustomerByEmail(email string) (*Customer, error) {
+	return r.GetCustomerByEmailContext(context.Background(), email)
+}
+
+// GetCustomerByEmailContext returns the customer with a given email
+func (r *Repo) GetCustomerByEmailContext(ctx context.Context, email string) (*Customer, error) {
 	var c Customer
-	if err := orm.Get(r.db, &c, "WHERE email = $1", email); err != nil {
+	if err := orm.Get(r.conn(ctx), &c, "WHERE email = $1 AND deleted_at IS NULL", email); err != nil {
 		return nil, err
 	}
 	return &c, nil
 }
 
-// GetCustomerByProvider returns the customer with provider id.
-// Provider id refers to the id given to the customer by an external provider such as stripe or paypal.
+// GetCustomerByProvider uses context.Background, to specify the context use GetCustomerByProviderContext
 func (r *Repo) GetCustomerByProvider(provider, providerID string) (*Customer, error) {
+	return r.GetCustomerByProviderContext(context.Background(), provider, providerID)
+}
+
+// GetCustomerByProviderContext returns the customer with provider id.
+// Provider id refers to the id given to the customer by an external provider such as stripe or paypal.
+func (r *Repo) GetCustomerByProviderContext(ctx context.Context, provider, providerID string) (*Customer, error) {
 	var c Customer
-	if err := orm.Get(r.db, &c, "WHERE provider_id = $1 AND provider = $2", providerID, provider); err != nil {
+	if err := orm.Get(r.conn(ctx), &c, "WHERE provider_id = $1 AND provider = $2", providerID, provider); err != nil {
 		return nil, err
 	}
 
@@ -213,13 +474,15 @@ func (r *Repo) GetCustomerByProvider(provider, providerID string) (*Customer, er
 }
 
 // UpdateCustomerByProvider updates a given customer by id field
-func (r *Repo) updateCustomerByProvider(c *Customer) error {
+func (r *Repo) updateCustomerByProvider(ctx context.Context, c *Customer) error {
 	var prev Customer
-	if err := orm.Get(r.db, &prev, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
 		return err
 	}
 
-	if err := orm.Update(r.db, c, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+	c.ID = prev.ID               // the id can't change
+	c.DeletedAt = prev.DeletedAt // ids of deleted customers are not reused, late events don't restore them
+	if err := orm.Update(r.conn(ctx), c, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
 		return err
 	}
 
@@ -227,23 +490,43 @@ func (r *Repo) updateCustomerByProvider(c *Customer) error {
 	return nil
 }
 
+// saveCustomer adds the customer or updates it when it already exists
+func (r *Repo) saveCustomer(ctx context.Context, c *Customer) error {
+	_, err := r.GetCustomerByProviderContext(ctx, c.Provider, c.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addCustomer(ctx, c)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateCustomerByProvider(ctx, c)
+}
+
 // AddCustomer inserts a customer into the repository
-func (r *Repo) addCustomer(c *Customer) error {
-	if err := orm.Add(r.db, c); err != nil {
+func (r *Repo) addCustomer(ctx context.Context, c *Customer) error {
+	if err := orm.Add(r.conn(ctx), c); err != nil {
 		return err
 	}
 	r.customerAdded(c)
 	return nil
 }
 
-// RemoveCustomerByProviderID removes customer by given provider
-func (r *Repo) removeCustomerByProvider(provider, providerID string) error {
+// removeCustomerByProvider marks the customer as deleted, the row is kept for the subscriptions, invoices and purchases referencing it
+func (r *Repo) removeCustomerByProvider(ctx context.Context, provider, providerID string) error {
 	var c Customer
-	if err := orm.Get(r.db, &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if err := orm.Get(r.conn(ctx), &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
 		return err
 	}
 
-	if err := orm.Remove(r.db, &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if c.DeletedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	c.DeletedAt = &now
+	if err := orm.UpdateByID(r.conn(ctx), &c); err != nil {
 		return err
 	}
 
@@ -251,20 +534,24 @@ func (r *Repo) removeCustomerByProvider(provider, providerID string) error {
 	return nil
 }
 
-func (r *Repo) removePlanOrphans(provider string, ids []string) error {
-	return removeOrphans[Plan](r.db, provider, ids, r.planRemoved)
+func (r *Repo) removePlanOrphans(ctx context.Context, provider string, ids []string) error {
+	return markOrphansDeleted[Plan](r.conn(ctx), provider, ids, r.planRemoved)
+}
+
+func (r *Repo) removePriceOrphans(ctx context.Context, provider string, ids []string) error {
+	return markOrphansDeleted[Price](r.conn(ctx), provider, ids, r.priceRemoved)
 }
 
-func (r *Repo) removePriceOrphans(provider string, ids []string) error {
-	return removeOrphans[Price](r.db, provider, ids, r.priceRemoved)
+func (r *Repo) removeSubscriptionOrphans(ctx context.Context, provider string, ids []string) error {
+	return removeOrphans[Subscription](r.conn(ctx), provider, ids, r.subRemoved)
 }
 
-func (r *Repo) removeSubscriptionOrphans(provider string, ids []string) error {
-	return removeOrphans[Subscription](r.db, provider, ids, r.subRemoved)
+func (r *Repo) removeCustomerOrphans(ctx context.Context, provider string, ids []string) error {
+	return markOrphansDeleted[Customer](r.conn(ctx), provider, ids, r.customerRemoved)
 }
 
-func (r *Repo) removeCustomerOrphans(provider string, ids []string) error {
-	return removeOrphans[Customer](r.db, provider, ids, r.customerRemoved)
+func (r *Repo) removeInvoiceOrphans(ctx context.Context, provider string, ids []string) error {
+	return removeOrphans[Invoice](r.conn(ctx), provider, ids, r.invoiceRemoved)
 }
 
 func removeOrphans[T any](r orm.QuerierExecuter, provider string, providerIDs []string, cb func(*T)) error {
@@ -304,19 +591,60 @@ func removeOrphans[T any](r orm.QuerierExecuter, provider string, providerIDs []
 	return nil
 }
 
-// Lists all plans
+// markOrphansDeleted sets deleted_at of the entities that are not in providerIDs rather than removing them,
+// so that the rows referencing them are kept
+func markOrphansDeleted[T any](r orm.QuerierExecuter, provider string, providerIDs []string, cb func(*T)) error {
+	if len(providerIDs) == 0 {
+		return nil
+	}
+
+	var (
+		ent     T
+		deleted []T
+		values  []any
+	)
+
+	values = append(values, provider)
+	values = append(values, convertStringsToInterfaces(providerIDs)...)
+	values = append(values, time.Now())
+
+	sql := fmt.Sprintf("UPDATE %s SET deleted_at = $%d WHERE provider = $1 AND deleted_at IS NULL AND provider_id NOT IN (%s) RETURNING %s",
+		orm.TableName(&ent), len(values), schema.ValueList(len(providerIDs), 2), orm.Columns(&ent).List())
+
+	if err := orm.Query(r, &deleted, sql, values...); err != nil {
+		return fmt.Errorf("error marking entities as deleted: %v", err)
+	}
+
+	for i := range deleted {
+		cb(&deleted[i])
+	}
+
+	return nil
+}
+
+// ListPlans uses context.Background, to specify the context use ListPlansContext
 func (r *Repo) ListPlans() ([]Plan, error) {
+	return r.ListPlansContext(context.Background())
+}
+
+// Lists all plans
+func (r *Repo) ListPlansContext(ctx context.Context) ([]Plan, error) {
 	var plans []Plan
-	if err := orm.List(r.db, &plans, "ORDER BY name ASC"); err != nil {
+	if err := orm.List(r.conn(ctx), &plans, "WHERE deleted_at IS NULL ORDER BY name ASC"); err != nil {
 		return nil, err
 	}
 	return plans, nil
 }
 
-// ListActivePlans returns a list of all active plans in alphabetic order
+// ListActivePlans uses context.Background, to specify the context use ListActivePlansContext
 func (r *Repo) ListActivePlans() ([]Plan, error) {
+	return r.ListActivePlansContext(context.Background())
+}
+
+// ListActivePlansContext returns a list of all active plans in alphabetic order
+func (r *Repo) ListActivePlansContext(ctx context.Context) ([]Plan, error) {
 	var plans []Plan
-	if err := orm.List(r.db, &plans, "WHERE active = TRUE ORDER BY name ASC"); err != nil {
+	if err := orm.List(r.conn(ctx), &plans, "WHERE active = TRUE AND deleted_at IS NULL ORDER BY name ASC"); err != nil {
 		return nil, err
 	}
 
@@ -324,8 +652,8 @@ func (r *Repo) ListActivePlans() ([]Plan, error) {
 }
 
 // AddPlan adds a plan to the repository
-func (r *Repo) addPlan(p *Plan) error {
-	if err := orm.Add(r.db, p); err != nil {
+func (r *Repo) addPlan(ctx context.Context, p *Plan) error {
+	if err := orm.Add(r.conn(ctx), p); err != nil {
 		return err
 	}
 
@@ -334,26 +662,36 @@ func (r *Repo) addPlan(p *Plan) error {
 }
 
 // RemovePlanByProviderID deletes a plan by provider id from the repository
-func (r *Repo) removePlanByProvider(provider, providerID string) error {
+func (r *Repo) removePlanByProvider(ctx context.Context, provider, providerID string) error {
 	var p Plan
-	if err := orm.Get(r.db, &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
 		return err
 	}
-	if err := orm.Remove(r.db, &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+
+	if p.DeletedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	p.DeletedAt = &now
+	if err := orm.UpdateByID(r.conn(ctx), &p); err != nil {
 		return err
 	}
+
 	r.planRemoved(&p)
 	return nil
 }
 
 // UpdatePlanByProvider updates the plan matching the provider and provider id
-func (r *Repo) updatePlanByProvider(p *Plan) error {
+func (r *Repo) updatePlanByProvider(ctx context.Context, p *Plan) error {
 	var prev Plan
-	if err := orm.Get(r.db, &prev, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
 		return err
 	}
 
-	if err := orm.Update(r.db, p, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
+	p.ID = prev.ID               // the id can't change
+	p.DeletedAt = prev.DeletedAt // ids of deleted plans are not reused, late events don't restore them
+	if err := orm.Update(r.conn(ctx), p, "WHERE provider = $1 AND provider_id = $2", p.Provider, p.ProviderID); err != nil {
 		return err
 	}
 
@@ -361,89 +699,190 @@ func (r *Repo) updatePlanByProvider(p *Plan) error {
 	return nil
 }
 
-// GetPlanByID returns the plan matching the internal id
+// savePlan adds the plan or updates it when it already exists
+func (r *Repo) savePlan(ctx context.Context, p *Plan) error {
+	_, err := r.GetPlanByProviderIDContext(ctx, p.Provider, p.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addPlan(ctx, p)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updatePlanByProvider(ctx, p)
+}
+
+// GetPlanByID uses context.Background, to specify the context use GetPlanByIDContext
 func (r *Repo) GetPlanByID(id int64) (*Plan, error) {
+	return r.GetPlanByIDContext(context.Background(), id)
+}
+
+// GetPlanByIDContext returns the plan matching the internal id
+func (r *Repo) GetPlanByIDContext(ctx context.Context, id int64) (*Plan, error) {
 	var p Plan
-	if err := orm.Get(r.db, &p, "WHERE id = $1", id); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE id = $1", id); err != nil {
 		return nil, err
 	}
 	return &p, nil
 }
 
-// GetPlanByProvider returns the plan which matches provider and provider id
+// GetPlanByProviderID uses context.Background, to specify the context use GetPlanByProviderIDContext
 func (r *Repo) GetPlanByProviderID(provider, providerID string) (*Plan, error) {
+	return r.GetPlanByProviderIDContext(context.Background(), provider, providerID)
+}
+
+// GetPlanByProviderIDContext returns the plan which matches provider and provider id
+func (r *Repo) GetPlanByProviderIDContext(ctx context.Context, provider, providerID string) (*Plan, error) {
 	var p Plan
 
-	if err := orm.Get(r.db, &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
 		return nil, err
 	}
 
 	return &p, nil
 }
 
-// GetPlanByName returns the plan with given name
+// GetPlanByName uses context.Background, to specify the context use GetPlanByNameContext
 func (r *Repo) GetPlanByName(name string) (*Plan, error) {
+	return r.GetPlanByNameContext(context.Background(), name)
+}
+
+// GetPlanByNameContext returns the plan with given name
+func (r *Repo) GetPlanByNameContext(ctx context.Context, name string) (*Plan, error) {
 	var p Plan
-	if err := orm.Get(r.db, &p, "WHERE name = $1", name); err != nil {
+	if err := orm.Get(r.conn(ctx), &p, "WHERE name = $1 AND deleted_at IS NULL", name); err != nil {
 		return nil, err
 	}
 	return &p, nil
 }
 
-func (r *Repo) addSubscription(s *Subscription) error {
+func (r *Repo) addSubscription(ctx context.Context, s *Subscription) error {
 	// get customer as we will be adding a user with same email
-	cust, err := r.GetCustomerByID(s.CustomerID)
+	cust, err := r.GetCustomerByIDContext(ctx, s.CustomerID)
 	if err != nil {
 		return err
 	}
 
-	tx, err := r.db.Begin()
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
 	defer tx.Rollback()
 
-	if err := orm.Add(tx, s); err != nil {
+	if err := orm.Add(r.tx(ctx, tx), s); err != nil {
 		return err
 	}
 
-	if err := orm.Add(tx, &SubscriptionUser{
+	if err := orm.Add(r.tx(ctx, tx), &SubscriptionUser{
 		SubscriptionID: s.ID,
 		Username:       cust.Email,
+		Role:           SeatOwner,
 	}); err != nil {
 		return err
 	}
 
+	if err := r.addSubscriptionItems(ctx, tx, s); err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
 
 	r.subAdded(s)
-	return nil
+	return r.subscriptionSaved(ctx, nil, s)
 }
 
-func (r *Repo) updateSubscriptionByProvider(s *Subscription) error {
+func (r *Repo) updateSubscriptionByProvider(ctx context.Context, s *Subscription) error {
 	var prev Subscription
-	if err := orm.Get(r.db, &prev, "WHERE provider = $1 AND provider_id = $2", s.Provider, s.ProviderID); err != nil {
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", s.Provider, s.ProviderID); err != nil {
 		return err
 	}
 
 	s.ID = prev.ID // the id can't change
-	if err := orm.UpdateByID(r.db, s); err != nil {
+
+	// events handled out of order must not overwrite newer state with an older snapshot
+	if s.SnapshotAt == nil {
+		s.SnapshotAt = prev.SnapshotAt
+	} else if prev.SnapshotAt != nil && s.SnapshotAt.Before(*prev.SnapshotAt) {
+		log.Printf("ignoring snapshot of subscription %s from %s, stored state is from %s", s.ProviderID, s.SnapshotAt, prev.SnapshotAt)
+		return nil
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.UpdateByID(r.tx(ctx, tx), s); err != nil {
+		return err
+	}
+
+	// the items stored are kept when the update doesn't know about them
+	if s.Items != nil {
+		sql := fmt.Sprintf("DELETE FROM %s WHERE subscription_id = $1", orm.TableName(&SubscriptionItem{}))
+		if err := orm.Exec(r.tx(ctx, tx), sql, s.ID); err != nil {
+			return err
+		}
+
+		if err := r.addSubscriptionItems(ctx, tx, s); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
 	r.subUpdated(&prev, s)
+	return r.subscriptionSaved(ctx, &prev, s)
+}
+
+// saveSubscription adds the subscription or updates it when it already exists
+func (r *Repo) saveSubscription(ctx context.Context, s *Subscription) error {
+	_, err := r.GetSubscriptionByProviderContext(ctx, s.Provider, s.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addSubscription(ctx, s)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateSubscriptionByProvider(ctx, s)
+}
+
+func (r *Repo) addSubscriptionItems(ctx context.Context, tx *sql.Tx, s *Subscription) error {
+	for i := range s.Items {
+		s.Items[i].SubscriptionID = s.ID
+		if err := orm.Add(r.tx(ctx, tx), &s.Items[i]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (r *Repo) removeSubscriptionByProvider(s *Subscription) error {
+// ListSubscriptionItems returns the items of the subscription in the order they were received
+func (r *Repo) ListSubscriptionItems(ctx context.Context, subID int64) ([]SubscriptionItem, error) {
+	var items []SubscriptionItem
+	if err := orm.List(r.conn(ctx), &items, "WHERE subscription_id = $1 ORDER BY id ASC", subID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (r *Repo) removeSubscriptionByProvider(ctx context.Context, s *Subscription) error {
 	table := s.TableName()
 	cols := orm.Columns(s).List()
 	sql := fmt.Sprintf("DELETE FROM %s WHERE provider = $1 AND provider_id = $2 RETURNING %s", table, cols)
 
-	if err := orm.QueryRow(r.db, s, sql, s.Provider, s.ProviderID); err != nil {
+	if err := orm.QueryRow(r.conn(ctx), s, sql, s.Provider, s.ProviderID); err != nil {
 		return err
 	}
 
@@ -451,16 +890,52 @@ func (r *Repo) removeSubscriptionByProvider(s *Subscription) error {
 	return nil
 }
 
+// ListSubscriptionsByCustomerID uses context.Background, to specify the context use ListSubscriptionsByCustomerIDContext
 func (r *Repo) ListSubscriptionsByCustomerID(customerID int64) ([]Subscription, error) {
+	return r.ListSubscriptionsByCustomerIDContext(context.Background(), customerID)
+}
+
+func (r *Repo) ListSubscriptionsByCustomerIDContext(ctx context.Context, customerID int64) ([]Subscription, error) {
+	var s []Subscription
+	if err := orm.List(r.conn(ctx), &s, "WHERE customer_id = $1", customerID); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListSubscriptionsByStatus returns the subscriptions in any of the given statuses
+func (r *Repo) ListSubscriptionsByStatus(ctx context.Context, statuses ...SubscriptionStatus) ([]Subscription, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+
+	sql := fmt.Sprintf("WHERE status IN (%s) ORDER BY id ASC", schema.ValueList(len(statuses), 1))
+
+	var s []Subscription
+	if err := orm.List(r.conn(ctx), &s, sql, convertStringsToInterfaces(statuses)...); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListTrialsEndingBefore returns the subscriptions still in their trial period whose trial ends before t
+func (r *Repo) ListTrialsEndingBefore(ctx context.Context, t time.Time) ([]Subscription, error) {
 	var s []Subscription
-	if err := orm.List(r.db, &s, "WHERE customer_id = $1", customerID); err != nil {
+	if err := orm.List(r.conn(ctx), &s, "WHERE status = $1 AND trial_end <= $2 ORDER BY trial_end ASC", SubscriptionTrialing, t); err != nil {
 		return nil, err
 	}
 
 	return s, nil
 }
 
+// ListSubscriptionsByPlanID uses context.Background, to specify the context use ListSubscriptionsByPlanIDContext
 func (r *Repo) ListSubscriptionsByPlanID(planID int64) ([]Subscription, error) {
+	return r.ListSubscriptionsByPlanIDContext(context.Background(), planID)
+}
+
+func (r *Repo) ListSubscriptionsByPlanIDContext(ctx context.Context, planID int64) ([]Subscription, error) {
 	var (
 		subs []Subscription
 		pr   Price
@@ -475,46 +950,233 @@ func (r *Repo) ListSubscriptionsByPlanID(planID int64) ([]Subscription, error) {
 		orm.TableName(&pl),
 	)
 
-	if err := orm.Query(r.db, &subs, sql, planID); err != nil {
+	if err := orm.Query(r.conn(ctx), &subs, sql, planID); err != nil {
 		return nil, err
 	}
 
 	return subs, nil
 }
 
+// GetSubscriptionByID uses context.Background, to specify the context use GetSubscriptionByIDContext
 func (r *Repo) GetSubscriptionByID(id int64) (*Subscription, error) {
+	return r.GetSubscriptionByIDContext(context.Background(), id)
+}
+
+func (r *Repo) GetSubscriptionByIDContext(ctx context.Context, id int64) (*Subscription, error) {
 	var s Subscription
 	s.ID = id
-	if err := orm.GetByID(r.db, &s); err != nil {
+	if err := orm.GetByID(r.conn(ctx), &s); err != nil {
 		return nil, err
 	}
 
 	return &s, nil
 }
 
+// GetSubscriptionByProvider uses context.Background, to specify the context use GetSubscriptionByProviderContext
 func (r *Repo) GetSubscriptionByProvider(provider, providerID string) (*Subscription, error) {
+	return r.GetSubscriptionByProviderContext(context.Background(), provider, providerID)
+}
+
+func (r *Repo) GetSubscriptionByProviderContext(ctx context.Context, provider, providerID string) (*Subscription, error) {
 	var s Subscription
-	if err := orm.Get(r.db, &s, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+	if err := orm.Get(r.conn(ctx), &s, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
 		return nil, err
 	}
 
 	return &s, nil
 }
 
-func (r *Repo) hasWebhookEvent(provider, providerID string) bool {
+// addWebhookEvent stores the event as pending so that it is picked up by processWebhookEvents.
+// It returns false without storing the event when an event with the same provider id was already received
+func (r *Repo) addWebhookEvent(ctx context.Context, e *WebhookEvent) (bool, error) {
+	now := time.Now()
+	e.Status = WebhookEventPending
+	e.CreatedAt = now
+	e.NextAttemptAt = &now
+
+	query := fmt.Sprintf(`INSERT INTO %s (provider, provider_id, event_type, payload, status, attempts, last_error, next_attempt_at, occurred_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (provider, provider_id) DO NOTHING RETURNING id`, e.TableName())
+
+	err := r.conn(ctx).QueryRow(query, e.Provider, e.ProviderID, e.EventType, e.Payload, e.Status, e.Attempts, e.LastError, e.NextAttemptAt, e.OccurredAt, e.CreatedAt).Scan(&e.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetWebhookEventByID returns the webhook event with the given id
+func (r *Repo) GetWebhookEventByID(ctx context.Context, id int64) (*WebhookEvent, error) {
 	var e WebhookEvent
-	if err := orm.Get(r.db, &e, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
-		return false
+	if err := orm.Get(r.conn(ctx), &e, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// ListWebhookEventsByStatus returns the webhook events with given status in the order they were received
+func (r *Repo) ListWebhookEventsByStatus(ctx context.Context, status WebhookEventStatus) ([]WebhookEvent, error) {
+	var events []WebhookEvent
+	if err := orm.List(r.conn(ctx), &events, "WHERE status = $1 ORDER BY id ASC", status); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// WebhookEventFilter narrows down the webhook events returned by ListWebhookEvents.
+// Zero values are ignored.
+type WebhookEventFilter struct {
+	Provider   string
+	EventTypes []string
+	Status     WebhookEventStatus
+	Since      time.Time // received at or after
+	Until      time.Time // received before
+}
+
+// ListWebhookEvents returns the webhook events matching the filter in the order they were received
+func (r *Repo) ListWebhookEvents(ctx context.Context, filter *WebhookEventFilter) ([]WebhookEvent, error) {
+	if filter == nil {
+		filter = new(WebhookEventFilter)
+	}
+
+	var (
+		conds []string
+		args  []any
+	)
+
+	cond := func(format string, vals ...any) {
+		conds = append(conds, fmt.Sprintf(format, schema.ValueList(len(vals), len(args)+1)))
+		args = append(args, vals...)
+	}
+
+	if filter.Provider != "" {
+		cond("provider = %s", filter.Provider)
+	}
+
+	if len(filter.EventTypes) > 0 {
+		cond("event_type IN (%s)", convertStringsToInterfaces(filter.EventTypes)...)
+	}
+
+	if filter.Status != "" {
+		cond("status = %s", filter.Status)
+	}
+
+	if !filter.Since.IsZero() {
+		cond("created_at >= %s", filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		cond("created_at < %s", filter.Until)
+	}
+
+	sql := "ORDER BY id ASC"
+	if len(conds) > 0 {
+		sql = fmt.Sprintf("WHERE %s %s", strings.Join(conds, " AND "), sql)
+	}
+
+	var events []WebhookEvent
+	if err := orm.List(r.conn(ctx), &events, sql, args...); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// processWebhookEvents calls handle for each event of the provider that is due, in the order they were received.
+// Events that fail are retried according to the policy.
+func (r *Repo) processWebhookEvents(ctx context.Context, provider string, policy *RetryPolicy, handle func(context.Context, *WebhookEvent) error) error {
+	const batchSize = 100
+
+	for {
+		var events []WebhookEvent
+		err := orm.List(r.conn(ctx), &events, "WHERE provider = $1 AND status <> $2 AND next_attempt_at <= $3 ORDER BY id ASC LIMIT $4",
+			provider, WebhookEventProcessed, time.Now(), batchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range events {
+			e := &events[i]
+
+			claimed, err := r.claimWebhookEvent(ctx, e, time.Now().Add(webhookEventLease))
+			if err != nil {
+				return err
+			}
+
+			// another worker is processing the event
+			if !claimed {
+				continue
+			}
+
+			if err := r.completeWebhookEvent(ctx, e, handle(ctx, e), policy); err != nil {
+				return err
+			}
+		}
+
+		if len(events) < batchSize {
+			return nil
+		}
+	}
+}
+
+// claimWebhookEvent postpones the next attempt of a due event until the lease expires.
+// It returns false when the event is no longer due because it was claimed by another worker.
+func (r *Repo) claimWebhookEvent(ctx context.Context, e *WebhookEvent, lease time.Time) (bool, error) {
+	sql := fmt.Sprintf("UPDATE %s SET next_attempt_at = $1 WHERE id = $2 AND status <> $3 AND next_attempt_at <= $4",
+		e.TableName())
+
+	res, err := r.conn(ctx).Exec(sql, lease, e.ID, WebhookEventProcessed, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
 	}
 
-	return e.Provider == provider && e.ProviderID == providerID
+	return n == 1, nil
 }
 
-func (r *Repo) addWebhookEvent(e *WebhookEvent) error {
-	return orm.Add(r.db, e)
+// completeWebhookEvent records the outcome of an attempt to handle the event, scheduling a retry on failure
+func (r *Repo) completeWebhookEvent(ctx context.Context, e *WebhookEvent, handleErr error, policy *RetryPolicy) error {
+	now := time.Now()
+	e.Attempts++
+
+	if handleErr == nil {
+		e.Status = WebhookEventProcessed
+		e.LastError = ""
+		e.NextAttemptAt = nil
+		e.ProcessedAt = &now
+		return orm.UpdateByID(r.conn(ctx), e)
+	}
+
+	log.Printf("error handling %s event %s (attempt %d): %v", e.Provider, e.EventType, e.Attempts, handleErr)
+
+	e.Status = WebhookEventFailed
+	e.LastError = handleErr.Error()
+	e.NextAttemptAt = nil
+
+	if e.Attempts < policy.MaxAttempts {
+		next := now.Add(policy.backoff(e.Attempts))
+		e.NextAttemptAt = &next
+	}
+
+	return orm.UpdateByID(r.conn(ctx), e)
 }
 
+// GetPlanByPriceID uses context.Background, to specify the context use GetPlanByPriceIDContext
 func (r *Repo) GetPlanByPriceID(priceID int64) (*Plan, error) {
+	return r.GetPlanByPriceIDContext(context.Background(), priceID)
+}
+
+func (r *Repo) GetPlanByPriceIDContext(ctx context.Context, priceID int64) (*Plan, error) {
 	var p Plan
 
 	sql := fmt.Sprintf("SELECT %s FROM %s p INNER JOIN %s pr ON pr.plan_id = p.id where pr.id = $1",
@@ -523,14 +1185,19 @@ func (r *Repo) GetPlanByPriceID(priceID int64) (*Plan, error) {
 		orm.TableName(&Price{}),
 	)
 
-	if err := orm.QueryRow(r.db, &p, sql, priceID); err != nil {
+	if err := orm.QueryRow(r.conn(ctx), &p, sql, priceID); err != nil {
 		return nil, err
 	}
 
 	return &p, nil
 }
 
+// GetPlanBySubscriptionID uses context.Background, to specify the context use GetPlanBySubscriptionIDContext
 func (r *Repo) GetPlanBySubscriptionID(subID int64) (*Plan, error) {
+	return r.GetPlanBySubscriptionIDContext(context.Background(), subID)
+}
+
+func (r *Repo) GetPlanBySubscriptionIDContext(ctx context.Context, subID int64) (*Plan, error) {
 	if subID == 0 {
 		return nil, errors.New("error: zero is not a valid id")
 	}
@@ -544,14 +1211,21 @@ func (r *Repo) GetPlanBySubscriptionID(subID int64) (*Plan, error) {
 		orm.TableName(&Subscription{}),
 	)
 
-	if err := orm.QueryRow(r.db, &p, sql, subID); err != nil {
+	if err := orm.QueryRow(r.conn(ctx), &p, sql, subID); err != nil {
 		return nil, err
 	}
 
 	return &p, nil
 }
 
+// GetPlansByUsername uses context.Background, to specify the context use GetPlansByUsernameContext
 func (r *Repo) GetPlansByUsername(username string) (plans []Plan, err error) {
+	return r.GetPlansByUsernameContext(context.Background(), username)
+}
+
+// GetPlansByUsernameContext returns the plans of the subscriptions the user has a seat in.
+// Only active subscriptions and the ones within the grace period of a failed payment are included
+func (r *Repo) GetPlansByUsernameContext(ctx context.Context, username string) (plans []Plan, err error) {
 	var (
 		s  Subscription
 		su SubscriptionUser
@@ -560,28 +1234,138 @@ func (r *Repo) GetPlansByUsername(username string) (plans []Plan, err error) {
 	)
 
 	sql := fmt.Sprintf(`
-		SELECT %s FROM %s pl 
+		SELECT DISTINCT %s FROM %s pl
 		INNER JOIN %s pr ON pr.plan_id = pl.id
-		INNER JOIN %s s ON s.price_id = pr.id
+		INNER JOIN %s s ON s.price_id = pr.id AND %s
 		INNER JOIN %s su ON su.subscription_id = s.id AND su.username = $1`,
 		orm.Columns(&pl).PrefixedList("pl"),
 		orm.TableName(&pl),
 		orm.TableName(&pr),
 		orm.TableName(&s),
+		r.entitledSQL(),
 		orm.TableName(&su),
 	)
 
-	fmt.Println(sql)
-
-	if err := orm.Query(r.db, &plans, sql, username); err != nil {
+	if err := orm.Query(r.conn(ctx), &plans, sql, username); err != nil {
 		return nil, err
 	}
 
 	return plans, nil
 }
 
-// ListSubscriptionsByUsername returns all subscriptions that have a user with given username
+// Unlimited is returned by GetLimit for features without a limit
+const Unlimited = math.MaxInt64
+
+// ListPlanFeatures returns the features granted by a plan
+func (r *Repo) ListPlanFeatures(ctx context.Context, planID int64) ([]PlanFeature, error) {
+	var features []PlanFeature
+	if err := orm.List(r.conn(ctx), &features, "WHERE plan_id = $1 ORDER BY key ASC", planID); err != nil {
+		return nil, err
+	}
+
+	return features, nil
+}
+
+// SetPlanFeature adds the feature to the plan or replaces the existing feature with the same key
+func (r *Repo) SetPlanFeature(ctx context.Context, f *PlanFeature) error {
+	sql := fmt.Sprintf(`INSERT INTO %s (plan_id, key, enabled, feature_limit) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (plan_id, key) DO UPDATE SET enabled = EXCLUDED.enabled, feature_limit = EXCLUDED.feature_limit
+		RETURNING id`, orm.TableName(f))
+
+	return r.conn(ctx).QueryRow(sql, f.PlanID, f.Key, f.Enabled, f.Limit).Scan(&f.ID)
+}
+
+// RemovePlanFeature removes the feature with the given key from the plan
+func (r *Repo) RemovePlanFeature(ctx context.Context, planID int64, key string) error {
+	return orm.Remove(r.conn(ctx), &PlanFeature{}, "WHERE plan_id = $1 AND key = $2", planID, key)
+}
+
+// replacePlanFeatures sets the features of the plan to exactly the ones given
+func (r *Repo) replacePlanFeatures(ctx context.Context, planID int64, features []PlanFeature) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.Remove(r.tx(ctx, tx), &PlanFeature{}, "WHERE plan_id = $1", planID); err != nil {
+		return err
+	}
+
+	for i := range features {
+		features[i].PlanID = planID
+		if err := orm.Add(r.tx(ctx, tx), &features[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HasFeature reports whether any of the active subscriptions of the user grants the feature
+func (r *Repo) HasFeature(ctx context.Context, username, key string) (bool, error) {
+	var has bool
+	sql := fmt.Sprintf("SELECT EXISTS (SELECT 1 %s)", r.userFeaturesSQL())
+	if err := r.conn(ctx).QueryRow(sql, username, key).Scan(&has); err != nil {
+		return false, err
+	}
+
+	return has, nil
+}
+
+// GetLimit returns the highest limit of the feature across the active subscriptions of the user.
+// Zero is returned when the feature is not granted and Unlimited when any subscription grants it without a limit
+func (r *Repo) GetLimit(ctx context.Context, username, key string) (int64, error) {
+	sql := fmt.Sprintf("SELECT pf.feature_limit %s", r.userFeaturesSQL())
+	rows, err := r.conn(ctx).Query(sql, username, key)
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	var limit int64
+	for rows.Next() {
+		var l *int64
+		if err := rows.Scan(&l); err != nil {
+			return 0, err
+		}
+
+		if l == nil {
+			return Unlimited, nil
+		}
+
+		if *l > limit {
+			limit = *l
+		}
+	}
+
+	return limit, rows.Err()
+}
+
+// userFeaturesSQL selects the enabled features with key $2 granted to username $1 by entitled subscriptions
+func (r *Repo) userFeaturesSQL() string {
+	return fmt.Sprintf(`FROM %s pf
+		INNER JOIN %s pr ON pr.plan_id = pf.plan_id
+		INNER JOIN %s s ON s.price_id = pr.id AND %s
+		INNER JOIN %s su ON su.subscription_id = s.id AND su.username = $1
+		WHERE pf.key = $2 AND pf.enabled`,
+		orm.TableName(&PlanFeature{}),
+		orm.TableName(&Price{}),
+		orm.TableName(&Subscription{}),
+		r.entitledSQL(),
+		orm.TableName(&SubscriptionUser{}),
+	)
+}
+
+// ListSubscriptionsByUsername uses context.Background, to specify the context use ListSubscriptionsByUsernameContext
 func (r *Repo) ListSubscriptionsByUsername(username string) ([]Subscription, error) {
+	return r.ListSubscriptionsByUsernameContext(context.Background(), username)
+}
+
+// ListSubscriptionsByUsernameContext returns all subscriptions that have a user with given username
+func (r *Repo) ListSubscriptionsByUsernameContext(ctx context.Context, username string) ([]Subscription, error) {
 	var (
 		s    Subscription
 		subs []Subscription
@@ -593,7 +1377,7 @@ func (r *Repo) ListSubscriptionsByUsername(username string) ([]Subscription, err
 		)
 	)
 
-	if err := orm.Query(r.db, &subs, sql, username); err != nil {
+	if err := orm.Query(r.conn(ctx), &subs, sql, username); err != nil {
 		if errors.Is(err, orm.ErrNotFound) {
 			return nil, ErrSubscriptionNotFound
 		}
@@ -604,53 +1388,1080 @@ func (r *Repo) ListSubscriptionsByUsername(username string) ([]Subscription, err
 	return subs, nil
 }
 
+// CountSubscriptionUsers uses context.Background, to specify the context use CountSubscriptionUsersContext
 func (r *Repo) CountSubscriptionUsers(subID int64) (int64, error) {
-	return orm.Count(r.db, &SubscriptionUser{}, "WHERE subscription_id = $1", subID)
+	return r.CountSubscriptionUsersContext(context.Background(), subID)
+}
+
+func (r *Repo) CountSubscriptionUsersContext(ctx context.Context, subID int64) (int64, error) {
+	return orm.Count(r.conn(ctx), &SubscriptionUser{}, "WHERE subscription_id = $1", subID)
 }
 
+// AddSubscriptionUser uses context.Background, to specify the context use AddSubscriptionUserContext
 func (r *Repo) AddSubscriptionUser(su *SubscriptionUser) error {
-	var s Subscription
+	return r.AddSubscriptionUserContext(context.Background(), su)
+}
 
-	s.ID = su.SubscriptionID
+// AddSubscriptionUserContext adds the user to the subscription.
+// ErrNoSeatsAvailable is returned when its users and pending invites already take as many seats as its quantity
+func (r *Repo) AddSubscriptionUserContext(ctx context.Context, su *SubscriptionUser) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
 
-	if err := orm.GetByID(r.db, &s); err != nil {
-		if errors.Is(err, orm.ErrNotFound) {
-			return ErrSubscriptionNotFound
-		}
+	defer tx.Rollback()
 
+	s, err := r.addSubscriptionUser(ctx, tx, su, 0)
+	if err != nil {
 		return err
 	}
 
-	if err := orm.Add(r.db, su); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
-	r.seatAdded(&s, su.Username)
+	r.seatAdded(s, su.Username)
 	return nil
 }
 
-func (r *Repo) RemoveSubscriptionUser(su *SubscriptionUser) error {
+// addSubscriptionUser adds the user within tx if a seat is available, returning the subscription.
+// Users are added as members unless a role is given, inviteID is the pending invite being accepted if any
+func (r *Repo) addSubscriptionUser(ctx context.Context, tx *sql.Tx, su *SubscriptionUser, inviteID int64) (*Subscription, error) {
+	if su.Role == "" {
+		su.Role = SeatMember
+	}
+
+	if !validSeatRole(su.Role) {
+		return nil, ErrInvalidRole
+	}
+
+	s, n, err := r.lockSeats(ctx, tx, su.SubscriptionID, inviteID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n >= s.Quantity {
+		return nil, ErrNoSeatsAvailable
+	}
+
+	if err := orm.Add(r.tx(ctx, tx), su); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// lockSubscription selects the subscription for update, serializing changes to its users
+func (r *Repo) lockSubscription(ctx context.Context, tx *sql.Tx, subID int64) (*Subscription, error) {
 	var s Subscription
-	s.ID = su.SubscriptionID
-	if err := orm.GetByID(r.db, &s); err != nil {
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE id = $1 FOR UPDATE", orm.Columns(&s).List(), orm.TableName(&s))
+	if err := orm.QueryRow(r.tx(ctx, tx), &s, sql, subID); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return nil, ErrSubscriptionNotFound
+		}
+
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// CountAvailableSeats returns the number of users that can still be added to the subscription, seats held by pending invites are not available
+func (r *Repo) CountAvailableSeats(ctx context.Context, subID int64) (int64, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	s, n, err := r.lockSeats(ctx, tx, subID, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if n >= s.Quantity {
+		return 0, nil
+	}
+
+	return s.Quantity - n, nil
+}
+
+// RemoveSubscriptionUser uses context.Background, to specify the context use RemoveSubscriptionUserContext
+func (r *Repo) RemoveSubscriptionUser(su *SubscriptionUser) error {
+	return r.RemoveSubscriptionUserContext(context.Background(), su)
+}
+
+// RemoveSubscriptionUserContext removes the user from the subscription.
+// ErrLastOwner is returned when the user is the only owner
+func (r *Repo) RemoveSubscriptionUserContext(ctx context.Context, su *SubscriptionUser) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	s, err := r.lockSubscription(ctx, tx, su.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	prev, err := r.getSubscriptionUser(ctx, tx, su.SubscriptionID, su.Username)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkLastOwner(ctx, tx, prev); err != nil {
+		return err
+	}
+
+	if err := orm.Remove(r.tx(ctx, tx), su, "WHERE subscription_id = $1 and username = $2", su.SubscriptionID, su.Username); err != nil {
 		return err
 	}
 
-	if err := orm.Remove(r.db, su, "WHERE subscription_id = $1 and username = $2", su.SubscriptionID, su.Username); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
-	r.seatRemoved(&s, su.Username)
+	r.seatRemoved(s, su.Username)
 	return nil
 }
 
-// ListUsername returns a list of all usernames attached to subscription
-func (r *Repo) ListUsernames(subID int64) ([]string, error) {
-	sql := fmt.Sprintf("SELECT username from %s WHERE subscription_id = $1", orm.TableName(&SubscriptionUser{}))
-	rows, err := r.db.Query(sql, subID)
-	if err != nil {
+// GetSubscriptionUser returns the user of the subscription along with its role
+func (r *Repo) GetSubscriptionUser(ctx context.Context, subID int64, username string) (*SubscriptionUser, error) {
+	var su SubscriptionUser
+	if err := orm.Get(r.conn(ctx), &su, "WHERE subscription_id = $1 AND username = $2", subID, username); err != nil {
 		return nil, err
 	}
 
-	return orm.CollectStrings(rows)
+	return &su, nil
+}
+
+// ListSubscriptionUsers returns the users of the subscription, owners first
+func (r *Repo) ListSubscriptionUsers(ctx context.Context, subID int64) ([]SubscriptionUser, error) {
+	var users []SubscriptionUser
+	sql := `WHERE subscription_id = $1 ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, username`
+	if err := orm.List(r.conn(ctx), &users, sql, subID); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SetSubscriptionUserRole changes the role of a user of the subscription.
+// ErrLastOwner is returned when demoting the only owner, use TransferSubscriptionOwnership instead
+func (r *Repo) SetSubscriptionUserRole(ctx context.Context, subID int64, username string, role SeatRole) error {
+	if !validSeatRole(role) {
+		return ErrInvalidRole
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := r.lockSubscription(ctx, tx, subID); err != nil {
+		return err
+	}
+
+	su, err := r.getSubscriptionUser(ctx, tx, subID, username)
+	if err != nil {
+		return err
+	}
+
+	if role != SeatOwner {
+		if err := r.checkLastOwner(ctx, tx, su); err != nil {
+			return err
+		}
+	}
+
+	if err := r.setSubscriptionUserRole(ctx, tx, subID, username, role); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// TransferSubscriptionOwnership makes to an owner of the subscription while from becomes an admin.
+// The new owner has to be a user of the subscription already
+func (r *Repo) TransferSubscriptionOwnership(ctx context.Context, subID int64, from, to string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := r.lockSubscription(ctx, tx, subID); err != nil {
+		return err
+	}
+
+	owner, err := r.getSubscriptionUser(ctx, tx, subID, from)
+	if err != nil {
+		return err
+	}
+
+	if owner.Role != SeatOwner {
+		return fmt.Errorf("%s is not an owner of subscription %d", from, subID)
+	}
+
+	if _, err := r.getSubscriptionUser(ctx, tx, subID, to); err != nil {
+		return err
+	}
+
+	if err := r.setSubscriptionUserRole(ctx, tx, subID, to, SeatOwner); err != nil {
+		return err
+	}
+
+	if err := r.setSubscriptionUserRole(ctx, tx, subID, from, SeatAdmin); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *Repo) getSubscriptionUser(ctx context.Context, tx *sql.Tx, subID int64, username string) (*SubscriptionUser, error) {
+	var su SubscriptionUser
+	if err := orm.Get(r.tx(ctx, tx), &su, "WHERE subscription_id = $1 AND username = $2", subID, username); err != nil {
+		return nil, err
+	}
+
+	return &su, nil
+}
+
+func (r *Repo) setSubscriptionUserRole(ctx context.Context, tx *sql.Tx, subID int64, username string, role SeatRole) error {
+	sql := fmt.Sprintf("UPDATE %s SET role = $1 WHERE subscription_id = $2 AND username = $3", orm.TableName(&SubscriptionUser{}))
+	return orm.Exec(r.tx(ctx, tx), sql, role, subID, username)
+}
+
+// checkLastOwner returns ErrLastOwner when su is the only owner of its subscription
+func (r *Repo) checkLastOwner(ctx context.Context, tx *sql.Tx, su *SubscriptionUser) error {
+	if su.Role != SeatOwner {
+		return nil
+	}
+
+	n, err := orm.Count(r.tx(ctx, tx), su, "WHERE subscription_id = $1 AND role = $2", su.SubscriptionID, SeatOwner)
+	if err != nil {
+		return err
+	}
+
+	if n <= 1 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
+
+func validSeatRole(role SeatRole) bool {
+	return role == SeatOwner || role == SeatAdmin || role == SeatMember
+}
+
+// ListUsernames uses context.Background, to specify the context use ListUsernamesContext
+func (r *Repo) ListUsernames(subID int64) ([]string, error) {
+	return r.ListUsernamesContext(context.Background(), subID)
+}
+
+// ListUsernamesContext returns a list of all usernames attached to subscription
+func (r *Repo) ListUsernamesContext(ctx context.Context, subID int64) ([]string, error) {
+	sql := fmt.Sprintf("SELECT username from %s WHERE subscription_id = $1", orm.TableName(&SubscriptionUser{}))
+	rows, err := r.conn(ctx).Query(sql, subID)
+	if err != nil {
+		return nil, err
+	}
+
+	return orm.CollectStrings(rows)
+}
+
+// GetCheckoutSessionByID returns the checkout session with the given id
+func (r *Repo) GetCheckoutSessionByID(ctx context.Context, id int64) (*CheckoutSession, error) {
+	var cs CheckoutSession
+	if err := orm.Get(r.conn(ctx), &cs, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadCheckoutSessionItems(ctx, &cs); err != nil {
+		return nil, err
+	}
+
+	return &cs, nil
+}
+
+// GetCheckoutSessionByProvider returns the checkout session with the given provider id.
+// This allows success pages to check the outcome of a checkout without going to the provider.
+func (r *Repo) GetCheckoutSessionByProvider(ctx context.Context, provider, providerID string) (*CheckoutSession, error) {
+	var cs CheckoutSession
+	if err := orm.Get(r.conn(ctx), &cs, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	if err := r.loadCheckoutSessionItems(ctx, &cs); err != nil {
+		return nil, err
+	}
+
+	return &cs, nil
+}
+
+// ListCheckoutSessionsByCustomerID returns the checkout sessions of a customer, most recent first
+func (r *Repo) ListCheckoutSessionsByCustomerID(ctx context.Context, customerID int64) ([]CheckoutSession, error) {
+	var sessions []CheckoutSession
+	if err := orm.List(r.conn(ctx), &sessions, "WHERE customer_id = $1 ORDER BY created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		if err := r.loadCheckoutSessionItems(ctx, &sessions[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+// ListCheckoutSessionsByClientReferenceID returns the checkout sessions started with the client reference id, most recent first
+func (r *Repo) ListCheckoutSessionsByClientReferenceID(ctx context.Context, ref string) ([]CheckoutSession, error) {
+	var sessions []CheckoutSession
+	if err := orm.List(r.conn(ctx), &sessions, "WHERE client_reference_id = $1 ORDER BY created_at DESC", ref); err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		if err := r.loadCheckoutSessionItems(ctx, &sessions[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return sessions, nil
+}
+
+// ListCheckoutSessionItems returns the items of the checkout session in the order they were checked out
+func (r *Repo) ListCheckoutSessionItems(ctx context.Context, sessionID int64) ([]CheckoutSessionItem, error) {
+	var items []CheckoutSessionItem
+	if err := orm.List(r.conn(ctx), &items, "WHERE checkout_session_id = $1 ORDER BY id ASC", sessionID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (r *Repo) loadCheckoutSessionItems(ctx context.Context, cs *CheckoutSession) error {
+	items, err := r.ListCheckoutSessionItems(ctx, cs.ID)
+	if err != nil {
+		return err
+	}
+
+	cs.Items = items
+	return nil
+}
+
+// addCheckoutSession stores the session along with its items
+func (r *Repo) addCheckoutSession(ctx context.Context, cs *CheckoutSession) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := orm.Add(r.tx(ctx, tx), cs); err != nil {
+		return err
+	}
+
+	for i := range cs.Items {
+		cs.Items[i].CheckoutSessionID = cs.ID
+		if err := orm.Add(r.tx(ctx, tx), &cs.Items[i]); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateCheckoutSessionByProvider updates the session firing callbacks when its status changes
+func (r *Repo) updateCheckoutSessionByProvider(ctx context.Context, cs *CheckoutSession) error {
+	var prev CheckoutSession
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", cs.Provider, cs.ProviderID); err != nil {
+		return err
+	}
+
+	cs.ID = prev.ID // the id can't change
+	if err := orm.UpdateByID(r.conn(ctx), cs); err != nil {
+		return err
+	}
+
+	if prev.Status == cs.Status {
+		return nil
+	}
+
+	switch cs.Status {
+	case CheckoutSessionComplete:
+		r.checkoutCompleted(cs)
+	case CheckoutSessionExpired:
+		r.checkoutExpired(cs)
+	}
+
+	return nil
+}
+
+// GetPurchaseByID returns the purchase with the given id
+func (r *Repo) GetPurchaseByID(ctx context.Context, id int64) (*Purchase, error) {
+	var p Purchase
+	if err := orm.Get(r.conn(ctx), &p, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// GetPurchaseByProvider returns the purchase with the given provider id
+func (r *Repo) GetPurchaseByProvider(ctx context.Context, provider, providerID string) (*Purchase, error) {
+	var p Purchase
+	if err := orm.Get(r.conn(ctx), &p, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// ListPurchasesByCustomerID returns the purchases made by a customer, most recent first
+func (r *Repo) ListPurchasesByCustomerID(ctx context.Context, customerID int64) ([]Purchase, error) {
+	var purchases []Purchase
+	if err := orm.List(r.conn(ctx), &purchases, "WHERE customer_id = $1 ORDER BY created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	return purchases, nil
+}
+
+// HasPurchased reports whether the customer has bought the price
+func (r *Repo) HasPurchased(ctx context.Context, customerID, priceID int64) (bool, error) {
+	n, err := orm.Count(r.conn(ctx), &Purchase{}, "WHERE customer_id = $1 AND price_id = $2", customerID, priceID)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// addPurchase stores the purchase unless one with the same provider id exists.
+// Providers may notify of the same payment more than once, possibly at the same time
+func (r *Repo) addPurchase(ctx context.Context, p *Purchase) error {
+	query := fmt.Sprintf(`INSERT INTO %s (provider, provider_id, payment_id, customer_id, price_id, quantity, amount, currency, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (provider, provider_id) DO NOTHING RETURNING id`, orm.TableName(p))
+
+	err := r.conn(ctx).QueryRow(query, p.Provider, p.ProviderID, p.PaymentID, p.CustomerID, p.PriceID, p.Quantity, p.Amount, p.Currency, p.CreatedAt).Scan(&p.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	r.purchaseAdded(p)
+	return nil
+}
+
+// GetInvoiceByID returns the invoice with the given id
+func (r *Repo) GetInvoiceByID(ctx context.Context, id int64) (*Invoice, error) {
+	var i Invoice
+	if err := orm.Get(r.conn(ctx), &i, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// GetInvoiceByProvider returns the invoice with the given provider id
+func (r *Repo) GetInvoiceByProvider(ctx context.Context, provider, providerID string) (*Invoice, error) {
+	var i Invoice
+	if err := orm.Get(r.conn(ctx), &i, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// ListInvoicesByCustomerID returns the invoices issued to a customer, most recent first
+func (r *Repo) ListInvoicesByCustomerID(ctx context.Context, customerID int64) ([]Invoice, error) {
+	var invoices []Invoice
+	if err := orm.List(r.conn(ctx), &invoices, "WHERE customer_id = $1 ORDER BY created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+// ListInvoicesByUsername returns the invoices of the subscriptions that have a user with given username, most recent first
+func (r *Repo) ListInvoicesByUsername(ctx context.Context, username string) ([]Invoice, error) {
+	var (
+		i        Invoice
+		invoices []Invoice
+		cols     = orm.Columns(&i).PrefixedList("i")
+		sql      = fmt.Sprintf("SELECT %s FROM %s i INNER JOIN %s su ON su.subscription_id = i.subscription_id AND su.username = $1 ORDER BY i.created_at DESC",
+			cols,
+			orm.TableName(&i),
+			orm.TableName(&SubscriptionUser{}),
+		)
+	)
+
+	if err := orm.Query(r.conn(ctx), &invoices, sql, username); err != nil {
+		return nil, err
+	}
+
+	return invoices, nil
+}
+
+func (r *Repo) addInvoice(ctx context.Context, i *Invoice) error {
+	if err := orm.Add(r.conn(ctx), i); err != nil {
+		return err
+	}
+
+	r.invoiceAdded(i)
+	return r.invoiceSaved(ctx, nil, i)
+}
+
+func (r *Repo) updateInvoiceByProvider(ctx context.Context, i *Invoice) error {
+	var prev Invoice
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", i.Provider, i.ProviderID); err != nil {
+		return err
+	}
+
+	i.ID = prev.ID // the id can't change
+	if err := orm.Update(r.conn(ctx), i, "WHERE provider = $1 AND provider_id = $2", i.Provider, i.ProviderID); err != nil {
+		return err
+	}
+
+	r.invoiceUpdated(&prev, i)
+	return r.invoiceSaved(ctx, &prev, i)
+}
+
+// saveInvoice adds the invoice or updates it when it already exists
+func (r *Repo) saveInvoice(ctx context.Context, i *Invoice) error {
+	_, err := r.GetInvoiceByProvider(ctx, i.Provider, i.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addInvoice(ctx, i)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateInvoiceByProvider(ctx, i)
+}
+
+func (r *Repo) removeInvoiceByProvider(ctx context.Context, provider, providerID string) error {
+	var i Invoice
+	if err := orm.Get(r.conn(ctx), &i, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return err
+	}
+
+	if err := orm.Remove(r.conn(ctx), &i, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return err
+	}
+
+	r.invoiceRemoved(&i)
+	return nil
+}
+
+// GetChargeByID returns the charge with the given id
+func (r *Repo) GetChargeByID(ctx context.Context, id int64) (*Charge, error) {
+	var c Charge
+	if err := orm.Get(r.conn(ctx), &c, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// GetChargeByProvider returns the charge with the given provider id
+func (r *Repo) GetChargeByProvider(ctx context.Context, provider, providerID string) (*Charge, error) {
+	var c Charge
+	if err := orm.Get(r.conn(ctx), &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// ListChargesByCustomerID returns the charges made to a customer, most recent first
+func (r *Repo) ListChargesByCustomerID(ctx context.Context, customerID int64) ([]Charge, error) {
+	var charges []Charge
+	if err := orm.List(r.conn(ctx), &charges, "WHERE customer_id = $1 ORDER BY created_at DESC", customerID); err != nil {
+		return nil, err
+	}
+
+	return charges, nil
+}
+
+func (r *Repo) addCharge(ctx context.Context, c *Charge) error {
+	if err := orm.Add(r.conn(ctx), c); err != nil {
+		return err
+	}
+
+	r.chargeAdded(c)
+	return nil
+}
+
+func (r *Repo) updateChargeByProvider(ctx context.Context, c *Charge) error {
+	var prev Charge
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+		return err
+	}
+
+	c.ID = prev.ID // the id can't change
+	if c.InvoiceID == nil {
+		c.InvoiceID = prev.InvoiceID // the invoice may not be stored yet when the charge is updated again
+	}
+
+	if err := orm.Update(r.conn(ctx), c, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+		return err
+	}
+
+	r.chargeUpdated(&prev, c)
+	return nil
+}
+
+// linkInvoiceCharge sets the invoice of a charge that was stored before the invoice was received
+func (r *Repo) linkInvoiceCharge(ctx context.Context, inv *Invoice, chargeProviderID string) error {
+	c, err := r.GetChargeByProvider(ctx, inv.Provider, chargeProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		// the charge is linked when it is received
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if c.InvoiceID != nil {
+		return nil
+	}
+
+	c.InvoiceID = &inv.ID
+	return r.updateChargeByProvider(ctx, c)
+}
+
+// saveCharge adds the charge or updates it when it already exists
+func (r *Repo) saveCharge(ctx context.Context, c *Charge) error {
+	_, err := r.GetChargeByProvider(ctx, c.Provider, c.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addCharge(ctx, c)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateChargeByProvider(ctx, c)
+}
+
+// refundAmount returns the amount to refund from the charge, a zero amount refunds whatever is left
+func refundAmount(c *Charge, amount int64) (int64, error) {
+	left := c.Refundable()
+	if left <= 0 {
+		return 0, ErrChargeNotRefundable
+	}
+
+	if amount == 0 {
+		return left, nil
+	}
+
+	if amount < 0 || amount > left {
+		return 0, ErrRefundExceedsCharge
+	}
+
+	return amount, nil
+}
+
+// GetRefundByID returns the refund with the given id
+func (r *Repo) GetRefundByID(ctx context.Context, id int64) (*Refund, error) {
+	var rf Refund
+	if err := orm.Get(r.conn(ctx), &rf, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &rf, nil
+}
+
+// GetRefundByProvider returns the refund with the given provider id
+func (r *Repo) GetRefundByProvider(ctx context.Context, provider, providerID string) (*Refund, error) {
+	var rf Refund
+	if err := orm.Get(r.conn(ctx), &rf, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &rf, nil
+}
+
+// ListRefundsByChargeID returns the refunds of a charge, most recent first
+func (r *Repo) ListRefundsByChargeID(ctx context.Context, chargeID int64) ([]Refund, error) {
+	var refunds []Refund
+	if err := orm.List(r.conn(ctx), &refunds, "WHERE charge_id = $1 ORDER BY created_at DESC", chargeID); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
+
+func (r *Repo) addRefund(ctx context.Context, rf *Refund) error {
+	if err := orm.Add(r.conn(ctx), rf); err != nil {
+		return err
+	}
+
+	r.refundAdded(rf)
+	return nil
+}
+
+func (r *Repo) updateRefundByProvider(ctx context.Context, rf *Refund) error {
+	var prev Refund
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", rf.Provider, rf.ProviderID); err != nil {
+		return err
+	}
+
+	rf.ID = prev.ID // the id can't change
+	if err := orm.Update(r.conn(ctx), rf, "WHERE provider = $1 AND provider_id = $2", rf.Provider, rf.ProviderID); err != nil {
+		return err
+	}
+
+	r.refundUpdated(&prev, rf)
+	return nil
+}
+
+// saveRefund adds the refund or updates it when it already exists
+func (r *Repo) saveRefund(ctx context.Context, rf *Refund) error {
+	_, err := r.GetRefundByProvider(ctx, rf.Provider, rf.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addRefund(ctx, rf)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateRefundByProvider(ctx, rf)
+}
+
+// GetDisputeByID returns the dispute with the given id
+func (r *Repo) GetDisputeByID(ctx context.Context, id int64) (*Dispute, error) {
+	var d Dispute
+	if err := orm.Get(r.conn(ctx), &d, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// GetDisputeByProvider returns the dispute with the given provider id
+func (r *Repo) GetDisputeByProvider(ctx context.Context, provider, providerID string) (*Dispute, error) {
+	var d Dispute
+	if err := orm.Get(r.conn(ctx), &d, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// ListDisputesByStatus returns the disputes with any of the given statuses, the ones whose evidence is due first come first
+func (r *Repo) ListDisputesByStatus(ctx context.Context, statuses ...DisputeStatus) ([]Dispute, error) {
+	if len(statuses) == 0 {
+		return nil, nil
+	}
+
+	var (
+		disputes []Dispute
+		query    = fmt.Sprintf("WHERE status IN (%s) ORDER BY evidence_due_by ASC", schema.ValueList(len(statuses), 1))
+	)
+
+	if err := orm.List(r.conn(ctx), &disputes, query, convertStringsToInterfaces(statuses)...); err != nil {
+		return nil, err
+	}
+
+	return disputes, nil
+}
+
+// ListDisputesByCustomerID returns the disputes of the charges made to a customer, most recent first
+func (r *Repo) ListDisputesByCustomerID(ctx context.Context, customerID int64) ([]Dispute, error) {
+	var (
+		d        Dispute
+		disputes []Dispute
+		sql      = fmt.Sprintf("SELECT %s FROM %s d INNER JOIN %s c ON c.id = d.charge_id AND c.customer_id = $1 ORDER BY d.created_at DESC",
+			orm.Columns(&d).PrefixedList("d"),
+			orm.TableName(&d),
+			orm.TableName(&Charge{}),
+		)
+	)
+
+	if err := orm.Query(r.conn(ctx), &disputes, sql, customerID); err != nil {
+		return nil, err
+	}
+
+	return disputes, nil
+}
+
+// addDispute stores the dispute, disputes that are already closed when first seen are not announced as opened
+func (r *Repo) addDispute(ctx context.Context, d *Dispute) error {
+	if err := orm.Add(r.conn(ctx), d); err != nil {
+		return err
+	}
+
+	if !d.Closed() {
+		r.disputeOpened(d)
+	}
+
+	return nil
+}
+
+func (r *Repo) updateDisputeByProvider(ctx context.Context, d *Dispute) error {
+	var prev Dispute
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", d.Provider, d.ProviderID); err != nil {
+		return err
+	}
+
+	d.ID = prev.ID // the id can't change
+	if err := orm.Update(r.conn(ctx), d, "WHERE provider = $1 AND provider_id = $2", d.Provider, d.ProviderID); err != nil {
+		return err
+	}
+
+	if d.Closed() && !prev.Closed() {
+		r.disputeClosed(d)
+	}
+
+	return nil
+}
+
+// saveDispute adds the dispute or updates it when it already exists
+func (r *Repo) saveDispute(ctx context.Context, d *Dispute) error {
+	_, err := r.GetDisputeByProvider(ctx, d.Provider, d.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addDispute(ctx, d)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateDisputeByProvider(ctx, d)
+}
+
+// GetCouponByID returns the coupon with the given id
+func (r *Repo) GetCouponByID(ctx context.Context, id int64) (*Coupon, error) {
+	var c Coupon
+	if err := orm.Get(r.conn(ctx), &c, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// GetCouponByProvider returns the coupon with the given provider id
+func (r *Repo) GetCouponByProvider(ctx context.Context, provider, providerID string) (*Coupon, error) {
+	var c Coupon
+	if err := orm.Get(r.conn(ctx), &c, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// ListCoupons returns the coupons that can still be redeemed, most recent first
+func (r *Repo) ListCoupons(ctx context.Context) ([]Coupon, error) {
+	var coupons []Coupon
+	if err := orm.List(r.conn(ctx), &coupons, "WHERE valid ORDER BY created_at DESC"); err != nil {
+		return nil, err
+	}
+
+	return coupons, nil
+}
+
+func (r *Repo) addCoupon(ctx context.Context, c *Coupon) error {
+	if err := orm.Add(r.conn(ctx), c); err != nil {
+		return err
+	}
+
+	r.couponAdded(c)
+	return nil
+}
+
+func (r *Repo) updateCouponByProvider(ctx context.Context, c *Coupon) error {
+	var prev Coupon
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+		return err
+	}
+
+	c.ID = prev.ID // the id can't change
+	if err := orm.Update(r.conn(ctx), c, "WHERE provider = $1 AND provider_id = $2", c.Provider, c.ProviderID); err != nil {
+		return err
+	}
+
+	r.couponUpdated(&prev, c)
+	return nil
+}
+
+// saveCoupon adds the coupon or updates it when it already exists
+func (r *Repo) saveCoupon(ctx context.Context, c *Coupon) error {
+	_, err := r.GetCouponByProvider(ctx, c.Provider, c.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addCoupon(ctx, c)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updateCouponByProvider(ctx, c)
+}
+
+// GetPromotionCodeByID returns the promotion code with the given id
+func (r *Repo) GetPromotionCodeByID(ctx context.Context, id int64) (*PromotionCode, error) {
+	var pc PromotionCode
+	if err := orm.Get(r.conn(ctx), &pc, "WHERE id = $1", id); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// GetPromotionCodeByProvider returns the promotion code with the given provider id
+func (r *Repo) GetPromotionCodeByProvider(ctx context.Context, provider, providerID string) (*PromotionCode, error) {
+	var pc PromotionCode
+	if err := orm.Get(r.conn(ctx), &pc, "WHERE provider = $1 AND provider_id = $2", provider, providerID); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// GetPromotionCodeByCode returns the active promotion code customers enter as code
+func (r *Repo) GetPromotionCodeByCode(ctx context.Context, code string) (*PromotionCode, error) {
+	var pc PromotionCode
+	if err := orm.Get(r.conn(ctx), &pc, "WHERE code = $1 AND active", code); err != nil {
+		return nil, err
+	}
+
+	return &pc, nil
+}
+
+// ListPromotionCodesByCouponID returns the promotion codes that redeem the coupon
+func (r *Repo) ListPromotionCodesByCouponID(ctx context.Context, couponID int64) ([]PromotionCode, error) {
+	var codes []PromotionCode
+	if err := orm.List(r.conn(ctx), &codes, "WHERE coupon_id = $1 ORDER BY created_at DESC", couponID); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// addPromotionCode stores the promotion code and links it to the subscriptions that redeemed it before it was received
+func (r *Repo) addPromotionCode(ctx context.Context, pc *PromotionCode) error {
+	if err := orm.Add(r.conn(ctx), pc); err != nil {
+		return err
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET promotion_code_id = $1 WHERE provider = $2 AND promotion_code_provider_id = $3 AND promotion_code_id IS NULL",
+		orm.TableName(&Subscription{}))
+
+	if _, err := r.conn(ctx).Exec(sql, pc.ID, pc.Provider, pc.ProviderID); err != nil {
+		return err
+	}
+
+	r.promoAdded(pc)
+	return nil
+}
+
+func (r *Repo) updatePromotionCodeByProvider(ctx context.Context, pc *PromotionCode) error {
+	var prev PromotionCode
+	if err := orm.Get(r.conn(ctx), &prev, "WHERE provider = $1 AND provider_id = $2", pc.Provider, pc.ProviderID); err != nil {
+		return err
+	}
+
+	pc.ID = prev.ID // the id can't change
+	if err := orm.Update(r.conn(ctx), pc, "WHERE provider = $1 AND provider_id = $2", pc.Provider, pc.ProviderID); err != nil {
+		return err
+	}
+
+	r.promoUpdated(&prev, pc)
+	return nil
+}
+
+// savePromotionCode adds the promotion code or updates it when it already exists
+func (r *Repo) savePromotionCode(ctx context.Context, pc *PromotionCode) error {
+	_, err := r.GetPromotionCodeByProvider(ctx, pc.Provider, pc.ProviderID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return r.addPromotionCode(ctx, pc)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.updatePromotionCodeByProvider(ctx, pc)
+}
+
+// ListSubscriptionsByCouponID returns the subscriptions the coupon was applied to, most recent first
+func (r *Repo) ListSubscriptionsByCouponID(ctx context.Context, couponID int64) ([]Subscription, error) {
+	var subs []Subscription
+	if err := orm.List(r.conn(ctx), &subs, "WHERE coupon_id = $1 ORDER BY discount_start DESC", couponID); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// ListSubscriptionsByPromotionCodeID returns the subscriptions of the customers that redeemed the promotion code, most recent first
+func (r *Repo) ListSubscriptionsByPromotionCodeID(ctx context.Context, promoID int64) ([]Subscription, error) {
+	var subs []Subscription
+	if err := orm.List(r.conn(ctx), &subs, "WHERE promotion_code_id = $1 ORDER BY discount_start DESC", promoID); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+// conn binds ctx to the database so that orm calls respect cancellation and deadlines
+func (r *Repo) conn(ctx context.Context) orm.DB {
+	return &conn{ctx: ctx, db: r.db}
+}
+
+// tx binds ctx to a transaction started with BeginTx
+func (r *Repo) tx(ctx context.Context, tx *sql.Tx) orm.QuerierExecuter {
+	return &conn{ctx: ctx, db: tx}
+}
+
+type conn struct {
+	ctx context.Context
+	db  interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+		QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+		QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	}
+}
+
+func (c *conn) Begin() (*sql.Tx, error) {
+	db, ok := c.db.(*sql.DB)
+	if !ok {
+		return nil, errors.New("nested transactions are not supported")
+	}
+
+	return db.BeginTx(c.ctx, nil)
+}
+
+func (c *conn) Exec(query string, args ...any) (sql.Result, error) {
+	return c.db.ExecContext(c.ctx, query, args...)
+}
+
+func (c *conn) Query(query string, args ...any) (*sql.Rows, error) {
+	return c.db.QueryContext(c.ctx, query, args...)
+}
+
+func (c *conn) QueryRow(query string, args ...any) *sql.Row {
+	return c.db.QueryRowContext(c.ctx, query, args...)
 }
@@ -0,0 +1,52 @@
+package pay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := p.backoff(tt.attempts); got != tt.want {
+			t.Fatalf("expected backoff of %s after %d attempts, got %s", tt.want, tt.attempts, got)
+		}
+	}
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   RetryPolicy
+	}{
+		{"empty", RetryPolicy{}, RetryPolicy{MinBackoff: DefaultRetryPolicy.MinBackoff, MaxBackoff: DefaultRetryPolicy.MaxBackoff}},
+		{"attempts kept", RetryPolicy{MaxAttempts: 3}, RetryPolicy{MaxAttempts: 3, MinBackoff: DefaultRetryPolicy.MinBackoff, MaxBackoff: DefaultRetryPolicy.MaxBackoff}},
+		{"min over default max", RetryPolicy{MinBackoff: 10 * time.Hour}, RetryPolicy{MinBackoff: 10 * time.Hour, MaxBackoff: 10 * time.Hour}},
+		{"max under min", RetryPolicy{MinBackoff: time.Minute, MaxBackoff: time.Second}, RetryPolicy{MinBackoff: time.Minute, MaxBackoff: time.Minute}},
+		{"max under default min", RetryPolicy{MaxBackoff: time.Second}, RetryPolicy{MinBackoff: DefaultRetryPolicy.MinBackoff, MaxBackoff: DefaultRetryPolicy.MinBackoff}},
+		{"set", RetryPolicy{MaxAttempts: 5, MinBackoff: time.Second, MaxBackoff: time.Minute}, RetryPolicy{MaxAttempts: 5, MinBackoff: time.Second, MaxBackoff: time.Minute}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.withDefaults(); *got != tt.want {
+				t.Fatalf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
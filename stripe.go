@@ -1,20 +1,38 @@
 package pay
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/stripe/stripe-go/v74"
 	"github.com/stripe/stripe-go/v74/checkout/session"
+	"github.com/stripe/stripe-go/v74/coupon"
 	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/invoice"
 	"github.com/stripe/stripe-go/v74/price"
 	"github.com/stripe/stripe-go/v74/product"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	"github.com/stripe/stripe-go/v74/refund"
+	"github.com/stripe/stripe-go/v74/subscription"
 )
 
 const ProviderStripe = "stripe"
 
-var ErrCheckoutFailed = errors.New("checkout failed")
+// basePriceMetadataKey is the subscription metadata key holding the provider id of the price which the seats are paid with.
+// It tells the base item apart from the add-ons checked out along with it
+const basePriceMetadataKey = "pay_base_price"
+
+var (
+	ErrCheckoutFailed    = errors.New("checkout failed")
+	ErrProviderMismatch  = errors.New("entity belongs to a different provider")
+	ErrPriceNotRecurring = errors.New("price is not recurring")
+)
+
+var _ Provider = (*StripeProvider)(nil)
 
 type (
 	// StripeConfig configures StripeService with necessary credentials and callbacks
@@ -22,12 +40,26 @@ type (
 		Repo          *Repo
 		Key           string
 		WebhookSecret string
+		WebhookRetry  *RetryPolicy // DefaultRetryPolicy is used when nil
+		UsageRetry    *RetryPolicy // retries of usage that failed to be flushed, DefaultRetryPolicy is used when nil
+
+		// FeatureMetadataPrefix enables reading plan features from product metadata.
+		// With the prefix "feature." the metadata feature.projects=10 grants a limit of 10 projects.
+		// Features of a plan are replaced by the ones in the metadata whenever the product is synced
+		FeatureMetadataPrefix string
+
+		// PortalConfigID is the billing portal configuration used by PortalSession, the default configuration is used when empty
+		PortalConfigID string
 	}
 
 	// StripeProvider interfaces with stripe for customer, plan and subscription data
 	StripeProvider struct {
 		*Repo
 		config *StripeConfig
+
+		worker     sync.Once
+		received   chan struct{}      // wakes up the webhook worker
+		stopWorker context.CancelFunc // stops the webhook worker started by Webhook
 	}
 )
 
@@ -44,9 +76,38 @@ func NewStripeProvider(config *StripeConfig) *StripeProvider {
 	}
 }
 
-// AddPlan directly in stripe
+// retryPolicy returns the configured retry policy with unset backoffs defaulted
+func (s *StripeProvider) retryPolicy() *RetryPolicy {
+	if s.config.WebhookRetry != nil {
+		return s.config.WebhookRetry.withDefaults()
+	}
+
+	return DefaultRetryPolicy.withDefaults()
+}
+
+// usageRetryPolicy returns the configured usage retry policy with unset backoffs defaulted
+func (s *StripeProvider) usageRetryPolicy() *RetryPolicy {
+	if s.config.UsageRetry != nil {
+		return s.config.UsageRetry.withDefaults()
+	}
+
+	return DefaultRetryPolicy.withDefaults()
+}
+
+// Name returns the name of the stripe provider
+func (s *StripeProvider) Name() string {
+	return ProviderStripe
+}
+
+// AddPlan uses context.Background, to specify the context use AddPlanContext
 func (s *StripeProvider) AddPlan(p *Plan) error {
+	return s.AddPlanContext(context.Background(), p)
+}
+
+// AddPlanContext directly in stripe
+func (s *StripeProvider) AddPlanContext(ctx context.Context, p *Plan) error {
 	_, err := product.New(&stripe.ProductParams{
+		Params:      stripe.Params{Context: ctx},
 		Name:        stripe.String(p.Name),
 		Description: stripe.String(p.Description),
 		Active:      stripe.Bool(p.Active),
@@ -54,9 +115,15 @@ func (s *StripeProvider) AddPlan(p *Plan) error {
 	return err
 }
 
-// UpdatePlan in stripe
+// UpdatePlan uses context.Background, to specify the context use UpdatePlanContext
 func (s *StripeProvider) UpdatePlan(p *Plan) error {
+	return s.UpdatePlanContext(context.Background(), p)
+}
+
+// UpdatePlanContext in stripe
+func (s *StripeProvider) UpdatePlanContext(ctx context.Context, p *Plan) error {
 	_, err := product.Update(p.ProviderID, &stripe.ProductParams{
+		Params:      stripe.Params{Context: ctx},
 		Name:        stripe.String(p.Name),
 		Description: stripe.String(p.Description),
 		Active:      stripe.Bool(p.Active),
@@ -65,73 +132,254 @@ func (s *StripeProvider) UpdatePlan(p *Plan) error {
 	return err
 }
 
-// RemovePlan from stripe
+// RemovePlanByProviderID uses context.Background, to specify the context use RemovePlanByProviderIDContext
 func (s *StripeProvider) RemovePlanByProviderID(providerID string) error {
-	_, err := product.Del(providerID, nil)
+	return s.RemovePlanByProviderIDContext(context.Background(), providerID)
+}
+
+// RemovePlan from stripe
+func (s *StripeProvider) RemovePlanByProviderIDContext(ctx context.Context, providerID string) error {
+	_, err := product.Del(providerID, &stripe.ProductParams{
+		Params: stripe.Params{Context: ctx},
+	})
 	return err
 }
 
-// AddPrice directly in stripe
+// AddPrice uses context.Background, to specify the context use AddPriceContext
 func (s *StripeProvider) AddPrice(p *Price) error {
-	var sched string
-	switch p.Schedule {
-	case PricingAnnual:
-		sched = string(stripe.PriceRecurringIntervalYear)
-	case PricingMonthly:
-		sched = string(stripe.PriceRecurringIntervalMonth)
-	}
+	return s.AddPriceContext(context.Background(), p)
+}
 
-	pl, err := s.GetPlanByID(p.PlanID)
+// AddPriceContext directly in stripe.
+// Prices without an interval are created as one time prices, tiered prices are created with their tiers
+func (s *StripeProvider) AddPriceContext(ctx context.Context, p *Price) error {
+	pl, err := s.GetPlanByIDContext(ctx, p.PlanID)
 	if err != nil {
 		return fmt.Errorf("plan with id %d not found", p.PlanID)
 	}
 
-	_, err = price.New(&stripe.PriceParams{
+	params := &stripe.PriceParams{
+		Params:     stripe.Params{Context: ctx},
 		Currency:   stripe.String(p.Currency),
 		UnitAmount: stripe.Int64(p.Amount),
 		Product:    stripe.String(pl.ProviderID),
-		Recurring: &stripe.PriceRecurringParams{
-			Interval:        stripe.String(sched),
+	}
+
+	if p.IsRecurring() {
+		params.Recurring = &stripe.PriceRecurringParams{
+			Interval:        stripe.String(p.Interval),
 			TrialPeriodDays: stripe.Int64(int64(p.TrialDays)),
-			IntervalCount:   stripe.Int64(1),
-		},
-	})
+			IntervalCount:   stripe.Int64(int64(max(p.IntervalCount, 1))),
+		}
+
+		if p.IsMetered() {
+			params.Recurring.UsageType = stripe.String(string(UsageMetered))
+			if p.AggregateUsage != "" {
+				params.Recurring.AggregateUsage = stripe.String(string(p.AggregateUsage))
+			}
+		}
+	}
+
+	if p.IsTiered() {
+		if !p.validTiers() {
+			return ErrInvalidPriceTiers
+		}
+
+		params.UnitAmount = nil
+		params.BillingScheme = stripe.String(string(stripe.PriceBillingSchemeTiered))
+		params.TiersMode = stripe.String(p.TiersMode)
 
+		for _, t := range p.Tiers {
+			tier := &stripe.PriceTierParams{
+				UnitAmount: stripe.Int64(t.UnitAmount),
+				FlatAmount: stripe.Int64(t.FlatAmount),
+			}
+
+			if t.UpTo != nil {
+				tier.UpTo = stripe.Int64(*t.UpTo)
+			} else {
+				tier.UpToInf = stripe.Bool(true)
+			}
+
+			params.Tiers = append(params.Tiers, tier)
+		}
+
+		// the price is stored right away as the webhook event won't include its tiers
+		params.AddExpand("tiers")
+		created, err := price.New(params)
+		if err != nil {
+			return err
+		}
+
+		pr, err := s.convertPrice(ctx, created)
+		if err != nil {
+			return err
+		}
+
+		return s.savePrice(ctx, pr)
+	}
+
+	_, err = price.New(params)
 	return err
 }
 
-// AddCustomer directly in stripe
+// AddCoupon creates the coupon in stripe storing it right away so that it can be used in checkouts
+func (s *StripeProvider) AddCoupon(ctx context.Context, c *Coupon) error {
+	if (c.PercentOff > 0) == (c.AmountOff > 0) {
+		return ErrInvalidCoupon
+	}
+
+	params := &stripe.CouponParams{
+		Params:   stripe.Params{Context: ctx},
+		Name:     optionalString(c.Name),
+		Duration: stripe.String(c.Duration),
+	}
+
+	if c.PercentOff > 0 {
+		params.PercentOff = stripe.Float64(c.PercentOff)
+	} else {
+		params.AmountOff = stripe.Int64(c.AmountOff)
+		params.Currency = stripe.String(c.Currency)
+	}
+
+	if c.Duration == CouponRepeating {
+		params.DurationInMonths = stripe.Int64(int64(c.DurationInMonths))
+	}
+
+	if c.MaxRedemptions > 0 {
+		params.MaxRedemptions = stripe.Int64(c.MaxRedemptions)
+	}
+
+	if c.RedeemBy != nil {
+		params.RedeemBy = stripe.Int64(c.RedeemBy.Unix())
+	}
+
+	sc, err := coupon.New(params)
+	if err != nil {
+		return err
+	}
+
+	saved := convertCoupon(sc)
+	if err := s.saveCoupon(ctx, saved); err != nil {
+		return err
+	}
+
+	*c = *saved
+	return nil
+}
+
+// AddPromotionCode creates a code for the coupon in stripe storing it right away.
+// Stripe generates the code when it is empty
+func (s *StripeProvider) AddPromotionCode(ctx context.Context, pc *PromotionCode) error {
+	c, err := s.GetCouponByID(ctx, pc.CouponID)
+	if err != nil {
+		return err
+	}
+
+	if c.Provider != ProviderStripe {
+		return ErrProviderMismatch
+	}
+
+	params := &stripe.PromotionCodeParams{
+		Params: stripe.Params{Context: ctx},
+		Coupon: stripe.String(c.ProviderID),
+		Code:   optionalString(pc.Code),
+		Active: stripe.Bool(true),
+	}
+
+	if pc.CustomerID != nil {
+		cust, err := s.GetCustomerByIDContext(ctx, *pc.CustomerID)
+		if err != nil {
+			return err
+		}
+
+		params.Customer = stripe.String(cust.ProviderID)
+	}
+
+	if pc.MaxRedemptions > 0 {
+		params.MaxRedemptions = stripe.Int64(pc.MaxRedemptions)
+	}
+
+	if pc.ExpiresAt != nil {
+		params.ExpiresAt = stripe.Int64(pc.ExpiresAt.Unix())
+	}
+
+	spc, err := promotioncode.New(params)
+	if err != nil {
+		return err
+	}
+
+	saved, err := s.convertPromotionCode(ctx, spc)
+	if err != nil {
+		return err
+	}
+
+	if err := s.savePromotionCode(ctx, saved); err != nil {
+		return err
+	}
+
+	*pc = *saved
+	return nil
+}
+
+// AddCustomer uses context.Background, to specify the context use AddCustomerContext
 func (s *StripeProvider) AddCustomer(c *Customer) error {
+	return s.AddCustomerContext(context.Background(), c)
+}
+
+// AddCustomerContext directly in stripe
+func (s *StripeProvider) AddCustomerContext(ctx context.Context, c *Customer) error {
 	_, err := customer.New(&stripe.CustomerParams{
-		Name:  stripe.String(c.Name),
-		Email: stripe.String(c.Email),
+		Params: stripe.Params{Context: ctx},
+		Name:   stripe.String(c.Name),
+		Email:  stripe.String(c.Email),
 	})
 	return err
 }
 
-// Update Customer directly in stripe
+// UpdateCustomer uses context.Background, to specify the context use UpdateCustomerContext
 func (s *StripeProvider) UpdateCustomer(c *Customer) error {
+	return s.UpdateCustomerContext(context.Background(), c)
+}
+
+// Update Customer directly in stripe
+func (s *StripeProvider) UpdateCustomerContext(ctx context.Context, c *Customer) error {
 	if c.ProviderID == "" {
 		return errors.New("missing customer provider id")
 	}
 
 	_, err := customer.Update(c.ProviderID, &stripe.CustomerParams{
-		Name:  stripe.String(c.Name),
-		Email: stripe.String(c.Email),
+		Params: stripe.Params{Context: ctx},
+		Name:   stripe.String(c.Name),
+		Email:  stripe.String(c.Email),
 	})
 
 	return err
 }
 
-// RemoveCustomer directly in stripe
+// RemoveCustomerByProviderID uses context.Background, to specify the context use RemoveCustomerByProviderIDContext
 func (s *StripeProvider) RemoveCustomerByProviderID(providerID string) error {
-	_, err := customer.Del(providerID, nil)
+	return s.RemoveCustomerByProviderIDContext(context.Background(), providerID)
+}
+
+// RemoveCustomer directly in stripe
+func (s *StripeProvider) RemoveCustomerByProviderIDContext(ctx context.Context, providerID string) error {
+	_, err := customer.Del(providerID, &stripe.CustomerParams{
+		Params: stripe.Params{Context: ctx},
+	})
 	return err
 }
 
-// Verify that the checkout was completed
+// VerifyCheckout uses context.Background, to specify the context use VerifyCheckoutContext
 func (s *StripeProvider) VerifyCheckout(sessionID string) error {
-	sess, err := session.Get(sessionID, nil)
+	return s.VerifyCheckoutContext(context.Background(), sessionID)
+}
+
+// Verify that the checkout was completed
+func (s *StripeProvider) VerifyCheckoutContext(ctx context.Context, sessionID string) error {
+	sess, err := session.Get(sessionID, &stripe.CheckoutSessionParams{
+		Params: stripe.Params{Context: ctx},
+	})
 	if err != nil {
 		return err
 	}
@@ -143,48 +391,643 @@ func (s *StripeProvider) VerifyCheckout(sessionID string) error {
 	return nil
 }
 
+// CancelSubscription in stripe. When atPeriodEnd is set the subscription stays active until the end of the
+// period it was paid for, otherwise it ends immediately
+func (s *StripeProvider) CancelSubscription(ctx context.Context, subID int64, atPeriodEnd bool) error {
+	sub, err := s.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	if atPeriodEnd {
+		_, err = subscription.Update(sub.ProviderID, &stripe.SubscriptionParams{
+			Params:            stripe.Params{Context: ctx},
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+		return err
+	}
+
+	_, err = subscription.Cancel(sub.ProviderID, &stripe.SubscriptionCancelParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	return err
+}
+
+// PauseSubscription stops collecting payments for the subscription, invoices created while paused are voided
+func (s *StripeProvider) PauseSubscription(ctx context.Context, subID int64) error {
+	sub, err := s.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	_, err = subscription.Update(sub.ProviderID, &stripe.SubscriptionParams{
+		Params: stripe.Params{Context: ctx},
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	})
+	return err
+}
+
+// ResumeSubscription resumes payment collection of a paused subscription
+// and withdraws a cancellation scheduled for the end of the period
+func (s *StripeProvider) ResumeSubscription(ctx context.Context, subID int64) error {
+	sub, err := s.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Params:            stripe.Params{Context: ctx},
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+
+	// an empty value unsets pause_collection
+	params.AddExtra("pause_collection", "")
+
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
+// ChangeSubscriptionPrice swaps the price of the subscription, the time left in the current period is prorated according to mode
+func (s *StripeProvider) ChangeSubscriptionPrice(ctx context.Context, subID, priceID int64, mode ProrationMode, prorationDate time.Time) error {
+	sub, pr, err := s.getPriceChange(ctx, subID, priceID)
+	if err != nil {
+		return err
+	}
+
+	itemID, err := s.subscriptionItemID(ctx, sub, sub.PriceID)
+	if err != nil {
+		return err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Params: stripe.Params{Context: ctx},
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(itemID),
+				Price: stripe.String(pr.ProviderID),
+			},
+		},
+		ProrationBehavior: stripe.String(prorationMode(mode)),
+	}
+
+	if !prorationDate.IsZero() {
+		params.ProrationDate = stripe.Int64(prorationDate.Unix())
+	}
+
+	// the item keeps holding the seats once its price has changed
+	params.AddMetadata(basePriceMetadataKey, pr.ProviderID)
+
+	_, err = subscription.Update(sub.ProviderID, params)
+	return err
+}
+
+// PreviewSubscriptionPriceChange asks stripe for the upcoming invoice as it would be after changing the price of the subscription
+func (s *StripeProvider) PreviewSubscriptionPriceChange(ctx context.Context, subID, priceID int64, mode ProrationMode) (*ProrationPreview, error) {
+	sub, pr, err := s.getPriceChange(ctx, subID, priceID)
+	if err != nil {
+		return nil, err
+	}
+
+	cust, err := s.GetCustomerByIDContext(ctx, sub.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+
+	itemID, err := s.subscriptionItemID(ctx, sub, sub.PriceID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	inv, err := invoice.Upcoming(&stripe.InvoiceUpcomingParams{
+		Params:       stripe.Params{Context: ctx},
+		Customer:     stripe.String(cust.ProviderID),
+		Subscription: stripe.String(sub.ProviderID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(itemID),
+				Price: stripe.String(pr.ProviderID),
+			},
+		},
+		SubscriptionProrationBehavior: stripe.String(prorationMode(mode)),
+		SubscriptionProrationDate:     stripe.Int64(now.Unix()),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	preview := ProrationPreview{
+		AmountDue:     inv.AmountDue,
+		Currency:      string(inv.Currency),
+		ProrationDate: now,
+	}
+
+	if inv.Lines != nil {
+		for _, line := range inv.Lines.Data {
+			if line.Proration {
+				preview.Amount += line.Amount
+			}
+		}
+	}
+
+	return &preview, nil
+}
+
+// SetSeatCount updates the quantity of the subscription in stripe, the change is prorated
+func (s *StripeProvider) SetSeatCount(ctx context.Context, subID, n int64) error {
+	sub, err := s.getSubscription(ctx, subID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkSeatCount(ctx, subID, n); err != nil {
+		return err
+	}
+
+	itemID, err := s.subscriptionItemID(ctx, sub, sub.PriceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = subscription.Update(sub.ProviderID, &stripe.SubscriptionParams{
+		Params: stripe.Params{Context: ctx},
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:       stripe.String(itemID),
+				Quantity: stripe.Int64(n),
+			},
+		},
+	})
+
+	return err
+}
+
+// Refund refunds the charge in stripe. The refund is stored right away and updated by webhooks as it progresses
+func (s *StripeProvider) Refund(ctx context.Context, chargeID, amount int64, reason RefundReason) (*Refund, error) {
+	c, err := s.GetChargeByID(ctx, chargeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Provider != ProviderStripe {
+		return nil, ErrProviderMismatch
+	}
+
+	amount, err = refundAmount(c, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.RefundParams{
+		Params: stripe.Params{Context: ctx},
+		Charge: stripe.String(c.ProviderID),
+		Amount: stripe.Int64(amount),
+	}
+
+	if reason != "" {
+		params.Reason = stripe.String(reason)
+	}
+
+	re, err := refund.New(params)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := s.convertRefund(re, c)
+	if err := s.saveRefund(ctx, rf); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+// getPriceChange returns the subscription and the recurring price it is being changed to
+func (s *StripeProvider) getPriceChange(ctx context.Context, subID, priceID int64) (*Subscription, *Price, error) {
+	sub, err := s.getSubscription(ctx, subID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pr, err := s.GetPriceByIDContext(ctx, priceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if pr.Provider != ProviderStripe {
+		return nil, nil, ErrProviderMismatch
+	}
+
+	if !pr.IsRecurring() {
+		return nil, nil, ErrPriceNotRecurring
+	}
+
+	if err := s.checkPriceCurrency(ctx, sub, pr); err != nil {
+		return nil, nil, err
+	}
+
+	return sub, pr, nil
+}
+
+// checkPriceCurrency returns ErrCurrencyMismatch when pr is in another currency than the price of the subscription,
+// as a subscription is billed in a single currency
+func (r *Repo) checkPriceCurrency(ctx context.Context, sub *Subscription, pr *Price) error {
+	cur, err := r.GetPriceByIDContext(ctx, sub.PriceID)
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(cur.Currency, pr.Currency) {
+		return ErrCurrencyMismatch
+	}
+
+	return nil
+}
+
+// prorationMode returns mode, or ProrationCreate when it is empty as stripe rejects an empty proration behavior
+func prorationMode(mode ProrationMode) ProrationMode {
+	if mode == "" {
+		return ProrationCreate
+	}
+
+	return mode
+}
+
+// subscriptionItemID returns the id of the item of the subscription holding the price
+func (s *StripeProvider) subscriptionItemID(ctx context.Context, sub *Subscription, priceID int64) (string, error) {
+	items, err := s.ListSubscriptionItems(ctx, sub.ID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, it := range items {
+		if it.PriceID == priceID {
+			return it.ProviderID, nil
+		}
+	}
+
+	// subscriptions stored before their items were kept
+	pr, err := s.GetPriceByIDContext(ctx, priceID)
+	if err != nil {
+		return "", err
+	}
+
+	ssub, err := subscription.Get(sub.ProviderID, &stripe.SubscriptionParams{
+		Params: stripe.Params{Context: ctx},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if ssub.Items != nil {
+		for _, it := range ssub.Items.Data {
+			if it.Price != nil && it.Price.ID == pr.ProviderID {
+				return it.ID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("subscription %s has no item with price %s", sub.ProviderID, pr.ProviderID)
+}
+
+// getSubscription returns the subscription with the given id ensuring that it was created by stripe
+func (s *StripeProvider) getSubscription(ctx context.Context, subID int64) (*Subscription, error) {
+	sub, err := s.GetSubscriptionByIDContext(ctx, subID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sub.Provider != ProviderStripe {
+		return nil, ErrProviderMismatch
+	}
+
+	return sub, nil
+}
+
 // CheckoutRequest
 type CheckoutRequest struct {
 	CustomerID  int64
-	PriceID     int64
+	PriceID     int64          // checked out as the first item when set
+	Quantity    int64          // quantity of PriceID, defaults to 1
+	Items       []CheckoutItem // further items such as add-ons to the plan
 	RedirectURL string
+	CancelURL   string // where the customer is sent when they leave the checkout, the provider decides when empty
+
+	Locale            string   // language of the checkout page, e.g. "fr" or "auto"
+	ClientReferenceID string   // your own reference for reconciling the checkout
+	Metadata          Metadata // kept on the CheckoutSession that is passed to OnCheckoutCompleted
+
+	Discounts           []Discount // applied to the checkout, can't be combined with AllowPromotionCodes
+	AllowPromotionCodes bool       // lets the customer enter a promotion code during checkout
+}
+
+// CheckoutItem is a price checked out with a quantity
+type CheckoutItem struct {
+	PriceID  int64
+	Quantity int64 // defaults to 1, metered prices have no quantity
+}
+
+// checkoutItem is an item of a checkout request with its price
+type checkoutItem struct {
+	price    *Price
+	quantity int64
+}
+
+// checkoutItems returns the items of the request ensuring that they belong to the provider and can be checked out together
+func (r *Repo) checkoutItems(ctx context.Context, provider string, request *CheckoutRequest) ([]checkoutItem, error) {
+	items := request.Items
+	if request.PriceID != 0 {
+		items = append([]CheckoutItem{{PriceID: request.PriceID, Quantity: request.Quantity}}, items...)
+	}
+
+	if len(items) == 0 {
+		return nil, ErrEmptyCheckout
+	}
+
+	var (
+		result    []checkoutItem
+		recurring *Price
+	)
+
+	for _, item := range items {
+		if item.Quantity < 0 {
+			return nil, ErrInvalidQuantity
+		}
+
+		pr, err := r.GetPriceByIDContext(ctx, item.PriceID)
+		if err != nil {
+			return nil, err
+		}
+
+		if pr.Provider != provider {
+			return nil, ErrProviderMismatch
+		}
+
+		if len(result) > 0 && pr.Currency != result[0].price.Currency {
+			return nil, ErrCheckoutItemsMismatch
+		}
+
+		if pr.IsRecurring() {
+			if recurring != nil && (pr.Interval != recurring.Interval || pr.IntervalCount != recurring.IntervalCount) {
+				return nil, ErrCheckoutItemsMismatch
+			}
+
+			if recurring == nil {
+				recurring = pr
+			}
+		}
+
+		result = append(result, checkoutItem{price: pr, quantity: max(item.Quantity, 1)})
+	}
+
+	return result, nil
+}
+
+// recurringCheckoutItem returns the first recurring item which the subscription started by the checkout is for, nil when there is none
+func recurringCheckoutItem(items []checkoutItem) *checkoutItem {
+	for i := range items {
+		if items[i].price.IsRecurring() {
+			return &items[i]
+		}
+	}
+
+	return nil
+}
+
+// sessionPurchases returns a purchase of each item of the session paid for with amount at the time at.
+// itemIDs are the provider ids of the line items in the order of the items of the session.
+// The amount is split across the items by their price
+func (r *Repo) sessionPurchases(ctx context.Context, cs *CheckoutSession, paymentID string, itemIDs []string, amount int64, currency string, at time.Time) ([]Purchase, error) {
+	if len(itemIDs) != len(cs.Items) {
+		return nil, fmt.Errorf("checkout session %s has %d items, got %d line items", cs.ProviderID, len(cs.Items), len(itemIDs))
+	}
+
+	quotes := make([]int64, len(cs.Items))
+	for i, item := range cs.Items {
+		pr, err := r.GetPriceByIDContext(ctx, item.PriceID)
+		if err != nil {
+			return nil, err
+		}
+
+		quotes[i] = pr.Quote(item.Quantity)
+	}
+
+	amounts := splitAmount(amount, quotes)
+	purchases := make([]Purchase, len(cs.Items))
+	for i, item := range cs.Items {
+		purchases[i] = Purchase{
+			Provider:   cs.Provider,
+			ProviderID: itemIDs[i],
+			PaymentID:  paymentID,
+			CustomerID: cs.CustomerID,
+			PriceID:    item.PriceID,
+			Quantity:   item.Quantity,
+			Amount:     amounts[i],
+			Currency:   currency,
+			CreatedAt:  at,
+		}
+	}
+
+	return purchases, nil
+}
+
+// splitAmount splits amount in proportion to the quotes.
+// The last part gets what is left over from rounding, all of it goes to the first part when nothing was quoted
+func splitAmount(amount int64, quotes []int64) []int64 {
+	var total int64
+	for _, q := range quotes {
+		total += q
+	}
+
+	parts := make([]int64, len(quotes))
+	rest := amount
+	for i, q := range quotes {
+		parts[i] = rest
+		if i < len(quotes)-1 && total > 0 {
+			parts[i] = amount * q / total
+		}
+
+		rest -= parts[i]
+	}
+
+	return parts
+}
+
+// Discount applies either a coupon or a promotion code
+type Discount struct {
+	CouponID        int64
+	PromotionCodeID int64
+}
+
+// appliedDiscount is a discount of a checkout request with its coupon, the promotion code is nil when the coupon is applied directly
+type appliedDiscount struct {
+	coupon *Coupon
+	promo  *PromotionCode
+}
+
+// checkoutDiscounts returns the discounts of the request ensuring that they belong to the provider and can be redeemed
+func (r *Repo) checkoutDiscounts(ctx context.Context, provider string, request *CheckoutRequest) ([]appliedDiscount, error) {
+	if len(request.Discounts) > 0 && request.AllowPromotionCodes {
+		return nil, ErrDiscountConflict
+	}
+
+	var discounts []appliedDiscount
+	for _, d := range request.Discounts {
+		var (
+			applied appliedDiscount
+			err     error
+		)
+
+		switch {
+		case d.CouponID != 0 && d.PromotionCodeID == 0:
+			applied.coupon, err = r.GetCouponByID(ctx, d.CouponID)
+		case d.PromotionCodeID != 0 && d.CouponID == 0:
+			applied.promo, err = r.GetPromotionCodeByID(ctx, d.PromotionCodeID)
+			if err != nil {
+				return nil, err
+			}
+
+			if !applied.promo.Active || applied.promo.Provider != provider {
+				return nil, ErrCouponNotRedeemable
+			}
+
+			applied.coupon, err = r.GetCouponByID(ctx, applied.promo.CouponID)
+		default:
+			return nil, ErrInvalidDiscount
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if applied.coupon.Provider != provider {
+			return nil, ErrProviderMismatch
+		}
+
+		if !applied.coupon.Valid {
+			return nil, ErrCouponNotRedeemable
+		}
+
+		discounts = append(discounts, applied)
+	}
+
+	return discounts, nil
 }
 
-// Checkout returns the url that a user has to visit in order to complete payment
-// it registers the customer if it was unavailable
+// newCheckoutSession returns the open checkout session of the request
+func newCheckoutSession(provider, providerID, url string, customer *Customer, items []checkoutItem, request *CheckoutRequest) *CheckoutSession {
+	cs := &CheckoutSession{
+		Provider:          provider,
+		ProviderID:        providerID,
+		CustomerID:        customer.ID,
+		PriceID:           items[0].price.ID,
+		Status:            CheckoutSessionOpen,
+		URL:               url,
+		CancelURL:         request.CancelURL,
+		Locale:            request.Locale,
+		ClientReferenceID: request.ClientReferenceID,
+		Metadata:          request.Metadata,
+		CreatedAt:         time.Now(),
+	}
+
+	for _, item := range items {
+		cs.Items = append(cs.Items, CheckoutSessionItem{PriceID: item.price.ID, Quantity: item.quantity})
+	}
+
+	return cs
+}
+
+// Checkout uses context.Background, to specify the context use CheckoutContext
 func (s *StripeProvider) Checkout(request *CheckoutRequest) (url string, err error) {
-	customer, err := s.GetCustomerByID(request.CustomerID)
+	return s.CheckoutContext(context.Background(), request)
+}
+
+// CheckoutContext returns the url that a user has to visit in order to complete payment.
+// Checkouts with a recurring price start a subscription to the first one while one time prices alone are checked out in payment mode
+func (s *StripeProvider) CheckoutContext(ctx context.Context, request *CheckoutRequest) (url string, err error) {
+	customer, err := s.GetCustomerByIDContext(ctx, request.CustomerID)
 	if err != nil {
 		return
 	}
 
-	price, err := s.GetPriceByID(request.PriceID)
+	items, err := s.checkoutItems(ctx, ProviderStripe, request)
 	if err != nil {
 		return
 	}
 
-	var trialEnd *int64 = nil
+	params := &stripe.CheckoutSessionParams{
+		Params:     stripe.Params{Context: ctx},
+		Customer:   stripe.String(customer.ProviderID),
+		SuccessURL: stripe.String(request.RedirectURL),
+	}
 
-	if price.TrialDays > 0 {
-		// we add one day of grace so that stripe displays the correct amount.
-		// since trial end is calculated from current time, being one second off will result in days -1 being displayed in stripe checkout
-		trialEnd = stripe.Int64(price.TrialEnd().Add(time.Hour * 24).Unix())
+	for _, item := range items {
+		li := &stripe.CheckoutSessionLineItemParams{
+			Price:    stripe.String(item.price.ProviderID),
+			Quantity: stripe.Int64(item.quantity),
+		}
+
+		// stripe rejects a quantity for metered prices, usage is reported with RecordUsage instead
+		if item.price.IsMetered() {
+			li.Quantity = nil
+		}
+
+		params.LineItems = append(params.LineItems, li)
 	}
 
-	params := &stripe.CheckoutSessionParams{
-		Customer:                stripe.String(customer.ProviderID),
-		SuccessURL:              stripe.String(request.RedirectURL),
-		Mode:                    stripe.String(string(stripe.CheckoutSessionModeSubscription)),
-		PaymentMethodCollection: stripe.String("if_required"),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(price.ProviderID),
-				Quantity: stripe.Int64(1),
-			},
-		},
-		SubscriptionData: &stripe.CheckoutSessionSubscriptionDataParams{
+	if request.CancelURL != "" {
+		params.CancelURL = stripe.String(request.CancelURL)
+	}
+
+	if request.Locale != "" {
+		params.Locale = stripe.String(request.Locale)
+	}
+
+	if request.ClientReferenceID != "" {
+		params.ClientReferenceID = stripe.String(request.ClientReferenceID)
+	}
+
+	for k, v := range request.Metadata {
+		params.AddMetadata(k, v)
+	}
+
+	discounts, err := s.checkoutDiscounts(ctx, ProviderStripe, request)
+	if err != nil {
+		return
+	}
+
+	for _, d := range discounts {
+		if d.promo != nil {
+			params.Discounts = append(params.Discounts, &stripe.CheckoutSessionDiscountParams{PromotionCode: stripe.String(d.promo.ProviderID)})
+		} else {
+			params.Discounts = append(params.Discounts, &stripe.CheckoutSessionDiscountParams{Coupon: stripe.String(d.coupon.ProviderID)})
+		}
+	}
+
+	if request.AllowPromotionCodes {
+		params.AllowPromotionCodes = stripe.Bool(true)
+	}
+
+	if item := recurringCheckoutItem(items); item != nil {
+		var trialEnd *int64
+
+		if item.price.TrialDays > 0 {
+			// we add one day of grace so that stripe displays the correct amount.
+			// since trial end is calculated from current time, being one second off will result in days -1 being displayed in stripe checkout
+			trialEnd = stripe.Int64(item.price.TrialEnd().Add(time.Hour * 24).Unix())
+		}
+
+		params.Mode = stripe.String(string(stripe.CheckoutSessionModeSubscription))
+		params.PaymentMethodCollection = stripe.String("if_required")
+		params.SubscriptionData = &stripe.CheckoutSessionSubscriptionDataParams{
 			TrialEnd: trialEnd,
-		},
+			Metadata: map[string]string{basePriceMetadataKey: item.price.ProviderID},
+		}
+	} else {
+		// one time prices are paid for immediately, a Purchase is recorded once the session completes
+		params.Mode = stripe.String(string(stripe.CheckoutSessionModePayment))
 	}
 
 	sess, err := session.New(params)
@@ -192,25 +1035,12 @@ func (s *StripeProvider) Checkout(request *CheckoutRequest) (url string, err err
 		return
 	}
 
+	cs := newCheckoutSession(ProviderStripe, sess.ID, sess.URL, customer, items, request)
+	cs.CreatedAt = time.Unix(sess.Created, 0)
+	if err = s.addCheckoutSession(ctx, cs); err != nil {
+		return
+	}
+
 	url = sess.URL
 	return
 }
-
-// this should go here
-func (StripeProvider) convertPricingSchedule(p *stripe.Price) PricingSchedule {
-	switch p.Type {
-	case stripe.PriceTypeOneTime:
-		return PricingOnce
-	case stripe.PriceTypeRecurring:
-		switch p.Recurring.Interval {
-		case stripe.PriceRecurringIntervalMonth:
-			return PricingMonthly
-		case stripe.PriceRecurringIntervalYear:
-			return PricingAnnual
-		default:
-			return ""
-		}
-	default:
-		return ""
-	}
-}
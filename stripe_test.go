@@ -0,0 +1,32 @@
+package pay
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitAmount(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int64
+		quotes []int64
+		want   []int64
+	}{
+		{"single item", 400, []int64{500}, []int64{400}},
+		{"by quote", 1000, []int64{300, 700}, []int64{300, 700}},
+		{"discounted", 900, []int64{500, 500}, []int64{450, 450}},
+		{"rounding left to last", 1000, []int64{1, 1, 1}, []int64{333, 333, 334}},
+		{"free item", 100, []int64{0, 100}, []int64{0, 100}},
+		{"nothing quoted", 500, []int64{0, 0}, []int64{500, 0}},
+		{"nothing paid", 0, []int64{300, 700}, []int64{0, 0}},
+		{"no items", 500, []int64{}, []int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitAmount(tt.amount, tt.quotes); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,1392 @@
+// Package stripetest provides a local stand-in for the subset of the Stripe REST API used by pay.
+//
+// The Server points stripe-go at itself so that the StripeProvider can be exercised without network access.
+// Any object created, updated or deleted through the API is delivered as a correctly signed event to the
+// webhook registered with SetWebhook.
+package stripetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/webhook"
+)
+
+var ErrNotFound = errors.New("stripetest: object not found")
+
+type (
+	// Object is the json representation of a stripe object
+	Object = map[string]any
+
+	// Server is a local stand-in for the stripe api
+	Server struct {
+		URL string
+
+		srv     *httptest.Server
+		prev    stripe.Backend
+		mu      sync.Mutex
+		seq     int
+		objects map[string]map[string]Object
+		order   map[string][]string
+		items   map[string][]Object // checkout session line items
+		subData map[string]Object   // checkout session subscription data
+		coupons map[string]Object   // checkout session discounts
+		usage   map[string][]Object // usage records by subscription item
+		keys    map[string]Object   // usage records by idempotency key
+		webhook http.Handler
+		secret  string
+	}
+
+	resource struct {
+		object string // value of the object field
+		prefix string // prefix of generated ids
+		event  string // prefix of the event types, no events are sent when empty
+		create func(s *Server, o Object) error
+		update func(s *Server, o, params Object) error // applies params that can't be merged into o
+		cancel func(o Object)                          // marks o as canceled on delete requests instead of removing it
+		listed func(o, params Object) bool             // reports whether o is included in lists, all objects are when nil
+		events func(s *Server, o Object) []event       // additional events sent when o is created, such as for objects it changed
+	}
+
+	event struct {
+		typ string
+		obj Object
+	}
+)
+
+var resources = map[string]*resource{
+	"products":          {object: "product", prefix: "prod", event: "product", create: createProduct},
+	"prices":            {object: "price", prefix: "price", event: "price", create: createPrice},
+	"customers":         {object: "customer", prefix: "cus", event: "customer"},
+	"subscriptions":     {object: "subscription", prefix: "sub", event: "customer.subscription", update: updateSubscription, cancel: cancelSubscription, listed: listSubscription},
+	"checkout/sessions": {object: "checkout.session", prefix: "cs", create: createCheckoutSession},
+	"invoices":          {object: "invoice", prefix: "in", event: "invoice"},
+	"charges":           {object: "charge", prefix: "ch", event: "charge"},
+	"disputes":          {object: "dispute", prefix: "dp", event: "charge.dispute"},
+	"refunds":           {object: "refund", prefix: "re", create: createRefund, listed: listRefund, events: refundEvents},
+	"coupons":           {object: "coupon", prefix: "co", event: "coupon", create: createCoupon},
+	"promotion_codes":   {object: "promotion_code", prefix: "promo", event: "promotion_code", create: createPromotionCode},
+
+	"billing_portal/sessions":       {object: "billing_portal.session", prefix: "bps", create: createPortalSession},
+	"billing_portal/configurations": {object: "billing_portal.configuration", prefix: "bpc", create: createPortalConfiguration},
+}
+
+// form values that are sent as strings but are numbers or booleans in stripe objects
+var (
+	intKeys = map[string]bool{
+		"amount": true, "amount_off": true, "amount_total": true, "created": true, "duration_in_months": true, "expires_at": true,
+		"flat_amount": true, "interval_count": true, "max_redemptions": true, "quantity": true, "redeem_by": true,
+		"resumes_at": true, "subscription_proration_date": true, "timestamp": true, "trial_end": true, "trial_period_days": true, "unit_amount": true, "up_to": true,
+	}
+	boolKeys = map[string]bool{
+		"active": true, "allow_promotion_codes": true, "cancel_at_period_end": true, "enabled": true, "livemode": true,
+	}
+	floatKeys = map[string]bool{
+		"percent_off": true,
+	}
+)
+
+// NewServer starts a server and sets it as the stripe-go api backend.
+// Close restores the previous backend.
+func NewServer() *Server {
+	s := &Server{
+		objects: make(map[string]map[string]Object),
+		order:   make(map[string][]string),
+		items:   make(map[string][]Object),
+		subData: make(map[string]Object),
+		coupons: make(map[string]Object),
+		usage:   make(map[string][]Object),
+		keys:    make(map[string]Object),
+	}
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	s.prev = stripe.GetBackend(stripe.APIBackend)
+
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(s.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+		LeveledLogger:     &stripe.LeveledLogger{Level: stripe.LevelNull},
+	}))
+
+	return s
+}
+
+// Close shuts down the server and restores the previous stripe-go backend
+func (s *Server) Close() {
+	stripe.SetBackend(stripe.APIBackend, s.prev)
+	s.srv.Close()
+}
+
+// SetWebhook registers the handler that receives signed events, usually the result of StripeProvider.Webhook
+func (s *Server) SetWebhook(h http.Handler, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhook = h
+	s.secret = secret
+}
+
+// Get returns a copy of the stored object.
+// Resource is the api path of the object such as products or checkout/sessions.
+func (s *Server) Get(resource, id string) (Object, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[resource][id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return clone(o), nil
+}
+
+// Update merges fields into the stored object and sends the corresponding updated event
+func (s *Server) Update(resource, id string, fields Object) error {
+	s.mu.Lock()
+	o, ok := s.objects[resource][id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+
+	for k, v := range fields {
+		o[k] = v
+	}
+
+	res := resources[resource]
+	obj := clone(o)
+	s.mu.Unlock()
+
+	if res.event == "" {
+		return nil
+	}
+
+	return s.Send(res.event+".updated", obj)
+}
+
+// CompleteCheckoutSession pays the session as the customer would by visiting its url.
+// In subscription mode a subscription to the line items is created along with its paid first invoice
+// and the subscription id is returned, in payment mode the session is given a payment intent.
+func (s *Server) CompleteCheckoutSession(id string) (string, error) {
+	s.mu.Lock()
+
+	sess, ok := s.objects["checkout/sessions"][id]
+	if !ok {
+		s.mu.Unlock()
+		return "", ErrNotFound
+	}
+
+	var (
+		events []event
+		subID  string
+	)
+
+	if sess["mode"] == "subscription" {
+		var (
+			data []any
+			end  = time.Now().AddDate(0, 1, 0)
+		)
+
+		for _, item := range s.items[id] {
+			pr, ok := s.objects["prices"][fmt.Sprint(item["price"])]
+			if !ok {
+				s.mu.Unlock()
+				return "", fmt.Errorf("stripetest: price %v not found", item["price"])
+			}
+
+			// one time prices are only charged on the first invoice
+			rec, ok := pr["recurring"].(Object)
+			if !ok {
+				continue
+			}
+
+			data = append(data, Object{
+				"id":       s.nextID("si"),
+				"object":   "subscription_item",
+				"price":    clone(pr),
+				"quantity": item["quantity"],
+			})
+
+			end = periodEnd(time.Now(), rec)
+		}
+
+		now := time.Now().Unix()
+		sub := Object{
+			"customer":             sess["customer"],
+			"status":               "active",
+			"cancel_at_period_end": false,
+			"current_period_start": now,
+			"current_period_end":   end.Unix(),
+			"items": Object{
+				"object":   "list",
+				"data":     data,
+				"has_more": false,
+				"url":      "/v1/subscription_items",
+			},
+		}
+
+		if md, ok := s.subData[id]["metadata"].(Object); ok {
+			sub["metadata"] = md
+		}
+
+		// the first period of a trial lasts until the trial ends
+		if end := num(s.subData[id]["trial_end"]); end > now {
+			sub["status"] = "trialing"
+			sub["trial_start"] = now
+			sub["trial_end"] = end
+			sub["current_period_end"] = end
+		}
+
+		s.store("subscriptions", sub)
+		subID = sub["id"].(string)
+		sess["subscription"] = subID
+		if d := s.redeem(id); d != nil {
+			d["subscription"] = subID
+			sub["discount"] = d
+		}
+		events = append(events, event{typ: "customer.subscription.created", obj: clone(sub)})
+
+		// nothing is charged until the trial ends
+		amount := num(sess["amount_total"])
+		if sub["status"] == "trialing" {
+			amount = 0
+		}
+
+		inv := Object{
+			"customer":     sess["customer"],
+			"subscription": subID,
+			"status":       "paid",
+			"amount_due":   amount,
+			"amount_paid":  amount,
+			"currency":     sess["currency"],
+			"period_start": sub["current_period_start"],
+			"period_end":   sub["current_period_end"],
+		}
+
+		s.store("invoices", inv)
+		inv["number"] = fmt.Sprintf("TEST-%04d", len(s.order["invoices"]))
+		inv["hosted_invoice_url"] = fmt.Sprintf("%s/invoices/%s", s.URL, inv["id"])
+		inv["invoice_pdf"] = fmt.Sprintf("%s/invoices/%s/pdf", s.URL, inv["id"])
+		events = append(events, event{typ: "invoice.paid", obj: clone(inv)})
+
+		if amount > 0 {
+			ch := s.storeCharge(sess, amount)
+			ch["invoice"] = inv["id"]
+			inv["charge"] = ch["id"]
+			events = append(events, event{typ: "charge.succeeded", obj: clone(ch)})
+		}
+	} else {
+		s.redeem(id)
+		sess["payment_intent"] = s.nextID("pi")
+		ch := s.storeCharge(sess, num(sess["amount_total"]))
+		ch["payment_intent"] = sess["payment_intent"]
+		events = append(events, event{typ: "charge.succeeded", obj: clone(ch)})
+	}
+
+	sess["status"] = "complete"
+	sess["payment_status"] = "paid"
+	events = append(events, event{typ: "checkout.session.completed", obj: clone(sess)})
+	s.mu.Unlock()
+
+	return subID, s.send(events)
+}
+
+// redeem counts the redemption of the discount of the checkout session returning the discount, nil when it has none
+func (s *Server) redeem(sessionID string) Object {
+	discount, ok := s.coupons[sessionID]
+	if !ok {
+		return nil
+	}
+
+	delete(s.coupons, sessionID)
+
+	c := s.objects["coupons"][fmt.Sprint(discount["coupon"])]
+	c["times_redeemed"] = num(c["times_redeemed"]) + 1
+
+	now := time.Now()
+	d := Object{
+		"id":       s.nextID("di"),
+		"object":   "discount",
+		"coupon":   clone(c),
+		"customer": s.objects["checkout/sessions"][sessionID]["customer"],
+		"start":    now.Unix(),
+	}
+
+	if c["duration"] == "repeating" {
+		d["end"] = now.AddDate(0, int(num(c["duration_in_months"])), 0).Unix()
+	}
+
+	if id, ok := discount["promotion_code"]; ok {
+		promo := s.objects["promotion_codes"][fmt.Sprint(id)]
+		promo["times_redeemed"] = num(promo["times_redeemed"]) + 1
+		d["promotion_code"] = id
+	}
+
+	return d
+}
+
+// storeCharge stores a successful charge of amount to the customer of the session
+func (s *Server) storeCharge(sess Object, amount int64) Object {
+	ch := Object{
+		"customer":        sess["customer"],
+		"amount":          amount,
+		"amount_refunded": int64(0),
+		"currency":        sess["currency"],
+		"status":          "succeeded",
+		"paid":            true,
+		"captured":        true,
+		"refunded":        false,
+	}
+
+	s.store("charges", ch)
+	return ch
+}
+
+// DisputeCharge opens a dispute for the whole amount of the charge as happens when the customer contacts their bank
+func (s *Server) DisputeCharge(chargeID, reason string) (string, error) {
+	s.mu.Lock()
+
+	ch, ok := s.objects["charges"][chargeID]
+	if !ok {
+		s.mu.Unlock()
+		return "", ErrNotFound
+	}
+
+	dp := Object{
+		"charge":   chargeID,
+		"amount":   ch["amount"],
+		"currency": ch["currency"],
+		"reason":   reason,
+		"status":   "needs_response",
+		"evidence_details": Object{
+			"due_by":           time.Now().AddDate(0, 0, 7).Unix(),
+			"has_evidence":     false,
+			"past_due":         false,
+			"submission_count": 0,
+		},
+	}
+
+	s.store("disputes", dp)
+	ch["disputed"] = true
+	obj := clone(dp)
+	s.mu.Unlock()
+
+	return dp["id"].(string), s.Send("charge.dispute.created", obj)
+}
+
+// CloseDispute decides the dispute in favor of the merchant when won is set
+func (s *Server) CloseDispute(id string, won bool) error {
+	s.mu.Lock()
+
+	dp, ok := s.objects["disputes"][id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+
+	dp["status"] = "lost"
+	if won {
+		dp["status"] = "won"
+	}
+
+	obj := clone(dp)
+	s.mu.Unlock()
+
+	return s.Send("charge.dispute.closed", obj)
+}
+
+// UsageRecords returns the usage records reported for the subscription item in the order they were received
+func (s *Server) UsageRecords(itemID string) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []Object
+	for _, ur := range s.usage[itemID] {
+		records = append(records, clone(ur))
+	}
+
+	return records
+}
+
+// ExpireCheckoutSession expires an open session as happens when the customer abandons it
+func (s *Server) ExpireCheckoutSession(id string) error {
+	s.mu.Lock()
+
+	sess, ok := s.objects["checkout/sessions"][id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+
+	sess["status"] = "expired"
+	obj := clone(sess)
+	s.mu.Unlock()
+
+	return s.Send("checkout.session.expired", obj)
+}
+
+// Send delivers a signed event with the given type and object to the registered webhook
+func (s *Server) Send(eventType string, object any) error {
+	s.mu.Lock()
+	h, secret := s.webhook, s.secret
+	id := s.nextID("evt")
+	s.mu.Unlock()
+
+	if h == nil {
+		return nil
+	}
+
+	payload, err := json.Marshal(Object{
+		"id":               id,
+		"object":           "event",
+		"api_version":      stripe.APIVersion,
+		"created":          time.Now().Unix(),
+		"type":             eventType,
+		"livemode":         false,
+		"pending_webhooks": 0,
+		"data":             Object{"object": object},
+	})
+	if err != nil {
+		return err
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  secret,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", signed.Header)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return fmt.Errorf("stripetest: webhook responded to %s with status %d", eventType, rec.Code)
+	}
+
+	return nil
+}
+
+func (s *Server) send(events []event) error {
+	for _, ev := range events {
+		if err := s.Send(ev.typ, ev.obj); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	name, id := path, ""
+
+	if _, ok := resources[name]; !ok {
+		if i := strings.LastIndex(path, "/"); i > 0 {
+			name, id = path[:i], path[i+1:]
+		}
+	}
+
+	if path == "invoices/upcoming" && r.Method == http.MethodGet {
+		s.mu.Lock()
+		inv, err := s.upcomingInvoice(decodeForm(r.Form))
+		s.mu.Unlock()
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inv)
+		return
+	}
+
+	if strings.HasPrefix(name, "subscription_items/") && id == "usage_records" && r.Method == http.MethodPost {
+		s.mu.Lock()
+		ur, err := s.createUsageRecord(strings.TrimPrefix(name, "subscription_items/"), r.Header.Get("Idempotency-Key"), decodeForm(r.Form))
+		s.mu.Unlock()
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ur)
+		return
+	}
+
+	if strings.HasPrefix(name, "checkout/sessions/") && id == "line_items" && r.Method == http.MethodGet {
+		s.mu.Lock()
+		list, err := s.lineItems(strings.TrimPrefix(name, "checkout/sessions/"))
+		s.mu.Unlock()
+
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	res, ok := resources[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unrecognized request url (%s: %s)", r.Method, r.URL.Path))
+		return
+	}
+
+	params := decodeForm(r.Form)
+	delete(params, "expand")
+
+	s.mu.Lock()
+
+	var (
+		resp   any
+		events []event
+		status = http.StatusOK
+	)
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		resp = s.list(name, params)
+	case r.Method == http.MethodGet:
+		o, ok := s.objects[name][id]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+		resp = clone(o)
+	case r.Method == http.MethodPost && id == "":
+		if res.create != nil {
+			if err := res.create(s, params); err != nil {
+				s.mu.Unlock()
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		s.store(name, params)
+		resp = clone(params)
+		events = append(events, event{typ: res.event + ".created", obj: clone(params)})
+	case r.Method == http.MethodPost:
+		o, ok := s.objects[name][id]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+
+		if res.update != nil {
+			if err := res.update(s, o, params); err != nil {
+				s.mu.Unlock()
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+
+		merge(o, params)
+		resp = clone(o)
+		events = append(events, event{typ: res.event + ".updated", obj: clone(o)})
+	case r.Method == http.MethodDelete:
+		o, ok := s.objects[name][id]
+		if !ok {
+			status = http.StatusNotFound
+			break
+		}
+
+		if res.cancel != nil {
+			res.cancel(o)
+			resp = clone(o)
+		} else {
+			s.remove(name, id)
+			resp = Object{"id": id, "object": res.object, "deleted": true}
+		}
+
+		events = append(events, event{typ: res.event + ".deleted", obj: clone(o)})
+	default:
+		status = http.StatusMethodNotAllowed
+	}
+
+	if res.event == "" {
+		events = nil
+	}
+
+	if res.events != nil && r.Method == http.MethodPost && id == "" && status == http.StatusOK {
+		events = append(events, res.events(s, resp.(Object))...)
+	}
+
+	s.mu.Unlock()
+
+	if status != http.StatusOK {
+		writeError(w, status, fmt.Sprintf("no such %s: '%s'", res.object, id))
+		return
+	}
+
+	if err := s.send(events); err != nil {
+		log.Printf("stripetest: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) store(name string, o Object) {
+	res := resources[name]
+	if _, ok := o["id"]; !ok {
+		o["id"] = s.nextID(res.prefix)
+	}
+
+	o["object"] = res.object
+	o["livemode"] = false
+
+	if _, ok := o["created"]; !ok {
+		o["created"] = time.Now().Unix()
+	}
+
+	if _, ok := o["metadata"]; !ok {
+		o["metadata"] = Object{}
+	}
+
+	if s.objects[name] == nil {
+		s.objects[name] = make(map[string]Object)
+	}
+
+	s.objects[name][o["id"].(string)] = o
+	s.order[name] = append(s.order[name], o["id"].(string))
+}
+
+func (s *Server) remove(name, id string) {
+	delete(s.objects[name], id)
+
+	ids := s.order[name][:0]
+	for _, v := range s.order[name] {
+		if v != id {
+			ids = append(ids, v)
+		}
+	}
+
+	s.order[name] = ids
+}
+
+func (s *Server) list(name string, params Object) Object {
+	listed := resources[name].listed
+
+	data := []any{}
+	for _, id := range s.order[name] {
+		o := s.objects[name][id]
+		if listed == nil || listed(o, params) {
+			data = append(data, clone(o))
+		}
+	}
+
+	return Object{
+		"object":   "list",
+		"data":     data,
+		"has_more": false,
+		"url":      "/v1/" + name,
+	}
+}
+
+// lineItems lists the line items of the checkout session, which are left out of the session itself
+func (s *Server) lineItems(sessionID string) (Object, error) {
+	items, ok := s.items[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("no such checkout.session: '%s'", sessionID)
+	}
+
+	data := []any{}
+	for _, item := range items {
+		pr := s.objects["prices"][fmt.Sprint(item["price"])]
+		data = append(data, Object{
+			"id":       item["id"],
+			"object":   "item",
+			"price":    clone(pr),
+			"quantity": item["quantity"],
+			"currency": pr["currency"],
+		})
+	}
+
+	return Object{
+		"object":   "list",
+		"data":     data,
+		"has_more": false,
+		"url":      fmt.Sprintf("/v1/checkout/sessions/%s/line_items", sessionID),
+	}, nil
+}
+
+func (s *Server) nextID(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s_%d", prefix, s.seq)
+}
+
+func createProduct(s *Server, o Object) error {
+	if _, ok := o["active"]; !ok {
+		o["active"] = true
+	}
+
+	return nil
+}
+
+func createPrice(s *Server, o Object) error {
+	if _, ok := s.objects["products"][fmt.Sprint(o["product"])]; !ok {
+		return fmt.Errorf("no such product: '%v'", o["product"])
+	}
+
+	if _, ok := o["active"]; !ok {
+		o["active"] = true
+	}
+
+	if _, ok := o["billing_scheme"]; !ok {
+		o["billing_scheme"] = "per_unit"
+	}
+
+	// the last tier is sent as up_to=inf and returned as null
+	if tiers, ok := o["tiers"].([]any); ok {
+		for _, v := range tiers {
+			if tier, ok := v.(Object); ok && tier["up_to"] == "inf" {
+				tier["up_to"] = nil
+			}
+		}
+	}
+
+	o["type"] = "one_time"
+	if rec, ok := o["recurring"].(Object); ok {
+		o["type"] = "recurring"
+		if _, ok := rec["interval_count"]; !ok {
+			rec["interval_count"] = 1
+		}
+
+		if _, ok := rec["usage_type"]; !ok {
+			rec["usage_type"] = "licensed"
+		}
+
+		if rec["usage_type"] == "metered" {
+			if _, ok := rec["aggregate_usage"]; !ok {
+				rec["aggregate_usage"] = "sum"
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateSubscription changes the price or quantity of the subscription items
+func updateSubscription(s *Server, o, params Object) error {
+	list, _ := params["items"].([]any)
+	delete(params, "items")
+	delete(params, "proration_behavior")
+	delete(params, "proration_date")
+
+	items, _ := o["items"].(Object)
+	data, _ := items["data"].([]any)
+
+	for _, v := range list {
+		change, ok := v.(Object)
+		if !ok {
+			continue
+		}
+
+		var item Object
+		for _, d := range data {
+			if d, ok := d.(Object); ok && change["id"] != nil && d["id"] == change["id"] {
+				item = d
+			}
+		}
+
+		if item == nil {
+			item = Object{"id": s.nextID("si"), "object": "subscription_item", "quantity": int64(1)}
+			data = append(data, item)
+		}
+
+		if id, ok := change["price"]; ok {
+			pr, ok := s.objects["prices"][fmt.Sprint(id)]
+			if !ok {
+				return fmt.Errorf("no such price: '%v'", id)
+			}
+			item["price"] = clone(pr)
+		}
+
+		if q, ok := change["quantity"]; ok {
+			item["quantity"] = q
+		}
+	}
+
+	if items != nil {
+		items["data"] = data
+	}
+
+	return nil
+}
+
+// createUsageRecord reports usage of a metered subscription item.
+// Requests with an idempotency key that was seen before return the record created by the first one
+func (s *Server) createUsageRecord(itemID, key string, params Object) (Object, error) {
+	if ur, ok := s.keys[key]; ok && key != "" {
+		return clone(ur), nil
+	}
+
+	found := false
+	for _, sub := range s.objects["subscriptions"] {
+		items, _ := sub["items"].(Object)
+		data, _ := items["data"].([]any)
+		for _, v := range data {
+			if item, ok := v.(Object); ok && item["id"] == itemID {
+				found = true
+			}
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("no such subscription item: '%s'", itemID)
+	}
+
+	action, _ := params["action"].(string)
+	if action == "" {
+		action = "increment"
+	}
+
+	ur := Object{
+		"id":                s.nextID("mbur"),
+		"object":            "usage_record",
+		"subscription_item": itemID,
+		"action":            action,
+		"quantity":          num(params["quantity"]),
+		"timestamp":         num(params["timestamp"]),
+		"livemode":          false,
+	}
+
+	s.usage[itemID] = append(s.usage[itemID], ur)
+	if key != "" {
+		s.keys[key] = ur
+	}
+
+	return clone(ur), nil
+}
+
+// upcomingInvoice previews the next invoice of a subscription as it would be with the changes in params.
+// Prorations are calculated on the fraction of the current period left at the proration date
+func (s *Server) upcomingInvoice(params Object) (Object, error) {
+	subID := fmt.Sprint(params["subscription"])
+	sub, ok := s.objects["subscriptions"][subID]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: '%s'", subID)
+	}
+
+	changes := map[string]Object{}
+	if list, ok := params["subscription_items"].([]any); ok {
+		for _, v := range list {
+			if change, ok := v.(Object); ok {
+				changes[fmt.Sprint(change["id"])] = change
+			}
+		}
+	}
+
+	date := time.Now().Unix()
+	if d := num(params["subscription_proration_date"]); d > 0 {
+		date = d
+	}
+
+	start, end := num(sub["current_period_start"]), num(sub["current_period_end"])
+	left := 0.0
+	if end > start && date < end {
+		left = float64(end-date) / float64(end-start)
+	}
+
+	var (
+		lines    []any
+		total    int64
+		currency any
+	)
+
+	line := func(amount int64, proration bool, pr Object) {
+		total += amount
+		lines = append(lines, Object{
+			"id":        s.nextID("il"),
+			"object":    "line_item",
+			"amount":    amount,
+			"currency":  pr["currency"],
+			"proration": proration,
+			"price":     pr,
+			"period":    Object{"start": date, "end": end},
+		})
+	}
+
+	items, _ := sub["items"].(Object)
+	data, _ := items["data"].([]any)
+	for _, v := range data {
+		item, ok := v.(Object)
+		if !ok {
+			continue
+		}
+
+		prev, _ := item["price"].(Object)
+		next := prev
+		quantity := num(item["quantity"])
+
+		if change, ok := changes[fmt.Sprint(item["id"])]; ok {
+			if id, ok := change["price"]; ok {
+				pr, ok := s.objects["prices"][fmt.Sprint(id)]
+				if !ok {
+					return nil, fmt.Errorf("no such price: '%v'", id)
+				}
+				next = clone(pr)
+			}
+
+			if q, ok := change["quantity"]; ok {
+				quantity = num(q)
+			}
+
+			if params["subscription_proration_behavior"] != "none" {
+				line(-int64(float64(num(prev["unit_amount"])*num(item["quantity"]))*left), true, prev)
+				line(int64(float64(num(next["unit_amount"])*quantity)*left), true, next)
+			}
+		}
+
+		line(num(next["unit_amount"])*quantity, false, next)
+		currency = next["currency"]
+	}
+
+	return Object{
+		"object":       "invoice",
+		"customer":     sub["customer"],
+		"subscription": subID,
+		"currency":     currency,
+		"amount_due":   total,
+		"total":        total,
+		"lines": Object{
+			"object":   "list",
+			"data":     lines,
+			"has_more": false,
+			"url":      "/v1/invoices/upcoming/lines",
+		},
+	}, nil
+}
+
+// num reads a number from a stored object, cloned objects hold floats after the json round trip
+func num(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+
+	return 0
+}
+
+// periodEnd returns the end of the billing period of a price with the recurring params starting at start
+func periodEnd(start time.Time, rec Object) time.Time {
+	n := int(max(num(rec["interval_count"]), 1))
+	switch rec["interval"] {
+	case "day":
+		return start.AddDate(0, 0, n)
+	case "week":
+		return start.AddDate(0, 0, 7*n)
+	case "year":
+		return start.AddDate(n, 0, 0)
+	default:
+		return start.AddDate(0, n, 0)
+	}
+}
+
+// quote returns the amount of quantity units of the price
+func quote(pr Object, quantity int64) int64 {
+	tiers, _ := pr["tiers"].([]any)
+	if pr["billing_scheme"] != "tiered" {
+		return num(pr["unit_amount"]) * quantity
+	}
+
+	var total, from int64
+	for _, v := range tiers {
+		tier, _ := v.(Object)
+		upTo, bounded := tier["up_to"], tier["up_to"] != nil
+
+		if pr["tiers_mode"] == "volume" {
+			if !bounded || quantity <= num(upTo) {
+				return quantity*num(tier["unit_amount"]) + num(tier["flat_amount"])
+			}
+
+			continue
+		}
+
+		units := quantity - from
+		if bounded && num(upTo) < quantity {
+			units = num(upTo) - from
+		}
+
+		if units <= 0 {
+			break
+		}
+
+		total += units*num(tier["unit_amount"]) + num(tier["flat_amount"])
+		if !bounded {
+			break
+		}
+
+		from = num(upTo)
+	}
+
+	return total
+}
+
+// cancelSubscription ends the subscription immediately, canceled subscriptions can still be retrieved
+func cancelSubscription(o Object) {
+	now := time.Now().Unix()
+	o["status"] = "canceled"
+	o["canceled_at"] = now
+	o["ended_at"] = now
+}
+
+// listSubscription filters subscriptions by the status param, canceled subscriptions are only listed when asked for
+func listSubscription(o, params Object) bool {
+	switch status := params["status"]; status {
+	case nil:
+		return o["status"] != "canceled" && o["status"] != "incomplete_expired"
+	case "all":
+		return true
+	default:
+		return o["status"] == status
+	}
+}
+
+func createPortalSession(s *Server, o Object) error {
+	if _, ok := s.objects["customers"][fmt.Sprint(o["customer"])]; !ok {
+		return fmt.Errorf("no such customer: '%v'", o["customer"])
+	}
+
+	id := s.nextID("bps")
+	o["id"] = id
+	o["url"] = fmt.Sprintf("%s/portal/%s", s.URL, id)
+	return nil
+}
+
+func createPortalConfiguration(s *Server, o Object) error {
+	o["active"] = true
+	o["is_default"] = false
+	return nil
+}
+
+// createRefund refunds the charge, the whole amount left is refunded when no amount is given
+func createRefund(s *Server, o Object) error {
+	ch, ok := s.objects["charges"][fmt.Sprint(o["charge"])]
+	if !ok {
+		return fmt.Errorf("no such charge: '%v'", o["charge"])
+	}
+
+	left := num(ch["amount"]) - num(ch["amount_refunded"])
+	amount := left
+	if _, ok := o["amount"]; ok {
+		amount = num(o["amount"])
+	}
+
+	if amount <= 0 || amount > left {
+		return fmt.Errorf("refund amount (%d) is greater than unrefunded amount on charge (%d)", amount, left)
+	}
+
+	ch["amount_refunded"] = num(ch["amount_refunded"]) + amount
+	ch["refunded"] = num(ch["amount_refunded"]) == num(ch["amount"])
+
+	o["amount"] = amount
+	o["currency"] = ch["currency"]
+	o["status"] = "succeeded"
+	return nil
+}
+
+// refundEvents notifies of the refunded charge
+func refundEvents(s *Server, o Object) []event {
+	ch := s.objects["charges"][fmt.Sprint(o["charge"])]
+	return []event{
+		{typ: "refund.created", obj: clone(o)},
+		{typ: "charge.refunded", obj: clone(ch)},
+	}
+}
+
+// listRefund filters refunds by the charge param
+func listRefund(o, params Object) bool {
+	charge, ok := params["charge"]
+	return !ok || o["charge"] == charge
+}
+
+func createCheckoutSession(s *Server, o Object) error {
+	var items []Object
+	if list, ok := o["line_items"].([]any); ok {
+		for _, item := range list {
+			if item, ok := item.(Object); ok {
+				items = append(items, item)
+			}
+		}
+	}
+
+	if len(items) == 0 {
+		return errors.New("line_items is required")
+	}
+
+	// line items are only returned when expanded so they are stored separately
+	delete(o, "line_items")
+
+	data, _ := o["subscription_data"].(Object)
+	delete(o, "subscription_data")
+
+	var total int64
+	for _, item := range items {
+		pr, ok := s.objects["prices"][fmt.Sprint(item["price"])]
+		if !ok {
+			return fmt.Errorf("no such price: '%v'", item["price"])
+		}
+
+		// metered prices are billed for their usage at the end of the period
+		if rec, ok := pr["recurring"].(Object); ok && rec["usage_type"] == "metered" {
+			if _, ok := item["quantity"]; ok {
+				return errors.New("quantity is not allowed for metered prices")
+			}
+
+			continue
+		}
+
+		total += quote(pr, num(item["quantity"]))
+		o["currency"] = pr["currency"]
+	}
+
+	// discounts are applied to the subscription or payment once the session completes
+	var discount Object
+	if list, ok := o["discounts"].([]any); ok && len(list) > 0 {
+		if o["allow_promotion_codes"] == true {
+			return errors.New("you may only specify one of these parameters: allow_promotion_codes, discounts")
+		}
+
+		d, _ := list[0].(Object)
+		discount = Object{}
+		if id, ok := d["promotion_code"]; ok {
+			promo, ok := s.objects["promotion_codes"][fmt.Sprint(id)]
+			if !ok || promo["active"] != true {
+				return fmt.Errorf("no such promotion code: '%v'", id)
+			}
+
+			discount["promotion_code"] = promo["id"]
+			d = Object{"coupon": promo["coupon"].(Object)["id"]}
+		}
+
+		c, ok := s.objects["coupons"][fmt.Sprint(d["coupon"])]
+		if !ok {
+			return fmt.Errorf("no such coupon: '%v'", d["coupon"])
+		}
+
+		discount["coupon"] = c["id"]
+		total -= discountAmount(c, total)
+	}
+
+	delete(o, "discounts")
+
+	for _, item := range items {
+		item["id"] = s.nextID("li")
+	}
+
+	id := s.nextID("cs")
+	o["id"] = id
+	o["amount_total"] = total
+	o["status"] = "open"
+	o["payment_status"] = "unpaid"
+	o["url"] = fmt.Sprintf("%s/pay/%s", s.URL, id)
+	s.items[id] = items
+	s.subData[id] = data
+	if discount != nil {
+		s.coupons[id] = discount
+	}
+
+	return nil
+}
+
+func createCoupon(s *Server, o Object) error {
+	percent, _ := o["percent_off"].(float64)
+	if (percent > 0) == (num(o["amount_off"]) > 0) {
+		return errors.New("you must pass either percent_off or amount_off")
+	}
+
+	if _, ok := o["duration"]; !ok {
+		o["duration"] = "once"
+	}
+
+	o["valid"] = true
+	o["times_redeemed"] = int64(0)
+	return nil
+}
+
+// createPromotionCode includes the coupon in the promotion code as stripe does
+func createPromotionCode(s *Server, o Object) error {
+	c, ok := s.objects["coupons"][fmt.Sprint(o["coupon"])]
+	if !ok {
+		return fmt.Errorf("no such coupon: '%v'", o["coupon"])
+	}
+
+	o["coupon"] = clone(c)
+	if _, ok := o["active"]; !ok {
+		o["active"] = true
+	}
+
+	if _, ok := o["code"]; !ok {
+		o["code"] = fmt.Sprintf("TEST%d", s.seq+1)
+	}
+
+	o["times_redeemed"] = int64(0)
+	return nil
+}
+
+// discountAmount returns the amount taken off of amount by the coupon
+func discountAmount(c Object, amount int64) int64 {
+	if off := num(c["amount_off"]); off > 0 {
+		return min(off, amount)
+	}
+
+	percent, _ := c["percent_off"].(float64)
+	return int64(math.Round(float64(amount) * percent / 100))
+}
+
+// decodeForm converts stripe form encoding such as line_items[0][price] into nested objects
+func decodeForm(form map[string][]string) Object {
+	root := Object{}
+
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		parts := strings.Split(strings.ReplaceAll(key, "]", ""), "[")
+		node := root
+		for i, part := range parts {
+			if i == len(parts)-1 {
+				node[part] = coerce(parts, form[key][0])
+				break
+			}
+
+			child, ok := node[part].(Object)
+			if !ok {
+				child = Object{}
+				node[part] = child
+			}
+
+			node = child
+		}
+	}
+
+	return arrays(root).(Object)
+}
+
+// arrays converts objects whose keys are all indexes into slices
+func arrays(v any) any {
+	o, ok := v.(Object)
+	if !ok {
+		return v
+	}
+
+	indexed := len(o) > 0
+	for k, child := range o {
+		o[k] = arrays(child)
+		if _, err := strconv.Atoi(k); err != nil {
+			indexed = false
+		}
+	}
+
+	if !indexed {
+		return o
+	}
+
+	list := make([]any, len(o))
+	for k, child := range o {
+		i, _ := strconv.Atoi(k)
+		if i < len(list) {
+			list[i] = child
+		}
+	}
+
+	return list
+}
+
+func coerce(path []string, val string) any {
+	key := path[len(path)-1]
+
+	for _, p := range path[:len(path)-1] {
+		if p == "metadata" {
+			return val
+		}
+	}
+
+	if val == "" {
+		return nil
+	}
+
+	if intKeys[key] {
+		if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+			return n
+		}
+	}
+
+	if boolKeys[key] {
+		if b, err := strconv.ParseBool(val); err == nil {
+			return b
+		}
+	}
+
+	if floatKeys[key] {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+
+	return val
+}
+
+func merge(dst, src Object) {
+	for k, v := range src {
+		if child, ok := v.(Object); ok {
+			if prev, ok := dst[k].(Object); ok {
+				merge(prev, child)
+				continue
+			}
+		}
+
+		dst[k] = v
+	}
+}
+
+func clone(o Object) Object {
+	b, _ := json.Marshal(o)
+	var c Object
+	json.Unmarshal(b, &c)
+	return c
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Object{
+		"error": Object{
+			"type":    "invalid_request_error",
+			"message": msg,
+		},
+	})
+}
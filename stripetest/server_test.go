@@ -0,0 +1,375 @@
+package stripetest_test
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cristosal/pay"
+	"github.com/cristosal/pay/stripetest"
+	_ "github.com/lib/pq"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/checkout/session"
+	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/price"
+	"github.com/stripe/stripe-go/v74/product"
+	"github.com/stripe/stripe-go/v74/subscription"
+)
+
+const secret = "whsec_test"
+
+// testProvider returns a stripe provider storing its entities on a freshly migrated schema of the database in PAY_TEST_DATABASE,
+// the test is skipped when it is not set
+func testProvider(t *testing.T) *pay.StripeProvider {
+	t.Helper()
+
+	dsn := os.Getenv("PAY_TEST_DATABASE")
+	if dsn == "" {
+		t.Skip("PAY_TEST_DATABASE is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	if _, err := db.Exec("DROP SCHEMA IF EXISTS " + pay.DefaultSchema + " CASCADE"); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := pay.NewEntityRepo(db)
+	if err := repo.InitContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := pay.NewStripeProvider(&pay.StripeConfig{
+		Repo:          repo,
+		Key:           "sk_test",
+		WebhookSecret: secret,
+	})
+
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	provider := testProvider(t)
+
+	srv := stripetest.NewServer()
+	defer srv.Close()
+
+	// no webhook is registered so the state only reaches the repo through Sync
+	prod, err := product.New(&stripe.ProductParams{Name: stripe.String("Basic"), Active: stripe.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := price.New(&stripe.PriceParams{
+		Currency:   stripe.String("usd"),
+		UnitAmount: stripe.Int64(1000),
+		Product:    stripe.String(prod.ID),
+		Recurring:  &stripe.PriceRecurringParams{Interval: stripe.String("month")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cust, err := customer.New(&stripe.CustomerParams{Name: stripe.String("Jane"), Email: stripe.String("jane@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := session.New(&stripe.CheckoutSessionParams{
+		Customer:   stripe.String(cust.ID),
+		SuccessURL: stripe.String("https://example.com/success"),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:  []*stripe.CheckoutSessionLineItemParams{{Price: stripe.String(pr.ID), Quantity: stripe.Int64(2)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subID, err := srv.CompleteCheckoutSession(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := provider.SyncContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := provider.GetPlanByProviderIDContext(ctx, pay.ProviderStripe, prod.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := provider.GetPriceByProviderContext(ctx, pay.ProviderStripe, pr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.PlanID != pl.ID || p.Amount != 1000 || p.Interval != pay.IntervalMonth {
+		t.Fatalf("unexpected price %+v", p)
+	}
+
+	c, err := provider.GetCustomerByProviderContext(ctx, pay.ProviderStripe, cust.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := provider.GetSubscriptionByProviderContext(ctx, pay.ProviderStripe, subID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.CustomerID != c.ID || sub.PriceID != p.ID || sub.Quantity != 2 || !sub.Active {
+		t.Fatalf("unexpected subscription %+v", sub)
+	}
+
+	invoices, err := provider.ListInvoicesByCustomerID(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invoices) != 1 || invoices[0].AmountPaid != 2000 {
+		t.Fatalf("expected one paid invoice of 2000, got %+v", invoices)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	provider := testProvider(t)
+
+	srv := stripetest.NewServer()
+	defer srv.Close()
+
+	// without a worker the events received are only handled by ProcessWebhookEvents
+	provider.Close()
+	srv.SetWebhook(provider.Webhook(), secret)
+
+	var completed []*pay.CheckoutSession
+	provider.OnCheckoutCompleted(func(cs *pay.CheckoutSession) { completed = append(completed, cs) })
+
+	process := func() {
+		t.Helper()
+		if err := provider.ProcessWebhookEvents(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := provider.AddPlanContext(ctx, &pay.Plan{Name: "Basic", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	process()
+
+	pl, err := provider.GetPlanByNameContext(ctx, "Basic")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := pay.Price{PlanID: pl.ID, Amount: 1000, Currency: "usd", Interval: pay.IntervalMonth, IntervalCount: 1}
+	addon := pay.Price{PlanID: pl.ID, Amount: 500, Currency: "usd", Interval: pay.IntervalMonth, IntervalCount: 1}
+	for _, p := range []*pay.Price{&base, &addon} {
+		if err := provider.AddPriceContext(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := provider.AddCustomerContext(ctx, &pay.Customer{Name: "Jane", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	process()
+
+	prices, err := provider.ListPricesByPlanIDContext(ctx, pl.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prices) != 2 {
+		t.Fatalf("expected 2 prices, got %d", len(prices))
+	}
+
+	for _, p := range prices {
+		if p.Amount == 1000 {
+			base = p
+		} else {
+			addon = p
+		}
+	}
+
+	cust, err := provider.GetCustomerByEmailContext(ctx, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := provider.CheckoutContext(ctx, &pay.CheckoutRequest{
+		CustomerID:  cust.ID,
+		PriceID:     base.ID,
+		Quantity:    3,
+		Items:       []pay.CheckoutItem{{PriceID: addon.ID}},
+		RedirectURL: "https://example.com/success",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subID, err := srv.CompleteCheckoutSession(path.Base(url))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// events are stored when received and applied once processed
+	if len(completed) != 0 {
+		t.Fatal("expected the checkout to complete once events are processed")
+	}
+
+	process()
+
+	sub, err := provider.GetSubscriptionByProviderContext(ctx, pay.ProviderStripe, subID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.CustomerID != cust.ID || sub.PriceID != base.ID || sub.Quantity != 3 {
+		t.Fatalf("expected subscription for 3 seats of price %d, got %d seats of price %d", base.ID, sub.Quantity, sub.PriceID)
+	}
+
+	items, err := provider.ListSubscriptionItems(ctx, sub.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("expected the base and add-on items, got %+v", items)
+	}
+
+	if len(completed) != 1 || completed[0].Status != pay.CheckoutSessionComplete {
+		t.Fatalf("expected OnCheckoutCompleted once, got %+v", completed)
+	}
+
+	events, err := provider.ListAllWebhookEventsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events {
+		if e.Status != pay.WebhookEventProcessed {
+			t.Fatalf("event %s %s is %s: %s", e.ProviderID, e.EventType, e.Status, e.LastError)
+		}
+	}
+}
+
+func TestDeleteCustomerWithCanceledSubscription(t *testing.T) {
+	ctx := context.Background()
+	provider := testProvider(t)
+
+	srv := stripetest.NewServer()
+	defer srv.Close()
+
+	provider.Close()
+	srv.SetWebhook(provider.Webhook(), secret)
+
+	process := func() {
+		t.Helper()
+		if err := provider.ProcessWebhookEvents(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prod, err := product.New(&stripe.ProductParams{Name: stripe.String("Basic"), Active: stripe.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pr, err := price.New(&stripe.PriceParams{
+		Currency:   stripe.String("usd"),
+		UnitAmount: stripe.Int64(1000),
+		Product:    stripe.String(prod.ID),
+		Recurring:  &stripe.PriceRecurringParams{Interval: stripe.String("month")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cust, err := customer.New(&stripe.CustomerParams{Name: stripe.String("Jane"), Email: stripe.String("jane@example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := session.New(&stripe.CheckoutSessionParams{
+		Customer:   stripe.String(cust.ID),
+		SuccessURL: stripe.String("https://example.com/success"),
+		Mode:       stripe.String(string(stripe.CheckoutSessionModeSubscription)),
+		LineItems:  []*stripe.CheckoutSessionLineItemParams{{Price: stripe.String(pr.ID), Quantity: stripe.Int64(1)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subID, err := srv.CompleteCheckoutSession(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process()
+
+	if _, err := subscription.Cancel(subID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := customer.Del(cust.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	process()
+
+	events, err := provider.ListAllWebhookEventsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range events {
+		if e.Status != pay.WebhookEventProcessed {
+			t.Fatalf("event %s %s is %s: %s", e.ProviderID, e.EventType, e.Status, e.LastError)
+		}
+	}
+
+	// the deleted customer is no longer listed but is kept for its subscription
+	if err := provider.SyncContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := provider.GetCustomerByProviderContext(ctx, pay.ProviderStripe, cust.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DeletedAt == nil {
+		t.Fatal("expected the customer to be marked as deleted")
+	}
+
+	customers, err := provider.ListAllCustomersContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(customers) != 0 {
+		t.Fatalf("expected no customers to be listed, got %+v", customers)
+	}
+
+	sub, err := provider.GetSubscriptionByProviderContext(ctx, pay.ProviderStripe, subID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sub.CustomerID != c.ID || sub.Active {
+		t.Fatalf("expected the canceled subscription of the customer, got %+v", sub)
+	}
+}
@@ -1,70 +1,97 @@
 package pay
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"log"
+	"time"
 
-	"github.com/cristosal/orm"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/charge"
+	"github.com/stripe/stripe-go/v74/coupon"
 	"github.com/stripe/stripe-go/v74/customer"
+	"github.com/stripe/stripe-go/v74/dispute"
+	"github.com/stripe/stripe-go/v74/invoice"
 	"github.com/stripe/stripe-go/v74/price"
 	"github.com/stripe/stripe-go/v74/product"
+	"github.com/stripe/stripe-go/v74/promotioncode"
+	"github.com/stripe/stripe-go/v74/refund"
 	"github.com/stripe/stripe-go/v74/subscription"
 )
 
-// Sync repository data with stripe
+// Sync uses context.Background, to specify the context use SyncContext
 func (s *StripeProvider) Sync() error {
-	if err := s.syncCustomers(); err != nil {
+	return s.SyncContext(context.Background())
+}
+
+// SyncContext repository data with stripe
+func (s *StripeProvider) SyncContext(ctx context.Context) error {
+	if err := s.syncCustomers(ctx); err != nil {
 		return fmt.Errorf("error syncing customers: %w", err)
 	}
 
-	if err := s.syncPlans(); err != nil {
+	if err := s.syncPlans(ctx); err != nil {
 		return fmt.Errorf("error syncing plans: %w", err)
 	}
 
-	if err := s.syncPrices(); err != nil {
+	if err := s.syncPrices(ctx); err != nil {
 		return fmt.Errorf("error syncing prices: %w", err)
 	}
 
-	if err := s.syncSubscriptions(); err != nil {
+	if err := s.syncCoupons(ctx); err != nil {
+		return fmt.Errorf("error syncing coupons: %w", err)
+	}
+
+	if err := s.syncPromotionCodes(ctx); err != nil {
+		return fmt.Errorf("error syncing promotion codes: %w", err)
+	}
+
+	if err := s.syncSubscriptions(ctx); err != nil {
 		return fmt.Errorf("error syncing subscriptions: %w", err)
 	}
 
+	if err := s.syncInvoices(ctx); err != nil {
+		return fmt.Errorf("error syncing invoices: %w", err)
+	}
+
+	if err := s.syncCharges(ctx); err != nil {
+		return fmt.Errorf("error syncing charges: %w", err)
+	}
+
+	if err := s.syncRefunds(ctx); err != nil {
+		return fmt.Errorf("error syncing refunds: %w", err)
+	}
+
+	if err := s.syncDisputes(ctx); err != nil {
+		return fmt.Errorf("error syncing disputes: %w", err)
+	}
+
 	return nil
 }
 
-func (s *StripeProvider) syncPrices() error {
-	it := price.List(nil)
+func (s *StripeProvider) syncPrices(ctx context.Context) error {
+	params := &stripe.PriceListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	}
+
+	// tiers are only included when expanded
+	params.AddExpand("data.tiers")
+
+	it := price.List(params)
 	var ids []string
 
 	for it.Next() {
 		p := it.Price()
 		ids = append(ids, p.ID)
 
-		pr, err := s.convertPrice(p)
+		pr, err := s.convertPrice(ctx, p)
 		if err != nil {
 			log.Printf("error converting price %s: %v", p.ID, err)
 			continue
 		}
 
-		_, err = s.GetPriceByProvider(ProviderStripe, p.ID)
-
-		// we did not find the price for the provider
-		if errors.Is(err, orm.ErrNotFound) {
-			if err := s.addPrice(pr); err != nil {
-				log.Printf("error updating price %s: %v", pr.ProviderID, err)
-			}
-			continue
-		}
-
-		if err != nil {
-			log.Printf("error getting price %s: %v", p.ID, err)
-			continue
-		}
-
-		if err := s.updatePriceByProvider(pr); err != nil {
-			log.Printf("error adding price %s: %v", pr.ProviderID, err)
-			continue
+		if err := s.savePrice(ctx, pr); err != nil {
+			log.Printf("error saving price %s: %v", pr.ProviderID, err)
 		}
 	}
 
@@ -72,21 +99,23 @@ func (s *StripeProvider) syncPrices() error {
 		return err
 	}
 
-	return s.removePriceOrphans(ProviderStripe, ids)
+	return s.removePriceOrphans(ctx, ProviderStripe, ids)
 }
 
-func (s *StripeProvider) syncCustomers() error {
+func (s *StripeProvider) syncCustomers(ctx context.Context) error {
 	var ids []string
 
-	it := customer.List(nil)
+	it := customer.List(&stripe.CustomerListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
 	for it.Next() {
 		cust := it.Customer()
 		ids = append(ids, cust.ID)
 		c := s.convertCustomer(cust)
 
-		found, _ := s.GetCustomerByProvider(ProviderStripe, cust.ID)
+		found, _ := s.GetCustomerByProviderContext(ctx, ProviderStripe, cust.ID)
 		if found == nil {
-			if err := s.addCustomer(c); err != nil {
+			if err := s.addCustomer(ctx, c); err != nil {
 				log.Printf("error while adding stripe customer with id %s: %v", c.ProviderID, err)
 			}
 			continue
@@ -94,7 +123,7 @@ func (s *StripeProvider) syncCustomers() error {
 
 		c.ID = found.ID
 		if c.Name != found.Name || c.Email != found.Email {
-			if err := s.updateCustomerByProvider(c); err != nil {
+			if err := s.updateCustomerByProvider(ctx, c); err != nil {
 				log.Printf("error while updating stripe customer with id %s: %v", c.ProviderID, err)
 			}
 		}
@@ -104,35 +133,55 @@ func (s *StripeProvider) syncCustomers() error {
 		return it.Err()
 	}
 
-	return s.removeCustomerOrphans(ProviderStripe, ids)
+	return s.removeCustomerOrphans(ctx, ProviderStripe, ids)
 }
 
-func (s *StripeProvider) syncPlans() error {
-	it := product.List(nil)
+func (s *StripeProvider) syncPlans(ctx context.Context) error {
+	it := product.List(&stripe.ProductListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
 	var ids []string
 
 	for it.Next() {
 		p := it.Product()
 		ids = append(ids, p.ID)
-		pl := s.convertProduct(p)
 
-		// we need to see if we already have it
-		_, err := s.GetPlanByProviderID(ProviderStripe, p.ID)
-
-		if errors.Is(err, orm.ErrNotFound) {
-			if err := s.addPlan(pl); err != nil {
-				log.Printf("error while adding plan %s: %v", p.ID, err)
-			}
-			continue
+		if err := s.saveProduct(ctx, p); err != nil {
+			log.Printf("error saving plan %s: %v", p.ID, err)
 		}
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
 
+	return s.removePlanOrphans(ctx, ProviderStripe, ids)
+}
+
+// syncSubscriptions pulls in all subscriptions from stripe
+func (s *StripeProvider) syncSubscriptions(ctx context.Context) error {
+	var ids []string
+
+	// the listed state is at least as recent as the start of the listing
+	listedAt := time.Now()
+	it := subscription.List(&stripe.SubscriptionListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+		Status:     stripe.String("all"), // canceled subscriptions are kept
+	})
+	for it.Next() {
+		sub := it.Subscription()
+		ids = append(ids, sub.ID)
+
+		subscr, err := s.convertSubscription(ctx, sub)
 		if err != nil {
-			log.Printf("error while getting plan %s: %v", p.ID, err)
+			log.Printf("error converting subscription %s: %v", sub.ID, err)
 			continue
 		}
 
-		if err := s.updatePlanByProvider(pl); err != nil {
-			log.Printf("error updating plan %s: %v", pl.ProviderID, err)
+		subscr.SnapshotAt = &listedAt
+
+		if err := s.saveSubscription(ctx, subscr); err != nil {
+			log.Printf("error saving subscription %s: %v", subscr.ProviderID, err)
 		}
 	}
 
@@ -140,47 +189,128 @@ func (s *StripeProvider) syncPlans() error {
 		return err
 	}
 
-	return s.removePlanOrphans(ProviderStripe, ids)
+	return s.removeSubscriptionOrphans(ctx, ProviderStripe, ids)
 }
 
-// syncSubscriptions pulls in all subscriptions from stripe
-func (s *StripeProvider) syncSubscriptions() error {
+// syncInvoices pulls in all invoices from stripe, subscriptions must be synced first
+func (s *StripeProvider) syncInvoices(ctx context.Context) error {
 	var ids []string
-	it := subscription.List(nil)
+	it := invoice.List(&stripe.InvoiceListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
 	for it.Next() {
-		sub := it.Subscription()
-		ids = append(ids, sub.ID)
+		inv := it.Invoice()
+		ids = append(ids, inv.ID)
 
-		subscr, err := s.convertSubscription(sub)
-		if err != nil {
-			log.Printf("error converting subscription %s: %v", sub.ID, err)
+		if _, err := s.saveStripeInvoice(ctx, inv); err != nil {
+			log.Printf("error saving invoice %s: %v", inv.ID, err)
 		}
+	}
 
-		_, err = s.GetSubscriptionByProvider(ProviderStripe, sub.ID)
-		if errors.Is(err, orm.ErrNotFound) {
-			// we add it
-			if err := s.addSubscription(subscr); err != nil {
-				log.Printf("error adding subscription %s: %v", subscr.ProviderID, err)
-			}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return s.removeInvoiceOrphans(ctx, ProviderStripe, ids)
+}
+
+// syncCharges pulls in all charges from stripe. Charges can't be deleted so there are no orphans to remove
+func (s *StripeProvider) syncCharges(ctx context.Context) error {
+	it := charge.List(&stripe.ChargeListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
+	for it.Next() {
+		ch := it.Charge()
+		if _, err := s.saveStripeCharge(ctx, ch); err != nil {
+			log.Printf("error saving charge %s: %v", ch.ID, err)
+		}
+	}
+
+	return it.Err()
+}
+
+// syncRefunds pulls in all refunds from stripe, charges must be synced first
+func (s *StripeProvider) syncRefunds(ctx context.Context) error {
+	it := refund.List(&stripe.RefundListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
+	for it.Next() {
+		re := it.Refund()
+		if re.Charge == nil {
 			continue
 		}
 
+		c, err := s.GetChargeByProvider(ctx, ProviderStripe, re.Charge.ID)
 		if err != nil {
-			log.Printf("error getting subscription %s: %v", sub.ID, err)
+			log.Printf("error getting charge %s of refund %s: %v", re.Charge.ID, re.ID, err)
 			continue
 		}
 
-		if err := s.updateSubscriptionByProvider(subscr); err != nil {
-			log.Printf("error updating subscription %s: %v", subscr.ProviderID, err)
+		if err := s.saveRefund(ctx, s.convertRefund(re, c)); err != nil {
+			log.Printf("error saving refund %s: %v", re.ID, err)
+		}
+	}
+
+	return it.Err()
+}
+
+// syncDisputes pulls in all disputes from stripe, charges must be synced first
+func (s *StripeProvider) syncDisputes(ctx context.Context) error {
+	it := dispute.List(&stripe.DisputeListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
+	for it.Next() {
+		dp := it.Dispute()
+
+		d, err := s.convertDispute(ctx, dp)
+		if err != nil {
+			log.Printf("error converting dispute %s: %v", dp.ID, err)
 			continue
 		}
+
+		if err := s.saveDispute(ctx, d); err != nil {
+			log.Printf("error saving dispute %s: %v", dp.ID, err)
+		}
 	}
 
-	if err := it.Err(); err != nil {
-		return err
+	return it.Err()
+}
+
+// syncCoupons saves the coupons listed by stripe.
+// Deleted coupons are not listed, they are kept as invalid when the webhook receives their deletion
+func (s *StripeProvider) syncCoupons(ctx context.Context) error {
+	it := coupon.List(&stripe.CouponListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
+	for it.Next() {
+		c := it.Coupon()
+		if err := s.saveCoupon(ctx, convertCoupon(c)); err != nil {
+			log.Printf("error saving coupon %s: %v", c.ID, err)
+		}
+	}
+
+	return it.Err()
+}
+
+func (s *StripeProvider) syncPromotionCodes(ctx context.Context) error {
+	it := promotioncode.List(&stripe.PromotionCodeListParams{
+		ListParams: stripe.ListParams{Context: ctx},
+	})
+	for it.Next() {
+		pc := it.PromotionCode()
+
+		promo, err := s.convertPromotionCode(ctx, pc)
+		if err != nil {
+			log.Printf("error converting promotion code %s: %v", pc.ID, err)
+			continue
+		}
+
+		if err := s.savePromotionCode(ctx, promo); err != nil {
+			log.Printf("error saving promotion code %s: %v", pc.ID, err)
+		}
 	}
 
-	return s.removeSubscriptionOrphans(ProviderStripe, ids)
+	return it.Err()
 }
 
 func convertStringsToInterfaces(input []string) []interface{} {
@@ -0,0 +1,373 @@
+package pay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cristosal/orm"
+	"github.com/cristosal/orm/schema"
+	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/usagerecord"
+)
+
+// usageBatchSize is the number of usage records flushed to the provider at a time
+const usageBatchSize = 500
+
+// RecordUsage stores usage of a metered price of the subscription to be flushed to the provider by FlushUsage.
+// The price is either the price of the subscription or one of its add-on items.
+// Usage recorded again with the same idempotency key is ignored, a random key is used when empty
+func (r *Repo) RecordUsage(ctx context.Context, subID, priceID, quantity int64, at time.Time, idempotencyKey string) error {
+	if quantity < 0 {
+		return fmt.Errorf("usage quantity must not be negative: %d", quantity)
+	}
+
+	pr, err := r.getSubscribedPrice(ctx, subID, priceID)
+	if err != nil {
+		return err
+	}
+
+	if !pr.IsMetered() {
+		return ErrPriceNotMetered
+	}
+
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	if idempotencyKey == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+
+		idempotencyKey = hex.EncodeToString(b)
+	}
+
+	now := time.Now()
+	sql := fmt.Sprintf(`INSERT INTO %s (subscription_id, price_id, quantity, recorded_at, idempotency_key, next_attempt_at, created_at) VALUES ($1, $2, $3, $4, $5, $6, $6)
+		ON CONFLICT (subscription_id, idempotency_key) DO NOTHING`, orm.TableName(&UsageRecord{}))
+
+	_, err = r.conn(ctx).Exec(sql, subID, priceID, quantity, at, idempotencyKey, now)
+	return err
+}
+
+// GetCurrentUsage returns the usage of a metered price of the subscription in its current period, combined as the price aggregates usage
+func (r *Repo) GetCurrentUsage(ctx context.Context, subID, priceID int64) (int64, error) {
+	pr, err := r.getSubscribedPrice(ctx, subID, priceID)
+	if err != nil {
+		return 0, err
+	}
+
+	sub, err := r.GetSubscriptionByIDContext(ctx, subID)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		table  = orm.TableName(&UsageRecord{})
+		period = "subscription_id = $1 AND price_id = $2 AND recorded_at >= $3 AND recorded_at < $4"
+		args   = []any{subID, priceID, sub.CurrentPeriodStart, sub.CurrentPeriodEnd}
+		sql    string
+	)
+
+	switch pr.AggregateUsage {
+	case AggregateMax:
+		sql = fmt.Sprintf("SELECT COALESCE(MAX(quantity), 0) FROM %s WHERE %s", table, period)
+	case AggregateLastDuringPeriod:
+		sql = fmt.Sprintf("SELECT COALESCE((SELECT quantity FROM %s WHERE %s ORDER BY recorded_at DESC, id DESC LIMIT 1), 0)", table, period)
+	case AggregateLastEver:
+		sql = fmt.Sprintf("SELECT COALESCE((SELECT quantity FROM %s WHERE subscription_id = $1 AND price_id = $2 ORDER BY recorded_at DESC, id DESC LIMIT 1), 0)", table)
+		args = args[:2]
+	default:
+		sql = fmt.Sprintf("SELECT COALESCE(SUM(quantity), 0) FROM %s WHERE %s", table, period)
+	}
+
+	var usage int64
+	if err := r.conn(ctx).QueryRow(sql, args...).Scan(&usage); err != nil {
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+// getSubscribedPrice returns the price if it is the price of the subscription or of one of its items
+func (r *Repo) getSubscribedPrice(ctx context.Context, subID, priceID int64) (*Price, error) {
+	sub, err := r.GetSubscriptionByIDContext(ctx, subID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return nil, ErrSubscriptionNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	subscribed := sub.PriceID == priceID
+	if !subscribed {
+		items, err := r.ListSubscriptionItems(ctx, subID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, it := range items {
+			if it.PriceID == priceID {
+				subscribed = true
+				break
+			}
+		}
+	}
+
+	if !subscribed {
+		return nil, ErrPriceNotSubscribed
+	}
+
+	return r.GetPriceByIDContext(ctx, priceID)
+}
+
+// listUnflushedUsage returns the oldest usage records of the providers subscriptions that are due to be flushed
+func (r *Repo) listUnflushedUsage(ctx context.Context, provider string, limit int) ([]UsageRecord, error) {
+	var (
+		u       UsageRecord
+		records []UsageRecord
+		sql     = fmt.Sprintf(`SELECT %s FROM %s u
+			INNER JOIN %s s ON s.id = u.subscription_id AND s.provider = $1
+			WHERE u.flushed_at IS NULL AND u.next_attempt_at <= $2 ORDER BY u.id LIMIT $3`,
+			orm.Columns(&u).PrefixedList("u"),
+			orm.TableName(&u),
+			orm.TableName(&Subscription{}),
+		)
+	)
+
+	if err := orm.Query(r.conn(ctx), &records, sql, provider, time.Now(), limit); err != nil {
+		if errors.Is(err, orm.ErrNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// markUsageFlushed records that the usage records were sent to the provider as providerID
+func (r *Repo) markUsageFlushed(ctx context.Context, records []UsageRecord, providerID string) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	args := []any{providerID, time.Now()}
+	for _, u := range records {
+		args = append(args, u.ID)
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET provider_id = $1, flushed_at = $2, next_attempt_at = NULL WHERE id IN (%s)",
+		orm.TableName(&UsageRecord{}), schema.ValueList(len(records), 3))
+
+	_, err := r.conn(ctx).Exec(sql, args...)
+	return err
+}
+
+// markUsageFailed records the failure of the records that are not flushed yet, scheduling their next attempt.
+// Records that reached the maximum attempts are no longer flushed and are kept with their last error
+func (r *Repo) markUsageFailed(ctx context.Context, records []UsageRecord, flushErr error, policy *RetryPolicy) error {
+	now := time.Now()
+	sql := fmt.Sprintf("UPDATE %s SET attempts = $1, last_error = $2, next_attempt_at = $3 WHERE id = $4 AND flushed_at IS NULL", orm.TableName(&UsageRecord{}))
+	for _, u := range records {
+		var next *time.Time
+		if u.Attempts+1 < policy.MaxAttempts {
+			t := now.Add(policy.backoff(u.Attempts + 1))
+			next = &t
+		}
+
+		if _, err := r.conn(ctx).Exec(sql, u.Attempts+1, flushErr.Error(), next, u.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// usageKey identifies the usage of a metered price of a subscription
+type usageKey struct {
+	SubscriptionID int64
+	PriceID        int64
+}
+
+// groupUsage groups the records by subscription and price keeping the order in which they first appear
+func groupUsage(records []UsageRecord) (keys []usageKey, groups map[usageKey][]UsageRecord) {
+	groups = make(map[usageKey][]UsageRecord)
+	for _, u := range records {
+		k := usageKey{SubscriptionID: u.SubscriptionID, PriceID: u.PriceID}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+
+		groups[k] = append(groups[k], u)
+	}
+
+	return keys, groups
+}
+
+// usageSum is the usage of a billing period sent to the provider as a single increment
+type usageSum struct {
+	Quantity int64
+	At       time.Time // latest time usage was recorded at in the period
+	Records  []UsageRecord
+}
+
+// sumUsage sums the records by the billing period of pr they were recorded in, oldest period first.
+// start is the start of the current period, records before it belong to earlier periods
+func sumUsage(records []UsageRecord, pr *Price, start time.Time) []usageSum {
+	var (
+		starts []time.Time
+		sums   = make(map[time.Time]*usageSum)
+	)
+
+	for _, u := range records {
+		ps := start
+		for u.RecordedAt.Before(ps) {
+			ps = pr.PeriodStart(ps)
+		}
+
+		sum, ok := sums[ps]
+		if !ok {
+			sum = &usageSum{}
+			sums[ps] = sum
+			starts = append(starts, ps)
+		}
+
+		sum.Quantity += u.Quantity
+		sum.Records = append(sum.Records, u)
+		if u.RecordedAt.After(sum.At) {
+			sum.At = u.RecordedAt
+		}
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	var res []usageSum
+	for _, ps := range starts {
+		res = append(res, *sums[ps])
+	}
+
+	return res
+}
+
+// FlushUsage sends the recorded usage to stripe in batches.
+// Summed usage is sent as a single increment per billing period, otherwise each record is sent on its own.
+// Records that fail to be sent are attempted again after a backoff so that they don't hold back the usage of other subscriptions
+func (s *StripeProvider) FlushUsage(ctx context.Context) error {
+	var errs []error
+	for {
+		records, err := s.listUnflushedUsage(ctx, ProviderStripe, usageBatchSize)
+		if err != nil {
+			return err
+		}
+
+		keys, groups := groupUsage(records)
+		for _, k := range keys {
+			flushErr := s.flushSubscriptionUsage(ctx, k, groups[k])
+			if flushErr == nil {
+				continue
+			}
+
+			errs = append(errs, fmt.Errorf("error flushing usage of subscription %d: %w", k.SubscriptionID, flushErr))
+
+			// failed records are no longer due so the next batch moves on to other records
+			if err := s.markUsageFailed(ctx, groups[k], flushErr, s.usageRetryPolicy()); err != nil {
+				return err
+			}
+		}
+
+		if len(records) < usageBatchSize {
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// RunUsageWorker flushes usage every interval until ctx is done
+func (s *StripeProvider) RunUsageWorker(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.FlushUsage(ctx); err != nil {
+			log.Printf("error flushing stripe usage: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *StripeProvider) flushSubscriptionUsage(ctx context.Context, k usageKey, records []UsageRecord) error {
+	sub, err := s.GetSubscriptionByIDContext(ctx, k.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	// stripe no longer accepts usage for subscriptions that have ended
+	if sub.Status == SubscriptionCanceled || sub.Status == SubscriptionIncompleteExpired {
+		log.Printf("discarding %d usage records of ended subscription %s", len(records), sub.ProviderID)
+		return s.markUsageFlushed(ctx, records, "")
+	}
+
+	pr, err := s.GetPriceByIDContext(ctx, k.PriceID)
+	if err != nil {
+		return err
+	}
+
+	itemID, err := s.subscriptionItemID(ctx, sub, k.PriceID)
+	if err != nil {
+		return err
+	}
+
+	if pr.AggregateUsage == AggregateSum || pr.AggregateUsage == "" {
+		for _, sum := range sumUsage(records, pr, sub.CurrentPeriodStart) {
+			key := fmt.Sprintf("pay-usage-%d-%d", sum.Records[0].ID, sum.Records[len(sum.Records)-1].ID)
+			if err := s.sendUsage(ctx, itemID, stripe.UsageRecordActionIncrement, sum.Quantity, sum.At, key, sum.Records); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, u := range records {
+		key := "pay-usage-" + strconv.FormatInt(u.ID, 10)
+		if err := s.sendUsage(ctx, itemID, stripe.UsageRecordActionSet, u.Quantity, u.RecordedAt, key, []UsageRecord{u}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendUsage creates the usage record in stripe and marks the records it was made from as flushed
+func (s *StripeProvider) sendUsage(ctx context.Context, itemID, action string, quantity int64, at time.Time, key string, records []UsageRecord) error {
+	params := &stripe.UsageRecordParams{
+		Params:           stripe.Params{Context: ctx},
+		SubscriptionItem: stripe.String(itemID),
+		Action:           stripe.String(action),
+		Quantity:         stripe.Int64(quantity),
+		Timestamp:        stripe.Int64(at.Unix()),
+	}
+
+	params.SetIdempotencyKey(key)
+
+	ur, err := usagerecord.New(params)
+	if err != nil {
+		return err
+	}
+
+	return s.markUsageFlushed(ctx, records, ur.ID)
+}
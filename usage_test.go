@@ -0,0 +1,99 @@
+package pay
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// usageIDs returns the ids of the records in order
+func usageIDs(records []UsageRecord) []int64 {
+	ids := make([]int64, len(records))
+	for i, u := range records {
+		ids[i] = u.ID
+	}
+
+	return ids
+}
+
+func TestGroupUsage(t *testing.T) {
+	records := []UsageRecord{
+		{ID: 1, SubscriptionID: 1, PriceID: 10},
+		{ID: 2, SubscriptionID: 2, PriceID: 10},
+		{ID: 3, SubscriptionID: 1, PriceID: 11},
+		{ID: 4, SubscriptionID: 1, PriceID: 10},
+		{ID: 5, SubscriptionID: 2, PriceID: 10},
+	}
+
+	keys, groups := groupUsage(records)
+
+	wantKeys := []usageKey{{1, 10}, {2, 10}, {1, 11}}
+	if !reflect.DeepEqual(keys, wantKeys) {
+		t.Fatalf("expected keys %v, got %v", wantKeys, keys)
+	}
+
+	tests := []struct {
+		key  usageKey
+		want []int64
+	}{
+		{usageKey{1, 10}, []int64{1, 4}},
+		{usageKey{2, 10}, []int64{2, 5}},
+		{usageKey{1, 11}, []int64{3}},
+	}
+
+	for _, tt := range tests {
+		if got := usageIDs(groups[tt.key]); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("expected records %v for %v, got %v", tt.want, tt.key, got)
+		}
+	}
+
+	if keys, groups := groupUsage(nil); len(keys) != 0 || len(groups) != 0 {
+		t.Fatalf("expected no groups, got %v", groups)
+	}
+}
+
+func TestSumUsage(t *testing.T) {
+	start := time.Date(2024, time.March, 15, 0, 0, 0, 0, time.UTC)
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 0, 0, 0, 0, time.UTC) }
+
+	records := []UsageRecord{
+		{ID: 1, Quantity: 1, RecordedAt: day(time.March, 20)},
+		{ID: 2, Quantity: 2, RecordedAt: day(time.February, 20)},
+		{ID: 3, Quantity: 3, RecordedAt: day(time.March, 16)},
+		{ID: 4, Quantity: 4, RecordedAt: day(time.January, 10)},
+		{ID: 5, Quantity: 5, RecordedAt: day(time.March, 14)},
+		{ID: 6, Quantity: 6, RecordedAt: start},
+	}
+
+	tests := []struct {
+		name  string
+		price Price
+		want  []usageSum
+	}{
+		{
+			name:  "monthly",
+			price: Price{Interval: IntervalMonth, IntervalCount: 1},
+			want: []usageSum{
+				{Quantity: 4, At: day(time.January, 10), Records: []UsageRecord{records[3]}},
+				{Quantity: 7, At: day(time.March, 14), Records: []UsageRecord{records[1], records[4]}},
+				{Quantity: 10, At: day(time.March, 20), Records: []UsageRecord{records[0], records[2], records[5]}},
+			},
+		},
+		{
+			name:  "quarterly",
+			price: Price{Interval: IntervalMonth, IntervalCount: 3},
+			want: []usageSum{
+				{Quantity: 11, At: day(time.March, 14), Records: []UsageRecord{records[1], records[3], records[4]}},
+				{Quantity: 10, At: day(time.March, 20), Records: []UsageRecord{records[0], records[2], records[5]}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sumUsage(records, &tt.price, start); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
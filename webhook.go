@@ -1,60 +1,37 @@
 package pay
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/cristosal/orm"
 	"github.com/stripe/stripe-go/v74"
+	"github.com/stripe/stripe-go/v74/checkout/session"
 	"github.com/stripe/stripe-go/v74/webhook"
 )
 
-// Webhook returns the http handler that is responsible for handling any event received from stripe
+// Webhook returns the http handler that is responsible for handling any event received from stripe.
+// Events are stored before being acknowledged and handled in the background by a worker
+// which retries failed events according to the configured RetryPolicy.
+// The worker is started once, no matter how many handlers are created, and runs until Close is called.
 func (s *StripeProvider) Webhook() http.HandlerFunc {
 	const MaxBodyBytes = int64(65536)
-	whevents := make(chan stripe.Event)
-
-	go func() {
-		for event := range whevents {
-			log.Printf("stripe webhook: recieved event: %s", event.Type)
-			var err error
-
-			switch event.Type {
-			case "product.created":
-				err = s.handleProductCreated(event.Data)
-			case "product.updated":
-				err = s.handleProductUpdated(event.Data)
-			case "product.deleted":
-				err = s.handleProductDeleted(event.Data)
-			case "price.created":
-				err = s.handlePriceCreated(event.Data)
-			case "price.updated":
-				err = s.handlePriceUpdated(event.Data)
-			case "price.deleted":
-				err = s.handlePriceDeleted(event.Data)
-			case "customer.created":
-				err = s.handleCustomerCreated(event.Data)
-			case "customer.updated":
-				err = s.handleCustomerUpdated(event.Data)
-			case "customer.deleted":
-				err = s.handleCustomerDeleted(event.Data)
-			case "customer.subscription.created":
-				err = s.handleSubscriptionCreated(event.Data)
-			case "customer.subscription.updated":
-				err = s.handleSubscriptionUpdated(event.Data)
-			case "customer.subscription.deleted":
-				err = s.handleSubscriptionDeleted(event.Data)
-			}
 
-			if err != nil {
-				log.Printf("error handling stripe event %s: %v", event.Type, err)
-			}
-		}
-	}()
+	s.worker.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.received = make(chan struct{}, 1)
+		s.stopWorker = cancel
+		go s.runWebhookWorker(ctx)
+	})
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
@@ -75,162 +52,689 @@ func (s *StripeProvider) Webhook() http.HandlerFunc {
 			return
 		}
 
-		if s.hasWebhookEvent(ProviderStripe, event.ID) {
-			log.Printf("Already processed event with id %s", event.ID)
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
-		if err := s.addWebhookEvent(&WebhookEvent{
+		occurredAt := time.Unix(event.Created, 0)
+		added, err := s.addWebhookEvent(r.Context(), &WebhookEvent{
 			Provider:   ProviderStripe,
 			ProviderID: event.ID,
 			EventType:  event.Type,
 			Payload:    event.Data.Raw,
-		}); err != nil {
+			OccurredAt: &occurredAt,
+		})
+		if err != nil {
 			log.Printf("error while saving stripe event: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		whevents <- event
+		if !added {
+			log.Printf("Already received event with id %s", event.ID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		log.Printf("stripe webhook: recieved event: %s", event.Type)
+
+		// wake up the worker without blocking when it is already busy
+		select {
+		case s.received <- struct{}{}:
+		default:
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-func (s *StripeProvider) handleSubscriptionCreated(data *stripe.EventData) error {
+// runWebhookWorker processes events whenever one is received, and at least every MinBackoff so that retries are picked up, until ctx is done
+func (s *StripeProvider) runWebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(s.retryPolicy().MinBackoff)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.received:
+		case <-ticker.C:
+		}
+
+		if err := s.ProcessWebhookEvents(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error processing stripe events: %v", err)
+		}
+	}
+}
+
+// Close stops the webhook worker started by Webhook. Stored events that are still due are processed by the next worker
+func (s *StripeProvider) Close() error {
+	s.worker.Do(func() {}) // a worker can no longer be started
+	if s.stopWorker != nil {
+		s.stopWorker()
+	}
+
+	return nil
+}
+
+// ProcessWebhookEvents handles all stored stripe events that are pending or due for a retry.
+// It is called by the worker started with Webhook, but can also be called directly such as from a scheduled job.
+func (s *StripeProvider) ProcessWebhookEvents(ctx context.Context) error {
+	return s.processWebhookEvents(ctx, ProviderStripe, s.retryPolicy(), s.handleWebhookEvent)
+}
+
+// ReplayWebhookEvent handles the stored stripe event again, regardless of whether it was already processed
+func (s *StripeProvider) ReplayWebhookEvent(ctx context.Context, id int64) error {
+	e, err := s.GetWebhookEventByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if e.Provider != ProviderStripe {
+		return fmt.Errorf("webhook event %d was received from %s", id, e.Provider)
+	}
+
+	handleErr := s.handleWebhookEvent(ctx, e)
+	if err := s.completeWebhookEvent(ctx, e, handleErr, s.retryPolicy()); err != nil {
+		return err
+	}
+
+	return handleErr
+}
+
+// ReplayWebhookEvents handles the stored stripe events matching filter again, in the order they were received.
+// This allows rebuilding local state from the event log without calling stripe.
+// Events that fail are recorded as such and do not stop the replay.
+func (s *StripeProvider) ReplayWebhookEvents(ctx context.Context, filter *WebhookEventFilter) error {
+	var f WebhookEventFilter
+	if filter != nil {
+		f = *filter
+	}
+
+	f.Provider = ProviderStripe
+	events, err := s.ListWebhookEvents(ctx, &f)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for i := range events {
+		e := &events[i]
+		handleErr := s.handleWebhookEvent(ctx, e)
+		if handleErr != nil {
+			failed++
+		}
+
+		if err := s.completeWebhookEvent(ctx, e, handleErr, s.retryPolicy()); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d replayed events failed", failed, len(events))
+	}
+
+	return nil
+}
+
+// handleWebhookEvent applies the event data to the repository based on the event type
+func (s *StripeProvider) handleWebhookEvent(ctx context.Context, e *WebhookEvent) error {
+	data := &stripe.EventData{Raw: e.Payload}
+
+	switch e.EventType {
+	case "product.created":
+		return s.handleProductCreated(ctx, data)
+	case "product.updated":
+		return s.handleProductUpdated(ctx, data)
+	case "product.deleted":
+		return s.handleProductDeleted(ctx, data)
+	case "price.created":
+		return s.handlePriceCreated(ctx, data)
+	case "price.updated":
+		return s.handlePriceUpdated(ctx, data)
+	case "price.deleted":
+		return s.handlePriceDeleted(ctx, data)
+	case "customer.created":
+		return s.handleCustomerCreated(ctx, data)
+	case "customer.updated":
+		return s.handleCustomerUpdated(ctx, data)
+	case "customer.deleted":
+		return s.handleCustomerDeleted(ctx, data)
+	case "customer.subscription.created":
+		return s.handleSubscriptionCreated(ctx, data, e.OccurredAt)
+	case "customer.subscription.updated":
+		return s.handleSubscriptionUpdated(ctx, data, e.OccurredAt)
+	case "customer.subscription.deleted":
+		return s.handleSubscriptionDeleted(ctx, data, e.OccurredAt)
+	case "checkout.session.completed":
+		return s.handleCheckoutSessionCompleted(ctx, data, e.OccurredAt)
+	case "checkout.session.expired":
+		return s.handleCheckoutSessionExpired(ctx, data)
+	case "checkout.session.async_payment_succeeded":
+		return s.handleCheckoutSessionAsyncPaymentSucceeded(ctx, data, e.OccurredAt)
+	case "charge.succeeded",
+		"charge.pending",
+		"charge.failed",
+		"charge.captured",
+		"charge.expired",
+		"charge.updated":
+		return s.handleChargeSaved(ctx, data)
+	case "charge.refunded":
+		return s.handleChargeRefunded(ctx, data)
+	case "charge.refund.updated",
+		"refund.created",
+		"refund.updated":
+		return s.handleRefundSaved(ctx, data)
+	case "charge.dispute.created",
+		"charge.dispute.updated",
+		"charge.dispute.closed",
+		"charge.dispute.funds_withdrawn",
+		"charge.dispute.funds_reinstated":
+		return s.handleDisputeSaved(ctx, data)
+	case "coupon.created",
+		"coupon.updated":
+		return s.handleCouponSaved(ctx, data)
+	case "coupon.deleted":
+		return s.handleCouponDeleted(ctx, data)
+	case "promotion_code.created",
+		"promotion_code.updated":
+		return s.handlePromotionCodeSaved(ctx, data)
+	case "payment_intent.succeeded",
+		"payment_intent.payment_failed":
+		return s.handlePaymentIntent(ctx, data)
+	case "invoice.created",
+		"invoice.updated",
+		"invoice.finalized",
+		"invoice.paid",
+		"invoice.payment_succeeded",
+		"invoice.voided",
+		"invoice.marked_uncollectible":
+		return s.handleInvoiceSaved(ctx, data)
+	case "invoice.payment_failed":
+		return s.handleInvoicePaymentFailed(ctx, data)
+	case "invoice.deleted":
+		return s.handleInvoiceDeleted(ctx, data)
+	}
+
+	return nil
+}
+
+func (s *StripeProvider) handleSubscriptionCreated(ctx context.Context, data *stripe.EventData, at *time.Time) error {
 	var sub stripe.Subscription
 	if err := sub.UnmarshalJSON(data.Raw); err != nil {
 		return err
 	}
 
-	subscr, err := s.convertSubscription(&sub)
+	subscr, err := s.convertSubscription(ctx, &sub)
 	if err != nil {
 		return err
 	}
 
-	return s.addSubscription(subscr)
+	subscr.SnapshotAt = at
+	return s.saveSubscription(ctx, subscr)
 }
 
-func (s *StripeProvider) handleSubscriptionUpdated(data *stripe.EventData) error {
+func (s *StripeProvider) handleSubscriptionUpdated(ctx context.Context, data *stripe.EventData, at *time.Time) error {
 	var sub stripe.Subscription
 	if err := sub.UnmarshalJSON(data.Raw); err != nil {
 		return err
 	}
 
-	subscr, err := s.convertSubscription(&sub)
+	subscr, err := s.convertSubscription(ctx, &sub)
 	if err != nil {
 		return err
 	}
 
-	return s.updateSubscriptionByProvider(subscr)
+	subscr.SnapshotAt = at
+	return s.saveSubscription(ctx, subscr)
 }
 
-func (s *StripeProvider) handleSubscriptionDeleted(data *stripe.EventData) error {
+// handleSubscriptionDeleted keeps the subscription with its canceled status so that it can still be looked up
+func (s *StripeProvider) handleSubscriptionDeleted(ctx context.Context, data *stripe.EventData, at *time.Time) error {
 	var sub stripe.Subscription
 	if err := sub.UnmarshalJSON(data.Raw); err != nil {
 		return err
 	}
 
-	subscr, err := s.convertSubscription(&sub)
+	subscr, err := s.convertSubscription(ctx, &sub)
 	if err != nil {
-		return err
+		// the customer or price may have been deleted before being received
+		return ignoreNotFound(err)
 	}
 
-	return s.removeSubscriptionByProvider(subscr)
+	subscr.SnapshotAt = at
+	return s.saveSubscription(ctx, subscr)
 }
 
-func (s *StripeProvider) handleCustomerCreated(data *stripe.EventData) error {
+func (s *StripeProvider) handleCustomerCreated(ctx context.Context, data *stripe.EventData) error {
 	var c stripe.Customer
 	if err := json.Unmarshal(data.Raw, &c); err != nil {
 		return err
 	}
-	return s.addCustomer(s.convertCustomer(&c))
+	return s.saveCustomer(ctx, s.convertCustomer(&c))
 }
 
-func (s *StripeProvider) handleCustomerUpdated(data *stripe.EventData) error {
+func (s *StripeProvider) handleCustomerUpdated(ctx context.Context, data *stripe.EventData) error {
 	var c stripe.Customer
 	if err := json.Unmarshal(data.Raw, &c); err != nil {
 		return err
 	}
 
-	return s.updateCustomerByProvider(s.convertCustomer(&c))
+	return s.saveCustomer(ctx, s.convertCustomer(&c))
 }
 
-func (s *StripeProvider) handleCustomerDeleted(data *stripe.EventData) error {
+func (s *StripeProvider) handleCustomerDeleted(ctx context.Context, data *stripe.EventData) error {
 	var c stripe.Customer
 	if err := json.Unmarshal(data.Raw, &c); err != nil {
 		return err
 	}
-	return s.removeCustomerByProvider(ProviderStripe, c.ID)
+	return ignoreNotFound(s.removeCustomerByProvider(ctx, ProviderStripe, c.ID))
 }
 
-func (s *StripeProvider) handlePriceCreated(data *stripe.EventData) error {
+func (s *StripeProvider) handlePriceCreated(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Price
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
 
-	pr, err := s.convertPrice(&p)
+	pr, err := s.convertPrice(ctx, &p)
 	if err != nil {
 		return err
 	}
 
-	return s.addPrice(pr)
+	return s.savePrice(ctx, pr)
 }
 
-func (s *StripeProvider) handlePriceUpdated(data *stripe.EventData) error {
+func (s *StripeProvider) handlePriceUpdated(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Price
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
 
-	pr, err := s.convertPrice(&p)
+	pr, err := s.convertPrice(ctx, &p)
 	if err != nil {
 		return err
 	}
 
-	return s.updatePriceByProvider(pr)
+	return s.savePrice(ctx, pr)
 }
 
-func (s *StripeProvider) handlePriceDeleted(data *stripe.EventData) error {
+func (s *StripeProvider) handlePriceDeleted(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Price
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
 
-	return s.removePriceByProvider(&Price{
+	return ignoreNotFound(s.removePriceByProvider(ctx, &Price{
 		Provider:   ProviderStripe,
 		ProviderID: p.ID,
-	})
+	}))
 }
 
-func (s *StripeProvider) handleProductCreated(data *stripe.EventData) error {
+func (s *StripeProvider) handleProductCreated(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Product
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
 
-	return s.addPlan(s.convertProduct(&p))
+	return s.saveProduct(ctx, &p)
 }
 
-func (s *StripeProvider) handleProductUpdated(data *stripe.EventData) error {
+func (s *StripeProvider) handleProductUpdated(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Product
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
 
-	return s.updatePlanByProvider(s.convertProduct(&p))
+	return s.saveProduct(ctx, &p)
 }
 
-func (s *StripeProvider) handleProductDeleted(data *stripe.EventData) error {
+// saveProduct saves the plan along with its features when they are read from metadata
+func (s *StripeProvider) saveProduct(ctx context.Context, p *stripe.Product) error {
+	pl := s.convertProduct(p)
+	if err := s.savePlan(ctx, pl); err != nil {
+		return err
+	}
+
+	if s.config.FeatureMetadataPrefix == "" {
+		return nil
+	}
+
+	return s.replacePlanFeatures(ctx, pl.ID, s.convertFeatures(p))
+}
+
+func (s *StripeProvider) handleProductDeleted(ctx context.Context, data *stripe.EventData) error {
 	var p stripe.Product
 	if err := json.Unmarshal(data.Raw, &p); err != nil {
 		return err
 	}
-	return s.removePlanByProvider(ProviderStripe, p.ID)
+	return ignoreNotFound(s.removePlanByProvider(ctx, ProviderStripe, p.ID))
+}
+
+func (s *StripeProvider) handleCheckoutSessionCompleted(ctx context.Context, data *stripe.EventData, at *time.Time) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(data.Raw, &sess); err != nil {
+		return err
+	}
+
+	cs, err := s.GetCheckoutSessionByProvider(ctx, ProviderStripe, sess.ID)
+	if errors.Is(err, orm.ErrNotFound) {
+		// sessions that were not started with Checkout are not tracked
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// payments made with delayed methods such as bank debits are unpaid at this point
+	// and are recorded once checkout.session.async_payment_succeeded is received
+	if sess.Mode == stripe.CheckoutSessionModePayment && sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusUnpaid {
+		if err := s.addSessionPurchase(ctx, cs, &sess, at); err != nil {
+			return err
+		}
+	}
+
+	if cs.Status == CheckoutSessionComplete {
+		return nil
+	}
+
+	now := time.Now()
+	if at != nil {
+		now = *at
+	}
+
+	cs.Status = CheckoutSessionComplete
+	cs.CompletedAt = &now
+
+	if sess.Subscription != nil {
+		cs.SubscriptionProviderID = sess.Subscription.ID
+	}
+
+	// prefer what stripe sends back, sessions stored before these were kept have neither
+	if sess.Metadata != nil {
+		cs.Metadata = sess.Metadata
+	}
+
+	if sess.ClientReferenceID != "" {
+		cs.ClientReferenceID = sess.ClientReferenceID
+	}
+
+	return s.updateCheckoutSessionByProvider(ctx, cs)
+}
+
+func (s *StripeProvider) handleCheckoutSessionExpired(ctx context.Context, data *stripe.EventData) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(data.Raw, &sess); err != nil {
+		return err
+	}
+
+	cs, err := s.GetCheckoutSessionByProvider(ctx, ProviderStripe, sess.ID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// a late or replayed expiry must not undo a paid checkout
+	if cs.Status == CheckoutSessionComplete {
+		return nil
+	}
+
+	cs.Status = CheckoutSessionExpired
+	return s.updateCheckoutSessionByProvider(ctx, cs)
+}
+
+func (s *StripeProvider) handleCheckoutSessionAsyncPaymentSucceeded(ctx context.Context, data *stripe.EventData, at *time.Time) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(data.Raw, &sess); err != nil {
+		return err
+	}
+
+	if sess.Mode != stripe.CheckoutSessionModePayment {
+		return nil
+	}
+
+	cs, err := s.GetCheckoutSessionByProvider(ctx, ProviderStripe, sess.ID)
+	if errors.Is(err, orm.ErrNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return s.addSessionPurchase(ctx, cs, &sess, at)
+}
+
+// addSessionPurchase records the purchases of the line items paid for by a checkout session in payment mode.
+// They are dated at the time of the event of the payment, which is the session creation when unknown
+func (s *StripeProvider) addSessionPurchase(ctx context.Context, cs *CheckoutSession, sess *stripe.CheckoutSession, at *time.Time) error {
+	paymentID := sess.ID
+	if sess.PaymentIntent != nil {
+		paymentID = sess.PaymentIntent.ID
+	}
+
+	paidAt := time.Unix(sess.Created, 0)
+	if at != nil {
+		paidAt = *at
+	}
+
+	// line items are left out of the events
+	var itemIDs []string
+	it := session.ListLineItems(&stripe.CheckoutSessionListLineItemsParams{
+		ListParams: stripe.ListParams{Context: ctx},
+		Session:    stripe.String(sess.ID),
+	})
+	for it.Next() {
+		itemIDs = append(itemIDs, it.LineItem().ID)
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	purchases, err := s.sessionPurchases(ctx, cs, paymentID, itemIDs, sess.AmountTotal, string(sess.Currency), paidAt)
+	if err != nil {
+		return err
+	}
+
+	for i := range purchases {
+		if err := s.addPurchase(ctx, &purchases[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handleInvoiceSaved stores the invoice, every invoice event carries the whole invoice
+func (s *StripeProvider) handleInvoiceSaved(ctx context.Context, data *stripe.EventData) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(data.Raw, &inv); err != nil {
+		return err
+	}
+
+	_, err := s.saveStripeInvoice(ctx, &inv)
+	return err
+}
+
+// handleInvoicePaymentFailed stores the invoice and records the failed attempt in the dunning state of its subscription
+func (s *StripeProvider) handleInvoicePaymentFailed(ctx context.Context, data *stripe.EventData) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(data.Raw, &inv); err != nil {
+		return err
+	}
+
+	i, err := s.saveStripeInvoice(ctx, &inv)
+	if err != nil {
+		return err
+	}
+
+	return s.addPaymentFailure(ctx, i, int(inv.AttemptCount), convertTimestamp(inv.NextPaymentAttempt))
+}
+
+// handleInvoiceDeleted is only sent for draft invoices
+func (s *StripeProvider) handleInvoiceDeleted(ctx context.Context, data *stripe.EventData) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(data.Raw, &inv); err != nil {
+		return err
+	}
+
+	return ignoreNotFound(s.removeInvoiceByProvider(ctx, ProviderStripe, inv.ID))
+}
+
+func (s *StripeProvider) handleChargeSaved(ctx context.Context, data *stripe.EventData) error {
+	var ch stripe.Charge
+	if err := json.Unmarshal(data.Raw, &ch); err != nil {
+		return err
+	}
+
+	_, err := s.saveStripeCharge(ctx, &ch)
+	return err
+}
+
+// handleChargeRefunded stores the refunded amount of the charge.
+// Refunds are stored from the refund events, or from the charge when its payload includes them
+func (s *StripeProvider) handleChargeRefunded(ctx context.Context, data *stripe.EventData) error {
+	var ch stripe.Charge
+	if err := json.Unmarshal(data.Raw, &ch); err != nil {
+		return err
+	}
+
+	c, err := s.saveStripeCharge(ctx, &ch)
+	if err != nil {
+		return err
+	}
+
+	if ch.Refunds == nil {
+		return nil
+	}
+
+	for _, re := range ch.Refunds.Data {
+		if err := s.saveRefund(ctx, s.convertRefund(re, c)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *StripeProvider) handleRefundSaved(ctx context.Context, data *stripe.EventData) error {
+	var re stripe.Refund
+	if err := json.Unmarshal(data.Raw, &re); err != nil {
+		return err
+	}
+
+	if re.Charge == nil {
+		return nil
+	}
+
+	c, err := s.GetChargeByProvider(ctx, ProviderStripe, re.Charge.ID)
+	if err != nil {
+		return err
+	}
+
+	return s.saveRefund(ctx, s.convertRefund(&re, c))
+}
+
+func (s *StripeProvider) handleDisputeSaved(ctx context.Context, data *stripe.EventData) error {
+	var dp stripe.Dispute
+	if err := json.Unmarshal(data.Raw, &dp); err != nil {
+		return err
+	}
+
+	d, err := s.convertDispute(ctx, &dp)
+	if err != nil {
+		return err
+	}
+
+	return s.saveDispute(ctx, d)
+}
+
+func (s *StripeProvider) handleCouponSaved(ctx context.Context, data *stripe.EventData) error {
+	var c stripe.Coupon
+	if err := json.Unmarshal(data.Raw, &c); err != nil {
+		return err
+	}
+
+	return s.saveCoupon(ctx, convertCoupon(&c))
+}
+
+// handleCouponDeleted keeps the coupon as invalid so that the subscriptions it was applied to still refer to it
+func (s *StripeProvider) handleCouponDeleted(ctx context.Context, data *stripe.EventData) error {
+	var c stripe.Coupon
+	if err := json.Unmarshal(data.Raw, &c); err != nil {
+		return err
+	}
+
+	coupon := convertCoupon(&c)
+	coupon.Valid = false
+	return s.saveCoupon(ctx, coupon)
+}
+
+func (s *StripeProvider) handlePromotionCodeSaved(ctx context.Context, data *stripe.EventData) error {
+	var pc stripe.PromotionCode
+	if err := json.Unmarshal(data.Raw, &pc); err != nil {
+		return err
+	}
+
+	promo, err := s.convertPromotionCode(ctx, &pc)
+	if err != nil {
+		return err
+	}
+
+	return s.savePromotionCode(ctx, promo)
 }
 
-func (StripeProvider) convertCustomer(c *stripe.Customer) *Customer {
+// handlePaymentIntent stores the latest charge of the payment intent when it is part of the payload.
+// The charge usually is only referenced by id, in which case it is stored from the charge events
+func (s *StripeProvider) handlePaymentIntent(ctx context.Context, data *stripe.EventData) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(data.Raw, &pi); err != nil {
+		return err
+	}
+
+	if pi.LatestCharge == nil || pi.LatestCharge.Object != "charge" {
+		return nil
+	}
+
+	_, err := s.saveStripeCharge(ctx, pi.LatestCharge)
+	return err
+}
+
+func (s *StripeProvider) saveStripeCharge(ctx context.Context, ch *stripe.Charge) (*Charge, error) {
+	c, err := s.convertCharge(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.saveCharge(ctx, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// saveStripeInvoice converts and saves the invoice, linking its charge when the charge was received first
+func (s *StripeProvider) saveStripeInvoice(ctx context.Context, inv *stripe.Invoice) (*Invoice, error) {
+	i, err := s.convertInvoice(ctx, inv)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.saveInvoice(ctx, i); err != nil {
+		return nil, err
+	}
+
+	if inv.Charge != nil {
+		if err := s.linkInvoiceCharge(ctx, i, inv.Charge.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return i, nil
+}
+
+func (*StripeProvider) convertCustomer(c *stripe.Customer) *Customer {
 	return &Customer{
 		ProviderID: c.ID,
 		Provider:   ProviderStripe,
@@ -239,7 +743,7 @@ func (StripeProvider) convertCustomer(c *stripe.Customer) *Customer {
 	}
 }
 
-func (StripeProvider) convertProduct(p *stripe.Product) *Plan {
+func (*StripeProvider) convertProduct(p *stripe.Product) *Plan {
 	return &Plan{
 		Name:        p.Name,
 		Description: p.Description,
@@ -249,8 +753,47 @@ func (StripeProvider) convertProduct(p *stripe.Product) *Plan {
 	}
 }
 
-func (s *StripeProvider) convertPrice(p *stripe.Price) (*Price, error) {
-	pl, err := s.GetPlanByProviderID(ProviderStripe, p.Product.ID)
+// convertFeatures reads plan features from product metadata.
+// Values are either true or false, a number for the limit or unlimited
+func (s *StripeProvider) convertFeatures(p *stripe.Product) []PlanFeature {
+	var keys []string
+	for k := range p.Metadata {
+		if strings.HasPrefix(k, s.config.FeatureMetadataPrefix) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	var features []PlanFeature
+	for _, k := range keys {
+		f := PlanFeature{
+			Key:     strings.TrimPrefix(k, s.config.FeatureMetadataPrefix),
+			Enabled: true,
+		}
+
+		switch v := strings.TrimSpace(p.Metadata[k]); v {
+		case "true", "unlimited":
+		case "false":
+			f.Enabled = false
+		default:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				log.Printf("invalid value %q for feature %s of product %s", v, k, p.ID)
+				continue
+			}
+
+			f.Limit = &n
+		}
+
+		features = append(features, f)
+	}
+
+	return features
+}
+
+func (s *StripeProvider) convertPrice(ctx context.Context, p *stripe.Price) (*Price, error) {
+	pl, err := s.GetPlanByProviderIDContext(ctx, ProviderStripe, p.Product.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -260,42 +803,413 @@ func (s *StripeProvider) convertPrice(p *stripe.Price) (*Price, error) {
 		ProviderID: p.ID,
 		Amount:     p.UnitAmount,
 		Currency:   string(p.Currency),
-		Schedule:   s.convertPricingSchedule(p),
-		TrialDays:  int(p.Recurring.TrialPeriodDays), // TODO: check if this is actually sent through in the webhook
 		PlanID:     pl.ID,
 	}
 
+	// one time prices have no recurring params
+	if p.Recurring != nil {
+		pr.Interval = PriceInterval(p.Recurring.Interval)
+		pr.IntervalCount = int(p.Recurring.IntervalCount)
+		pr.TrialDays = int(p.Recurring.TrialPeriodDays) // TODO: check if this is actually sent through in the webhook
+		pr.UsageType = UsageType(p.Recurring.UsageType)
+		pr.AggregateUsage = AggregateUsage(p.Recurring.AggregateUsage)
+	}
+
+	if pr.UsageType == "" {
+		pr.UsageType = UsageLicensed
+	}
+
+	if !pr.IsMetered() {
+		pr.AggregateUsage = ""
+	}
+
+	pr.BillingScheme = BillingPerUnit
+	if p.BillingScheme == stripe.PriceBillingSchemeTiered {
+		pr.BillingScheme = BillingTiered
+		pr.TiersMode = TiersMode(p.TiersMode)
+		pr.Tiers = convertPriceTiers(p.Tiers)
+
+		// tiers are only sent when expanded, which is not the case for webhook events.
+		// Tiers can't change once a price is created so the stored ones are kept, Sync fetches them when there are none
+		if p.Tiers == nil {
+			prev, err := s.GetPriceByProviderContext(ctx, ProviderStripe, p.ID)
+			if err != nil && !errors.Is(err, orm.ErrNotFound) {
+				return nil, err
+			}
+
+			if prev != nil {
+				pr.Tiers = prev.Tiers
+			}
+		}
+	}
+
 	return pr, nil
 }
 
-func (s *StripeProvider) convertSubscription(sub *stripe.Subscription) (*Subscription, error) {
-	// ensure that the first item is a subscription
-	if sub.Items == nil ||
-		len(sub.Items.Data) == 0 ||
-		sub.Items.Data[0].Price == nil {
+func convertPriceTiers(tiers []*stripe.PriceTier) []PriceTier {
+	var converted []PriceTier
+	for _, t := range tiers {
+		tier := PriceTier{
+			UnitAmount: t.UnitAmount,
+			FlatAmount: t.FlatAmount,
+		}
+
+		// the last tier is sent with up_to null
+		if t.UpTo > 0 {
+			upTo := t.UpTo
+			tier.UpTo = &upTo
+		}
+
+		converted = append(converted, tier)
+	}
+
+	return converted
+}
+
+func (s *StripeProvider) convertSubscription(ctx context.Context, sub *stripe.Subscription) (*Subscription, error) {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
 		return nil, errors.New("unable to get price id from subscription")
 	}
 
-	priceID := sub.Items.Data[0].Price.ID
-	pr, err := s.GetPriceByProvider(ProviderStripe, priceID)
+	items := make([]SubscriptionItem, 0, len(sub.Items.Data))
+	prices := make(map[string]*Price, len(sub.Items.Data))
+	for _, it := range sub.Items.Data {
+		if it.Price == nil {
+			return nil, fmt.Errorf("subscription item %s has no price", it.ID)
+		}
+
+		pr, err := s.GetPriceByProviderContext(ctx, ProviderStripe, it.Price.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get price %s: %w", it.Price.ID, err)
+		}
+
+		prices[it.Price.ID] = pr
+		items = append(items, SubscriptionItem{
+			ProviderID: it.ID,
+			PriceID:    pr.ID,
+			Quantity:   it.Quantity,
+		})
+	}
+
+	base, err := s.stripeBaseItem(ctx, sub)
 	if err != nil {
-		return nil, fmt.Errorf("could not get price %s: %w", priceID, err)
+		return nil, err
 	}
 
-	cust, err := s.GetCustomerByProvider(ProviderStripe, sub.Customer.ID)
+	pr := prices[base.Price.ID]
+
+	cust, err := s.GetCustomerByProviderContext(ctx, ProviderStripe, sub.Customer.ID)
 	if err != nil {
 		return nil, fmt.Errorf("could not get customer with provider_id = %s for subscription %s: %w",
 			sub.Customer.ID, sub.ID, err)
 	}
 
+	// metered items have no quantity, they still count as a single seat
+	quantity := base.Quantity
+	if quantity == 0 && pr.IsMetered() {
+		quantity = 1
+	}
+
 	subscr := Subscription{
 		Provider:   ProviderStripe,
 		ProviderID: sub.ID,
 		CustomerID: cust.ID,
 		PriceID:    pr.ID,
+		Quantity:   quantity,
 		Active:     sub.Status == stripe.SubscriptionStatusActive || sub.Status == stripe.SubscriptionStatusTrialing,
+		Status:     string(sub.Status),
 		CreatedAt:  time.Unix(sub.Created, 0),
+
+		CurrentPeriodStart: time.Unix(sub.CurrentPeriodStart, 0),
+		CurrentPeriodEnd:   time.Unix(sub.CurrentPeriodEnd, 0),
+		TrialStart:         convertTimestamp(sub.TrialStart),
+		TrialEnd:           convertTimestamp(sub.TrialEnd),
+		EndedAt:            convertTimestamp(sub.EndedAt),
+
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+		CanceledAt:        convertTimestamp(sub.CanceledAt),
+
+		Items: items,
+	}
+
+	if sub.PauseCollection != nil {
+		subscr.PauseCollection = string(sub.PauseCollection.Behavior)
+	}
+
+	if d := sub.Discount; d != nil && d.Coupon != nil {
+		couponID, err := s.stripeCouponID(ctx, d.Coupon)
+		if err != nil {
+			return nil, fmt.Errorf("could not get coupon %s for subscription %s: %w", d.Coupon.ID, sub.ID, err)
+		}
+
+		subscr.CouponID = &couponID
+		subscr.DiscountStart = convertTimestamp(d.Start)
+		subscr.DiscountEnd = convertTimestamp(d.End)
+
+		// promotion codes that have not been received yet are linked once their event arrives or they are synced
+		if d.PromotionCode != nil {
+			subscr.PromotionCodeProviderID = d.PromotionCode.ID
+
+			promo, err := s.GetPromotionCodeByProvider(ctx, ProviderStripe, d.PromotionCode.ID)
+			if err != nil && !errors.Is(err, orm.ErrNotFound) {
+				return nil, err
+			}
+
+			if promo != nil {
+				subscr.PromotionCodeID = &promo.ID
+			}
+		}
 	}
 
 	return &subscr, nil
 }
+
+// stripeBaseItem returns the item of the subscription holding its seats. This is the item with the price already stored
+// for the subscription, then the item with the price the subscription was checked out for and otherwise the first item
+func (s *StripeProvider) stripeBaseItem(ctx context.Context, sub *stripe.Subscription) (*stripe.SubscriptionItem, error) {
+	var priceIDs []string
+
+	prev, err := s.GetSubscriptionByProviderContext(ctx, ProviderStripe, sub.ID)
+	if err != nil && !errors.Is(err, orm.ErrNotFound) {
+		return nil, err
+	}
+
+	if prev != nil {
+		pr, err := s.GetPriceByIDContext(ctx, prev.PriceID)
+		if err != nil {
+			return nil, err
+		}
+
+		priceIDs = append(priceIDs, pr.ProviderID)
+	}
+
+	if id := sub.Metadata[basePriceMetadataKey]; id != "" {
+		priceIDs = append(priceIDs, id)
+	}
+
+	for _, id := range priceIDs {
+		for _, it := range sub.Items.Data {
+			if it.Price.ID == id {
+				return it, nil
+			}
+		}
+	}
+
+	return sub.Items.Data[0], nil
+}
+
+func (s *StripeProvider) convertInvoice(ctx context.Context, inv *stripe.Invoice) (*Invoice, error) {
+	if inv.Customer == nil {
+		return nil, fmt.Errorf("invoice %s has no customer", inv.ID)
+	}
+
+	cust, err := s.GetCustomerByProviderContext(ctx, ProviderStripe, inv.Customer.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get customer with provider_id = %s for invoice %s: %w",
+			inv.Customer.ID, inv.ID, err)
+	}
+
+	i := Invoice{
+		Provider:         ProviderStripe,
+		ProviderID:       inv.ID,
+		CustomerID:       cust.ID,
+		Number:           inv.Number,
+		Status:           string(inv.Status),
+		AmountDue:        inv.AmountDue,
+		AmountPaid:       inv.AmountPaid,
+		Currency:         string(inv.Currency),
+		PeriodStart:      time.Unix(inv.PeriodStart, 0),
+		PeriodEnd:        time.Unix(inv.PeriodEnd, 0),
+		HostedInvoiceURL: inv.HostedInvoiceURL,
+		InvoicePDF:       inv.InvoicePDF,
+		CreatedAt:        time.Unix(inv.Created, 0),
+	}
+
+	// the subscription event may not have been handled yet, in which case the invoice event is retried
+	if inv.Subscription != nil {
+		sub, err := s.GetSubscriptionByProviderContext(ctx, ProviderStripe, inv.Subscription.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get subscription %s for invoice %s: %w", inv.Subscription.ID, inv.ID, err)
+		}
+
+		i.SubscriptionID = &sub.ID
+	}
+
+	return &i, nil
+}
+
+func (s *StripeProvider) convertCharge(ctx context.Context, ch *stripe.Charge) (*Charge, error) {
+	c := Charge{
+		Provider:       ProviderStripe,
+		ProviderID:     ch.ID,
+		Amount:         ch.Amount,
+		AmountRefunded: ch.AmountRefunded,
+		Currency:       string(ch.Currency),
+		Status:         string(ch.Status),
+		Refunded:       ch.Refunded,
+		FailureMessage: ch.FailureMessage,
+		CreatedAt:      time.Unix(ch.Created, 0),
+	}
+
+	if ch.PaymentIntent != nil {
+		c.PaymentIntentID = ch.PaymentIntent.ID
+	}
+
+	// guest payments have no customer
+	if ch.Customer != nil {
+		cust, err := s.GetCustomerByProviderContext(ctx, ProviderStripe, ch.Customer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get customer with provider_id = %s for charge %s: %w",
+				ch.Customer.ID, ch.ID, err)
+		}
+
+		c.CustomerID = &cust.ID
+	}
+
+	// charges can arrive before their invoice, which links them once it is received
+	if ch.Invoice != nil {
+		inv, err := s.GetInvoiceByProvider(ctx, ProviderStripe, ch.Invoice.ID)
+		if err != nil && !errors.Is(err, orm.ErrNotFound) {
+			return nil, fmt.Errorf("could not get invoice %s for charge %s: %w", ch.Invoice.ID, ch.ID, err)
+		}
+
+		if err == nil {
+			c.InvoiceID = &inv.ID
+		}
+	}
+
+	return &c, nil
+}
+
+func (*StripeProvider) convertRefund(re *stripe.Refund, c *Charge) *Refund {
+	return &Refund{
+		Provider:      ProviderStripe,
+		ProviderID:    re.ID,
+		ChargeID:      c.ID,
+		Amount:        re.Amount,
+		Currency:      string(re.Currency),
+		Status:        string(re.Status),
+		Reason:        string(re.Reason),
+		FailureReason: string(re.FailureReason),
+		CreatedAt:     time.Unix(re.Created, 0),
+	}
+}
+
+func (s *StripeProvider) convertDispute(ctx context.Context, dp *stripe.Dispute) (*Dispute, error) {
+	if dp.Charge == nil {
+		return nil, fmt.Errorf("dispute %s has no charge", dp.ID)
+	}
+
+	c, err := s.GetChargeByProvider(ctx, ProviderStripe, dp.Charge.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not get charge %s for dispute %s: %w", dp.Charge.ID, dp.ID, err)
+	}
+
+	d := Dispute{
+		Provider:   ProviderStripe,
+		ProviderID: dp.ID,
+		ChargeID:   c.ID,
+		Amount:     dp.Amount,
+		Currency:   string(dp.Currency),
+		Status:     string(dp.Status),
+		Reason:     string(dp.Reason),
+		CreatedAt:  time.Unix(dp.Created, 0),
+	}
+
+	if dp.EvidenceDetails != nil {
+		d.EvidenceDueBy = convertTimestamp(dp.EvidenceDetails.DueBy)
+	}
+
+	return &d, nil
+}
+
+func convertCoupon(c *stripe.Coupon) *Coupon {
+	return &Coupon{
+		Provider:         ProviderStripe,
+		ProviderID:       c.ID,
+		Name:             c.Name,
+		PercentOff:       c.PercentOff,
+		AmountOff:        c.AmountOff,
+		Currency:         string(c.Currency),
+		Duration:         string(c.Duration),
+		DurationInMonths: int(c.DurationInMonths),
+		MaxRedemptions:   c.MaxRedemptions,
+		TimesRedeemed:    c.TimesRedeemed,
+		RedeemBy:         convertTimestamp(c.RedeemBy),
+		Valid:            c.Valid,
+		CreatedAt:        time.Unix(c.Created, 0),
+	}
+}
+
+func (s *StripeProvider) convertPromotionCode(ctx context.Context, pc *stripe.PromotionCode) (*PromotionCode, error) {
+	if pc.Coupon == nil {
+		return nil, fmt.Errorf("promotion code %s has no coupon", pc.ID)
+	}
+
+	couponID, err := s.stripeCouponID(ctx, pc.Coupon)
+	if err != nil {
+		return nil, fmt.Errorf("could not get coupon %s for promotion code %s: %w", pc.Coupon.ID, pc.ID, err)
+	}
+
+	promo := PromotionCode{
+		Provider:       ProviderStripe,
+		ProviderID:     pc.ID,
+		CouponID:       couponID,
+		Code:           pc.Code,
+		Active:         pc.Active,
+		MaxRedemptions: pc.MaxRedemptions,
+		TimesRedeemed:  pc.TimesRedeemed,
+		ExpiresAt:      convertTimestamp(pc.ExpiresAt),
+		CreatedAt:      time.Unix(pc.Created, 0),
+	}
+
+	if pc.Customer != nil {
+		cust, err := s.GetCustomerByProviderContext(ctx, ProviderStripe, pc.Customer.ID)
+		if err != nil {
+			return nil, fmt.Errorf("could not get customer %s for promotion code %s: %w", pc.Customer.ID, pc.ID, err)
+		}
+
+		promo.CustomerID = &cust.ID
+	}
+
+	return &promo, nil
+}
+
+// stripeCouponID returns the id of the coupon, storing it first when it has not been seen yet.
+// Coupons are sent in full with subscriptions and promotion codes so they don't have to be retrieved
+func (s *StripeProvider) stripeCouponID(ctx context.Context, c *stripe.Coupon) (int64, error) {
+	found, err := s.GetCouponByProvider(ctx, ProviderStripe, c.ID)
+	if err == nil {
+		return found.ID, nil
+	}
+
+	if !errors.Is(err, orm.ErrNotFound) {
+		return 0, err
+	}
+
+	coupon := convertCoupon(c)
+	if err := s.saveCoupon(ctx, coupon); err != nil {
+		return 0, err
+	}
+
+	return coupon.ID, nil
+}
+
+// convertTimestamp returns nil for the zero timestamps stripe sends for unset times
+func convertTimestamp(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+
+	t := time.Unix(ts, 0)
+	return &t
+}
+
+// ignoreNotFound treats the removal of an entity that does not exist as successful
+func ignoreNotFound(err error) error {
+	if errors.Is(err, orm.ErrNotFound) {
+		return nil
+	}
+
+	return err
+}